@@ -2,10 +2,22 @@ package main
 
 import (
 	"backend/pkg/vars"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
@@ -13,6 +25,14 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 )
 
+const (
+	HeaderIdempotencyKey     = "Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+	HeaderTotalCount         = "X-Total-Count"
+	HeaderNextCursor         = "X-Next-Cursor"
+	HeaderLocationID         = "X-Location-ID"
+)
+
 type Server struct {
 	minPassword int
 	maxPassword int
@@ -26,7 +46,36 @@ type Server struct {
 	uc Usecase
 }
 
-func NewServer(ip string, port int, minPassword, maxPassword, minUsername, maxUsername int, secret string, uc Usecase) *Server {
+// Определение адреса клиента для журнала и защиты входа. Заголовкам
+// X-Forwarded-For и X-Real-IP без доверенного прокси верить нельзя:
+// клиент подставит в них любой адрес.
+func NewIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted_proxies: invalid address %q", proxy)
+			}
+			if ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %v", err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+func NewServer(ip string, port int, minPassword, maxPassword, minUsername, maxUsername int, secret string, ipExtractor echo.IPExtractor, uc Usecase) *Server {
 	api := Server{
 		minPassword: minPassword,
 		maxPassword: maxPassword,
@@ -36,12 +85,14 @@ func NewServer(ip string, port int, minPassword, maxPassword, minUsername, maxUs
 	}
 
 	api.server = echo.New()
+	api.server.IPExtractor = ipExtractor
 	api.server.Use(middleware.Logger())
 	api.server.Use(middleware.Recover())
 	api.server.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"http://localhost:3000"},
-		AllowMethods: []string{echo.GET, echo.POST, echo.PUT, echo.DELETE, echo.OPTIONS},
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAuthorization},
+		AllowOrigins:  []string{"http://localhost:3000"},
+		AllowMethods:  []string{echo.GET, echo.POST, echo.PUT, echo.DELETE, echo.OPTIONS},
+		AllowHeaders:  []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAuthorization, HeaderIdempotencyKey, HeaderLocationID, "Last-Event-ID"},
+		ExposeHeaders: []string{HeaderIdempotentReplayed, HeaderTotalCount, HeaderNextCursor, echo.HeaderRetryAfter},
 	}))
 
 	api.RegisterRoutes()
@@ -54,6 +105,11 @@ func (api *Server) RegisterRoutes() {
 	// Публичные маршруты без JWT аутентификации
 	api.server.POST("/api/register", api.Register)
 	api.server.POST("/api/login", api.Login)
+	api.server.POST("/api/invites/accept", api.AcceptInvite)
+	api.server.POST("/api/password/forgot", api.ForgotPassword)
+	api.server.POST("/api/password/reset", api.ResetPassword)
+	// Отзыв гостя по подписанной ссылке с чека
+	api.server.POST("/api/feedback", api.SubmitFeedback)
 
 	// Конфигурация JWT мидлвари
 	config := echojwt.Config{
@@ -63,20 +119,110 @@ func (api *Server) RegisterRoutes() {
 		SigningKey: []byte(api.uc.jp.secretKey),
 	}
 
+	// Лента событий: EventSource в браузере не умеет передавать заголовки,
+	// поэтому вместо токена в параметре ticket передаётся короткоживущий билет,
+	// выданный по обычному токену. Сам токен в URL и журналы не попадает.
+	api.server.POST("/api/orders/stream-ticket", api.IssueStreamTicket, echojwt.WithConfig(config), api.activeUser)
+	streamConfig := config
+	streamConfig.SigningKey = api.uc.jp.streamKey()
+	streamConfig.TokenLookup = "header:Authorization:Bearer ,query:ticket"
+	api.server.GET("/api/orders/stream", api.StreamOrders, echojwt.WithConfig(streamConfig), api.activeUser)
+
 	// Группа защищённых маршрутов с префиксом /api
 	apiGroup := api.server.Group("/api")
 	apiGroup.Use(echojwt.WithConfig(config))
+	apiGroup.Use(api.activeUser)
+	apiGroup.Use(api.auditLog)
 
 	// Защищённые маршруты (без дополнительного /api)
+	apiGroup.GET("/me", api.GetMe)
+	apiGroup.PUT("/me/password", api.ChangePassword)
+	apiGroup.GET("/users", api.GetUsers, ownerOnly)
+	apiGroup.GET("/users/invites", api.GetInvites, ownerOnly)
+	apiGroup.POST("/users/invites", api.InviteUser, ownerOnly)
+	apiGroup.DELETE("/users/invites/:id", api.RevokeInvite, ownerOnly)
+	apiGroup.PUT("/users/:id/role", api.SetUserRole, ownerOnly)
+	apiGroup.POST("/users/:id/deactivate", api.DeactivateUser, ownerOnly)
+	apiGroup.POST("/users/:id/activate", api.ActivateUser, ownerOnly)
+	apiGroup.POST("/users/:id/reset-password", api.ResetUserPassword, ownerOnly)
 	apiGroup.GET("/menu", api.GetMenu)
 	apiGroup.DELETE("/menu/:id", api.DeleteMenuItem)
 	apiGroup.PUT("/menu/:id", api.UpdateMenuItem)
 	apiGroup.POST("/menu", api.AddMenuItem)
 	apiGroup.POST("/orders", api.AddOrder)
 	apiGroup.GET("/orders", api.GetOrders)
-	apiGroup.PUT("/orders/:id/status", api.UpdateOrderStatus)
+	apiGroup.GET("/orders/:id", api.GetOrder, api.orderAccess)
+	apiGroup.PUT("/orders/:id/status", api.UpdateOrderStatus, api.orderAccess)
+	apiGroup.POST("/orders/:id/items", api.AddOrderLine, api.orderAccess)
+	apiGroup.PUT("/orders/:id/items/:itemId", api.ChangeOrderLine, api.orderAccess)
+	apiGroup.DELETE("/orders/:id/items/:itemId", api.RemoveOrderLine, api.orderAccess)
+	apiGroup.GET("/orders/:id/audit", api.GetOrderAudit, api.orderAccess)
+	apiGroup.POST("/orders/:id/refunds", api.RefundOrder, api.orderAccess)
+	apiGroup.GET("/orders/:id/refunds", api.GetRefunds, api.orderAccess)
+	apiGroup.GET("/orders/:id/receipt", api.GetReceipt, api.orderAccess)
+	apiGroup.POST("/orders/:id/print", api.PrintOrder, api.orderAccess)
+	apiGroup.GET("/orders/:id/fiscal", api.GetOrderFiscal, api.orderAccess)
+	apiGroup.POST("/orders/:id/fiscal", api.FiscalizeOrder, api.orderAccess)
+	apiGroup.POST("/orders/:id/fiscal/correction", api.CorrectOrderFiscal, ownerOnly, api.orderAccess)
+	apiGroup.GET("/fiscal", api.GetFiscalQueue, ownerOnly)
+	apiGroup.POST("/fiscal/:id/retry", api.RetryFiscalDocument, ownerOnly)
+	apiGroup.GET("/print-jobs", api.GetPrintJobs, ownerOnly)
+	apiGroup.POST("/print-jobs/:id/retry", api.RetryPrintJob, ownerOnly)
+	apiGroup.GET("/orders/:id/feedback", api.GetOrderFeedback, api.orderAccess)
+	apiGroup.GET("/orders/:id/feedback-token", api.GetFeedbackToken, api.orderAccess)
+	apiGroup.GET("/feedback", api.GetFeedback)
+	apiGroup.GET("/feedback/analytics", api.GetFeedbackAnalytics, ownerOnly)
+	apiGroup.GET("/stations", api.GetStations)
+	apiGroup.POST("/stations", api.AddStation)
+	apiGroup.DELETE("/stations/:id", api.DeleteStation)
+	apiGroup.PUT("/menu/:id/station", api.SetMenuItemStation)
+	apiGroup.GET("/kds/stations/:id/lines", api.GetStationLines)
+	apiGroup.POST("/kds/lines/:id/bump", api.BumpOrderItem)
+	apiGroup.GET("/business/status", api.GetBusinessStatus)
+	apiGroup.GET("/locations", api.GetLocations)
+	apiGroup.POST("/locations", api.AddLocation, ownerOnly)
+	apiGroup.PUT("/locations/:id/menu/:menuId", api.SetMenuLocationPrice, ownerOnly)
+	apiGroup.DELETE("/locations/:id/menu/:menuId", api.DeleteMenuLocationPrice, ownerOnly)
+	apiGroup.PUT("/locations/:id/users/:userId", api.GrantLocation, ownerOnly)
+	apiGroup.DELETE("/locations/:id/users/:userId", api.RevokeLocation, ownerOnly)
+	apiGroup.GET("/customers", api.GetCustomers)
+	apiGroup.POST("/customers", api.AddCustomer)
+	apiGroup.GET("/customers/:id", api.GetCustomer)
+	apiGroup.PUT("/customers/:id", api.UpdateCustomer)
+	apiGroup.GET("/customers/:id/points", api.GetCustomerPoints)
+	apiGroup.GET("/customers/:id/stamps", api.GetCustomerStamps)
+	apiGroup.GET("/stamp-programs", api.GetStampPrograms)
+	apiGroup.POST("/stamp-programs", api.AddStampProgram, ownerOnly)
+	apiGroup.PUT("/stamp-programs/:id", api.UpdateStampProgram, ownerOnly)
+	apiGroup.POST("/gift-cards", api.IssueGiftCard)
+	apiGroup.GET("/gift-cards/liability", api.GetGiftCardLiability, ownerOnly)
+	apiGroup.GET("/gift-cards/:code", api.GetGiftCard)
+	apiGroup.POST("/gift-cards/:code/activate", api.ActivateGiftCard)
+	apiGroup.POST("/gift-cards/:code/top-up", api.TopUpGiftCard)
+	apiGroup.POST("/gift-cards/:code/redeem", api.RedeemGiftCard)
+	apiGroup.POST("/gift-cards/:code/void", api.VoidGiftCard, ownerOnly)
+	apiGroup.GET("/tables", api.GetTables)
+	apiGroup.POST("/tables", api.AddTable, ownerOnly)
+	apiGroup.PUT("/tables/:id", api.UpdateTable, ownerOnly)
+	apiGroup.GET("/reservations", api.GetReservations)
+	apiGroup.POST("/reservations", api.AddReservation)
+	apiGroup.GET("/reservations/availability", api.GetAvailability)
+	apiGroup.GET("/reservations/:id", api.GetReservation, api.reservationAccess)
+	apiGroup.PUT("/reservations/:id", api.UpdateReservation, api.reservationAccess)
+	apiGroup.PUT("/reservations/:id/status", api.SetReservationStatus, api.reservationAccess)
+	apiGroup.POST("/reservations/:id/order", api.OpenReservationOrder, api.reservationAccess)
+	apiGroup.POST("/shifts", api.OpenShift)
+	apiGroup.GET("/shifts", api.GetShifts)
+	apiGroup.GET("/shifts/current", api.GetCurrentShift)
+	apiGroup.POST("/shifts/current/cash", api.AddCashOperation)
+	apiGroup.GET("/shifts/current/report", api.GetXReport)
+	apiGroup.POST("/shifts/current/close", api.CloseShift)
+	apiGroup.GET("/shifts/:id/report", api.GetShiftReport)
 	apiGroup.GET("/revenue", api.GetRevenue)
 	apiGroup.GET("/order_counts", api.GetOrderCounts)
+	apiGroup.GET("/order_types", api.GetOrderTypeBreakdown)
+	apiGroup.GET("/audit", api.GetAudit, ownerOnly)
+	apiGroup.GET("/login-lockouts", api.GetLoginLockouts, ownerOnly)
 }
 func (api *Server) Run() {
 	api.server.Logger.Fatal(api.server.Start(api.address))
@@ -108,6 +254,12 @@ func (srv *Server) Register(c echo.Context) error {
 	}
 
 	err = srv.uc.Register(user.Name, user.Email, user.Password)
+	if errors.Is(err, ErrRegistrationClose) {
+		return echo.NewHTTPError(http.StatusForbidden, "Регистрация закрыта, попросите владельца прислать приглашение")
+	}
+	if errors.Is(err, ErrUserExists) {
+		return echo.NewHTTPError(http.StatusConflict, "User already exists")
+	}
 	if err != nil {
 		log.Printf("Error registering user: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create account")
@@ -124,21 +276,35 @@ func (srv *Server) Login(c echo.Context) error {
 
 	err := c.Bind(&user)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid login data")
 	}
 
 	if user.Email == "" || user.Password == "" {
 		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid credentials")
 	}
 
-	token, err := srv.uc.Authenticate(user.Email, user.Password)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	token, err := srv.uc.Authenticate(user.Email, user.Password, c.RealIP())
+	var throttled *LoginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		return tooManyRequests(c, throttled, "Too many login attempts, try again later")
+	case errors.Is(err, ErrInvalidCredentials):
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid credentials")
+	case err != nil:
+		log.Printf("Error authenticating user: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to log in")
 	}
 
 	return c.JSON(http.StatusOK, echo.Map{"token": token})
 }
 
+// Ответ 429 с Retry-After в целых секундах
+func tooManyRequests(c echo.Context, throttled *LoginThrottledError, msg string) error {
+	retry := int(math.Ceil(throttled.RetryAfter.Seconds()))
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(retry))
+	return echo.NewHTTPError(http.StatusTooManyRequests, msg)
+}
+
 func (srv *Server) AuthMiddleware(c echo.Context) error {
 	user := c.Get("user").(*jwt.Token)
 	if user == nil {
@@ -152,7 +318,12 @@ func (srv *Server) AuthMiddleware(c echo.Context) error {
 }
 
 func (srv *Server) GetMenu(c echo.Context) error {
-	menuItems, err := srv.uc.GetMenuItems()
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+
+	menuItems, err := srv.uc.GetMenuItems(locationID)
 	if err != nil {
 		log.Printf("Error fetching menu items: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to fetch menu items")
@@ -188,6 +359,7 @@ func (srv *Server) UpdateMenuItem(c echo.Context) error {
 		Name        string  `json:"name"`
 		Description string  `json:"description"`
 		Price       float64 `json:"price"`
+		Category    string  `json:"category"`
 	}
 	if err := c.Bind(&input); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные")
@@ -198,6 +370,7 @@ func (srv *Server) UpdateMenuItem(c echo.Context) error {
 		Name:        input.Name,
 		Description: input.Description,
 		Price:       input.Price,
+		Category:    sanitizeText(input.Category, false),
 	}
 
 	updatedItem, err := srv.uc.UpdateMenuItem(item)
@@ -213,6 +386,7 @@ func (srv *Server) AddMenuItem(c echo.Context) error {
 		Name        string  `json:"name"`
 		Description string  `json:"description"`
 		Price       float64 `json:"price"`
+		Category    string  `json:"category"`
 	}
 	if err := c.Bind(&input); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные")
@@ -222,6 +396,7 @@ func (srv *Server) AddMenuItem(c echo.Context) error {
 		Name:        input.Name,
 		Description: input.Description,
 		Price:       input.Price,
+		Category:    sanitizeText(input.Category, false),
 	}
 
 	newItem, err := srv.uc.AddMenuItem(item)
@@ -234,11 +409,30 @@ func (srv *Server) AddMenuItem(c echo.Context) error {
 }
 func (srv *Server) AddOrder(c echo.Context) error {
 	var input struct {
-		Items []struct {
-			MenuItemId int `json:"menuItemId"`
-			Quantity   int `json:"quantity"`
-		} `json:"items"`
+		Items        []orderItemInput `json:"items"`
+		OrderType    string           `json:"orderType"`
+		TableNumber  *int             `json:"tableNumber"`
+		CustomerName string           `json:"customerName"`
+		Note         string           `json:"note"`
+		PickupAt     *time.Time       `json:"pickupAt"`
+		// Способ оплаты: cash (по умолчанию) или card
+		PaymentMethod string `json:"paymentMethod"`
+		// Телефон покупателя и баллы, которыми он оплачивает часть заказа
+		CustomerPhone string `json:"customerPhone"`
+		RedeemPoints  int    `json:"redeemPoints"`
+		// Подарочная карта и сумма к списанию; без суммы списывается сколько возможно
+		GiftCardCode   string  `json:"giftCardCode"`
+		GiftCardAmount float64 `json:"giftCardAmount"`
+		// Принять заказ, даже если кафе закрыто
+		OverrideClosed bool `json:"overrideClosed"`
+	}
+
+	// Тело запроса читается заранее, чтобы сверить повторы по ключу идемпотентности
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные заказа")
 	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
 
 	// Привязка входящих данных
 	if err := c.Bind(&input); err != nil {
@@ -246,39 +440,270 @@ func (srv *Server) AddOrder(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные заказа")
 	}
 
-	// Проверка наличия элементов
-	if len(input.Items) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Заказ должен содержать хотя бы один товар")
+	orderItems, err := parseOrderItems(input.Items)
+	if err != nil {
+		return err
 	}
 
-	orderItems := make([]OrderItem, len(input.Items))
-	for i, item := range input.Items {
+	if input.OrderType != "" && !OrderTypes[input.OrderType] {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый тип заказа")
+	}
+	if input.PaymentMethod != "" && !PaymentMethods[input.PaymentMethod] {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый способ оплаты")
+	}
+	if input.RedeemPoints < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректное количество баллов")
+	}
+	if input.GiftCardAmount < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректная сумма по подарочной карте")
+	}
+	if input.TableNumber != nil && *input.TableNumber <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректный номер стола")
+	}
+	input.CustomerName = sanitizeText(input.CustomerName, false)
+	if utf8.RuneCountInString(input.CustomerName) > MaxCustomerNameSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "Имя гостя должно быть не длиннее "+strconv.Itoa(MaxCustomerNameSize)+" символов")
+	}
+	input.Note = sanitizeText(input.Note, true)
+	if utf8.RuneCountInString(input.Note) > MaxOrderNoteSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "Примечание к заказу должно быть не длиннее "+strconv.Itoa(MaxOrderNoteSize)+" символов")
+	}
+
+	locationID, err := srv.writeLocation(c)
+	if err != nil {
+		return err
+	}
+
+	key := c.Request().Header.Get(HeaderIdempotencyKey)
+	if len(key) > 255 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Слишком длинный ключ идемпотентности")
+	}
+	hash := sha256.Sum256(body)
+
+	newOrder, replayed, err := srv.uc.AddOrder(OrderRequest{
+		Items:             orderItems,
+		Type:              input.OrderType,
+		TableNumber:       input.TableNumber,
+		CustomerName:      input.CustomerName,
+		Note:              input.Note,
+		PickupAt:          input.PickupAt,
+		OverrideClosed:    input.OverrideClosed,
+		LocationID:        locationID,
+		PaymentMethod:     input.PaymentMethod,
+		UserID:            currentUser(c).UserID,
+		UserName:          currentUser(c).Username,
+		CustomerPhone:     input.CustomerPhone,
+		RedeemPoints:      input.RedeemPoints,
+		GiftCardCode:      input.GiftCardCode,
+		GiftCardAmount:    input.GiftCardAmount,
+		IdempotencyKey:    key,
+		IdempotencyUserID: currentUser(c).UserID,
+		RequestHash:       hex.EncodeToString(hash[:]),
+	})
+	if err != nil {
+		return addOrderError(err)
+	}
+
+	if replayed {
+		c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+	}
+	return c.JSON(http.StatusOK, newOrder)
+}
+
+type orderItemInput struct {
+	MenuItemId int    `json:"menuItemId"`
+	Quantity   int    `json:"quantity"`
+	Comment    string `json:"comment"`
+}
+
+// Проверка позиций нового заказа
+func parseOrderItems(items []orderItemInput) ([]OrderItem, error) {
+	if len(items) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Заказ должен содержать хотя бы один товар")
+	}
+
+	orderItems := make([]OrderItem, len(items))
+	for i, item := range items {
 		if item.MenuItemId <= 0 || item.Quantity <= 0 {
-			return echo.NewHTTPError(http.StatusBadRequest, "Некорректные данные товара в заказе")
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Некорректные данные товара в заказе")
+		}
+		comment := sanitizeText(item.Comment, false)
+		if utf8.RuneCountInString(comment) > MaxItemCommentSize {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Комментарий к позиции должен быть не длиннее "+strconv.Itoa(MaxItemCommentSize)+" символов")
 		}
 		orderItems[i] = OrderItem{
 			MenuItemId: item.MenuItemId,
 			Quantity:   item.Quantity,
+			Comment:    comment,
 		}
 	}
+	return orderItems, nil
+}
 
-	newOrder, err := srv.uc.AddOrder(orderItems)
-	if err != nil {
-		log.Printf("Error adding order: %v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось добавить заказ")
+func addOrderError(err error) error {
+	switch {
+	case errors.Is(err, ErrIdempotencyKeyConflict):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Ключ идемпотентности уже использован с другими данными")
+	case errors.Is(err, ErrClosed):
+		return echo.NewHTTPError(http.StatusConflict, "Кафе закрыто, заказы не принимаются")
+	case errors.Is(err, ErrLocationNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Точка не найдена")
+	case errors.Is(err, ErrPickupUnavailable):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrSlotFull):
+		return echo.NewHTTPError(http.StatusConflict, "На это время выдачи больше нет мест")
+	case errors.Is(err, ErrNoOpenShift):
+		return echo.NewHTTPError(http.StatusConflict, "Откройте кассовую смену, чтобы принимать заказы")
+	case errors.Is(err, ErrInvalidPhone):
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректный номер телефона")
+	case errors.Is(err, ErrInvalidRedemption):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case isGiftCardError(err):
+		return giftCardError(err, "добавить заказ")
 	}
-
-	return c.JSON(http.StatusOK, newOrder)
+	log.Printf("Error adding order: %v", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось добавить заказ")
 }
+
+// Список заказов с фильтрами и курсорной пагинацией.
+// Параметры: status, order_type, table, upcoming, from, to, min_total, max_total, menu_item_id, customer_id,
+// sort (id, created_at, total), order (asc, desc), limit, cursor.
 func (srv *Server) GetOrders(c echo.Context) error {
-	orders, err := srv.uc.GetOrders()
+	locationID, loc, err := srv.filterScope(c)
 	if err != nil {
+		return err
+	}
+	filter, err := parseOrderFilter(c, loc)
+	if err != nil {
+		return err
+	}
+	filter.LocationID = locationID
+
+	page, err := srv.uc.GetOrders(filter)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Неверный курсор")
+		}
 		log.Printf("Error fetching orders: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить заказы")
 	}
 
-	return c.JSON(http.StatusOK, orders)
+	c.Response().Header().Set(HeaderTotalCount, strconv.Itoa(page.TotalCount))
+	if page.NextCursor != "" {
+		c.Response().Header().Set(HeaderNextCursor, page.NextCursor)
+	}
+	return c.JSON(http.StatusOK, page.Orders)
+}
+
+func parseOrderFilter(c echo.Context, loc *time.Location) (OrderFilter, error) {
+	filter := OrderFilter{
+		Status: c.QueryParam("status"),
+		Type:   c.QueryParam("order_type"),
+		Sort:   c.QueryParam("sort"),
+		Cursor: c.QueryParam("cursor"),
+		Desc:   true,
+	}
+
+	if filter.Type != "" && !OrderTypes[filter.Type] {
+		return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр order_type")
+	}
+	if v := c.QueryParam("upcoming"); v != "" {
+		upcoming, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр upcoming")
+		}
+		filter.Upcoming = upcoming
+	}
+	if v := c.QueryParam("table"); v != "" {
+		table, err := strconv.Atoi(v)
+		if err != nil || table <= 0 {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр table")
+		}
+		filter.TableNumber = table
+	}
+
+	if filter.Sort != "" && filter.Sort != "id" && filter.Sort != "created_at" && filter.Sort != "total" {
+		return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр sort")
+	}
+
+	switch c.QueryParam("order") {
+	case "", "desc":
+	case "asc":
+		filter.Desc = false
+	default:
+		return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр order")
+	}
+
+	if v := c.QueryParam("from"); v != "" {
+		from, _, err := parseDateParam(v, loc)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр from")
+		}
+		filter.From = &from
+	}
+	if v := c.QueryParam("to"); v != "" {
+		to, dateOnly, err := parseDateParam(v, loc)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр to")
+		}
+		// Дата без времени включает весь день целиком
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.To = &to
+	}
+
+	if v := c.QueryParam("min_total"); v != "" {
+		minTotal, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр min_total")
+		}
+		filter.MinTotal = &minTotal
+	}
+	if v := c.QueryParam("max_total"); v != "" {
+		maxTotal, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр max_total")
+		}
+		filter.MaxTotal = &maxTotal
+	}
+
+	if v := c.QueryParam("menu_item_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр menu_item_id")
+		}
+		filter.MenuItemID = id
+	}
+	if v := c.QueryParam("customer_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр customer_id")
+		}
+		filter.CustomerID = id
+	}
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр limit")
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
 }
+
+// Дата в формате YYYY-MM-DD (в часовом поясе loc) или RFC3339;
+// второй результат сообщает, была ли это дата без времени
+func parseDateParam(v string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", v, loc); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, false, err
+}
+
 func (srv *Server) UpdateOrderStatus(c echo.Context) error {
 	idParam := c.Param("id")
 	orderID, err := strconv.Atoi(idParam)
@@ -297,8 +722,15 @@ func (srv *Server) UpdateOrderStatus(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid status value")
 	}
 
-	err = srv.uc.UpdateOrderStatus(orderID, status.Status)
+	err = srv.uc.UpdateOrderStatus(orderID, status.Status, currentUser(c).Username)
 	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+		}
+		if errors.Is(err, ErrOrderNotEditable) {
+			return echo.NewHTTPError(http.StatusConflict, "Отменённый заказ нельзя вернуть в работу")
+		}
+		log.Printf("Error updating order status: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update order status")
 	}
 
@@ -310,9 +742,24 @@ func (srv *Server) GetRevenue(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр period")
 	}
 
-	revenueData, err := srv.uc.GetRevenue(period)
+	orderType := c.QueryParam("order_type")
+	if orderType != "" && !OrderTypes[orderType] {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр order_type")
+	}
+
+	loc, err := parseTimezoneParam(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Ошибка получения данных выручки")
+		return err
+	}
+
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+
+	revenueData, err := srv.uc.GetRevenue(period, orderType, loc, locationID)
+	if err != nil {
+		return analyticsError(err, "Ошибка получения данных выручки")
 	}
 
 	return c.JSON(http.StatusOK, revenueData)
@@ -326,10 +773,2250 @@ func (srv *Server) GetOrderCounts(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр period")
 	}
 
-	orderCounts, err := srv.uc.GetOrderCounts(period)
+	orderType := c.QueryParam("order_type")
+	if orderType != "" && !OrderTypes[orderType] {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр order_type")
+	}
+
+	loc, err := parseTimezoneParam(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Ошибка получения данных количества заказов")
+		return err
+	}
+
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+
+	orderCounts, err := srv.uc.GetOrderCounts(period, orderType, loc, locationID)
+	if err != nil {
+		return analyticsError(err, "Ошибка получения данных количества заказов")
 	}
 
 	return c.JSON(http.StatusOK, orderCounts)
 }
+
+func (srv *Server) GetOrderTypeBreakdown(c echo.Context) error {
+	period := c.QueryParam("period")
+	if period == "" {
+		period = "day"
+	}
+	if period != "day" && period != "week" && period != "month" && period != "year" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр period")
+	}
+
+	loc, err := parseTimezoneParam(c)
+	if err != nil {
+		return err
+	}
+
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := srv.uc.GetOrderTypeBreakdown(period, loc, locationID)
+	if err != nil {
+		return analyticsError(err, "Ошибка получения данных по типам заказов")
+	}
+
+	return c.JSON(http.StatusOK, data)
+}
+
+// Ответ на ошибку отчёта: неизвестная точка — 404, остальное — 500 с сообщением msg
+func analyticsError(err error, msg string) error {
+	if errors.Is(err, ErrLocationNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "Точка не найдена")
+	}
+	log.Printf("Error fetching analytics: %v", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, msg)
+}
+
+// Данные пользователя из проверенного JWT
+func currentUser(c echo.Context) *vars.JWTClaims {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok || token == nil {
+		return &vars.JWTClaims{}
+	}
+	claims, ok := token.Claims.(*vars.JWTClaims)
+	if !ok {
+		return &vars.JWTClaims{}
+	}
+	return claims
+}
+
+func (srv *Server) RefundOrder(c echo.Context) error {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID заказа")
+	}
+
+	var input struct {
+		Reason  string `json:"reason"`
+		Comment string `json:"comment"`
+		Items   []struct {
+			OrderItemId int `json:"orderItemId"`
+			Quantity    int `json:"quantity"`
+		} `json:"items"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные возврата")
+	}
+
+	if !RefundReasons[input.Reason] {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимая причина возврата")
+	}
+
+	items := make([]RefundItem, len(input.Items))
+	for i, item := range input.Items {
+		if item.OrderItemId <= 0 || item.Quantity <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Некорректные данные позиции возврата")
+		}
+		items[i] = RefundItem{
+			OrderItemId: item.OrderItemId,
+			Quantity:    item.Quantity,
+		}
+	}
+
+	refund, err := srv.uc.RefundOrder(orderID, input.Reason, input.Comment, currentUser(c).Username, currentUser(c).UserID, items)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+		case errors.Is(err, ErrInvalidRefund):
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		log.Printf("Error refunding order: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось оформить возврат")
+	}
+
+	return c.JSON(http.StatusOK, refund)
+}
+
+func (srv *Server) GetRefunds(c echo.Context) error {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID заказа")
+	}
+
+	refunds, err := srv.uc.GetRefunds(orderID)
+	if err != nil {
+		log.Printf("Error fetching refunds: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить возвраты")
+	}
+
+	return c.JSON(http.StatusOK, refunds)
+}
+
+// Билет для подключения к ленте событий
+func (srv *Server) IssueStreamTicket(c echo.Context) error {
+	ticket, err := srv.uc.IssueStreamTicket(currentUser(c))
+	if err != nil {
+		log.Printf("Error issuing stream ticket: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось выдать билет")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"ticket":     ticket,
+		"expires_in": int(streamTicketTTL.Seconds()),
+	})
+}
+
+// Лента событий заказов в формате Server-Sent Events. Последнее полученное
+// событие передаётся заголовком Last-Event-ID или параметром lastEventId:
+// EventSource не умеет задавать заголовок, а после обрыва дольше срока
+// билета клиент открывает новое соединение с новым билетом.
+func (srv *Server) StreamOrders(c echo.Context) error {
+	var (
+		epoch  string
+		lastID int64
+		stale  bool
+	)
+	v := c.Request().Header.Get("Last-Event-ID")
+	if v == "" {
+		v = c.QueryParam("lastEventId")
+	}
+	if v != "" {
+		var err error
+		epoch, lastID, err = ParseEventID(v)
+		// Идентификатор старого формата или чужой: догнать по истории нельзя
+		stale = err != nil
+	}
+
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+	visible := func(event OrderEvent) bool {
+		return locationID == 0 || event.LocationID == locationID
+	}
+
+	events, missed, complete, cancel := srv.uc.SubscribeOrderEvents(epoch, lastID)
+	defer cancel()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.WriteHeader(http.StatusOK)
+
+	// Часть событий потеряна: клиент должен заново загрузить список заказов
+	if !complete || stale {
+		fmt.Fprint(res, "event: resync\ndata: {}\n\n")
+	}
+	for _, event := range missed {
+		if !visible(event) {
+			continue
+		}
+		if err := writeOrderEvent(res, event); err != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if !visible(event) {
+				continue
+			}
+			if err := writeOrderEvent(res, event); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
+
+func writeOrderEvent(w io.Writer, event OrderEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.StreamID(), event.Type, data)
+	return err
+}
+
+func (srv *Server) GetStations(c echo.Context) error {
+	stations, err := srv.uc.GetStations()
+	if err != nil {
+		log.Printf("Error fetching stations: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить станции")
+	}
+
+	return c.JSON(http.StatusOK, stations)
+}
+
+func (srv *Server) AddStation(c echo.Context) error {
+	var input struct {
+		Name string `json:"name"`
+	}
+	if err := c.Bind(&input); err != nil || input.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные станции")
+	}
+
+	station, err := srv.uc.AddStation(input.Name)
+	if err != nil {
+		log.Printf("Error adding station: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось добавить станцию")
+	}
+
+	return c.JSON(http.StatusOK, station)
+}
+
+func (srv *Server) DeleteStation(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID")
+	}
+
+	if err := srv.uc.DeleteStation(id); err != nil {
+		log.Printf("Error deleting station: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось удалить станцию")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Станция удалена"})
+}
+
+func (srv *Server) SetMenuItemStation(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID")
+	}
+
+	var input struct {
+		StationID *int `json:"stationId"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные")
+	}
+
+	err = srv.uc.SetMenuItemStation(id, input.StationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return echo.NewHTTPError(http.StatusNotFound, "Элемент меню не найден")
+		case errors.Is(err, ErrStationNotFound):
+			return echo.NewHTTPError(http.StatusBadRequest, "Станция не найдена")
+		}
+		log.Printf("Error setting menu item station: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось назначить станцию")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Станция назначена"})
+}
+
+func (srv *Server) GetStationLines(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID станции")
+	}
+
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+
+	lines, err := srv.uc.GetStationLines(id, locationID)
+	if err != nil {
+		log.Printf("Error fetching station lines: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить позиции станции")
+	}
+
+	return c.JSON(http.StatusOK, lines)
+}
+
+func (srv *Server) BumpOrderItem(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID позиции")
+	}
+
+	locationID, err := srv.uc.GetOrderItemLocation(id)
+	if err != nil {
+		if errors.Is(err, ErrOrderItemNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Позиция заказа не найдена")
+		}
+		log.Printf("Error fetching order item location: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось отметить позицию")
+	}
+	if !currentUser(c).CanAccessLocation(locationID) {
+		return echo.NewHTTPError(http.StatusForbidden, "Нет доступа к точке")
+	}
+
+	orderID, ready, err := srv.uc.BumpOrderItem(id)
+	if err != nil {
+		if errors.Is(err, ErrOrderItemNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Позиция заказа не найдена")
+		}
+		if errors.Is(err, ErrOrderNotEditable) {
+			return echo.NewHTTPError(http.StatusConflict, "Заказ уже выполнен или отменён")
+		}
+		log.Printf("Error bumping order item: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось отметить позицию")
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"order_id": orderID, "order_ready": ready})
+}
+
+func (srv *Server) GetOrder(c echo.Context) error {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID заказа")
+	}
+
+	order, err := srv.uc.GetOrder(orderID)
+	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+		}
+		log.Printf("Error fetching order: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить заказ")
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+// Ответ на ошибку изменения заказа
+func orderEditError(err error) error {
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+	case errors.Is(err, ErrOrderItemNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Позиция заказа не найдена")
+	case errors.Is(err, ErrOrderNotEditable):
+		return echo.NewHTTPError(http.StatusConflict, "Завершённый или отменённый заказ нельзя изменить")
+	case errors.Is(err, ErrOrderFiscalized):
+		return echo.NewHTTPError(http.StatusConflict, "По заказу уже пробит чек: измените его через возврат")
+	case errors.Is(err, ErrInvalidOrderEdit):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	log.Printf("Error editing order: %v", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось изменить заказ")
+}
+
+func (srv *Server) AddOrderLine(c echo.Context) error {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID заказа")
+	}
+
+	var input struct {
+		MenuItemId int    `json:"menuItemId"`
+		Quantity   int    `json:"quantity"`
+		Comment    string `json:"comment"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные позиции")
+	}
+	if input.MenuItemId <= 0 || input.Quantity <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректные данные товара в заказе")
+	}
+	comment := sanitizeText(input.Comment, false)
+	if utf8.RuneCountInString(comment) > MaxItemCommentSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "Комментарий к позиции должен быть не длиннее "+strconv.Itoa(MaxItemCommentSize)+" символов")
+	}
+
+	order, err := srv.uc.AddOrderLine(orderID, OrderItem{
+		MenuItemId: input.MenuItemId,
+		Quantity:   input.Quantity,
+		Comment:    comment,
+	}, currentUser(c).Username)
+	if err != nil {
+		return orderEditError(err)
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (srv *Server) ChangeOrderLine(c echo.Context) error {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID заказа")
+	}
+	itemID, err := strconv.Atoi(c.Param("itemId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID позиции")
+	}
+
+	var input struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := c.Bind(&input); err != nil || input.Quantity <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректное количество")
+	}
+
+	order, err := srv.uc.ChangeOrderLine(orderID, itemID, input.Quantity, currentUser(c).Username)
+	if err != nil {
+		return orderEditError(err)
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (srv *Server) RemoveOrderLine(c echo.Context) error {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID заказа")
+	}
+	itemID, err := strconv.Atoi(c.Param("itemId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID позиции")
+	}
+
+	order, err := srv.uc.RemoveOrderLine(orderID, itemID, currentUser(c).Username)
+	if err != nil {
+		return orderEditError(err)
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (srv *Server) GetOrderAudit(c echo.Context) error {
+	orderID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID заказа")
+	}
+
+	entries, err := srv.uc.GetOrderAudit(orderID)
+	if err != nil {
+		log.Printf("Error fetching order audit: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить историю заказа")
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// Режим работы по часовому поясу выбранной точки
+func (srv *Server) GetBusinessStatus(c echo.Context) error {
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+	status, err := srv.uc.GetBusinessStatus(locationID)
+	if err != nil {
+		return analyticsError(err, "Не удалось получить режим работы")
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// Часовой пояс группировки аналитики из параметра tz; nil означает пояс кафе
+func parseTimezoneParam(c echo.Context) (*time.Location, error) {
+	tz := c.QueryParam("tz")
+	if tz == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр tz")
+	}
+	return loc, nil
+}
+
+// Точка, к которой относится запрос: параметр location_id или заголовок X-Location-ID.
+// Без явного указания владелец получает сводные данные по всем точкам (0),
+// а сотрудник с единственной точкой — эту точку.
+func locationScope(c echo.Context) (int, error) {
+	claims := currentUser(c)
+
+	v := c.QueryParam("location_id")
+	if v == "" {
+		v = c.Request().Header.Get(HeaderLocationID)
+	}
+	if v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return 0, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр location_id")
+		}
+		if !claims.CanAccessLocation(id) {
+			return 0, echo.NewHTTPError(http.StatusForbidden, "Нет доступа к точке")
+		}
+		return id, nil
+	}
+
+	switch {
+	case claims.Role == vars.RoleOwner:
+		return 0, nil
+	case len(claims.Locations) == 1:
+		return claims.Locations[0], nil
+	case len(claims.Locations) == 0:
+		return 0, echo.NewHTTPError(http.StatusForbidden, "Нет доступа ни к одной точке")
+	}
+	return 0, echo.NewHTTPError(http.StatusBadRequest, "Укажите location_id")
+}
+
+// Точка запроса и её часовой пояс, в котором читаются даты без времени
+// в параметрах from и to; в сводном режиме — часовой пояс кафе
+func (srv *Server) filterScope(c echo.Context) (int, *time.Location, error) {
+	locationID, err := locationScope(c)
+	if err != nil {
+		return 0, nil, err
+	}
+	loc, err := srv.uc.Location(locationID)
+	if errors.Is(err, ErrLocationNotFound) {
+		return 0, nil, echo.NewHTTPError(http.StatusNotFound, "Точка не найдена")
+	}
+	if err != nil {
+		log.Printf("Error loading location %d timezone: %v", locationID, err)
+		return 0, nil, echo.NewHTTPError(http.StatusInternalServerError, "Не удалось определить часовой пояс точки")
+	}
+	return locationID, loc, nil
+}
+
+// Точка для операций записи: сводный режим владельца заменяется точкой по умолчанию
+func (srv *Server) writeLocation(c echo.Context) (int, error) {
+	locationID, err := locationScope(c)
+	if err != nil {
+		return 0, err
+	}
+	if locationID == 0 {
+		locationID = srv.uc.DefaultLocationID()
+	}
+	return locationID, nil
+}
+
+// Мидлварь: маршрут доступен только владельцу
+func ownerOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if currentUser(c).Role != vars.RoleOwner {
+			return echo.NewHTTPError(http.StatusForbidden, "Доступно только владельцу")
+		}
+		return next(c)
+	}
+}
+
+// Мидлварь: проверка доступа к точке заказа из параметра :id
+func (srv *Server) orderAccess(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		orderID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID заказа")
+		}
+
+		locationID, err := srv.uc.GetOrderLocation(orderID)
+		if err != nil {
+			if errors.Is(err, ErrOrderNotFound) {
+				return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+			}
+			log.Printf("Error fetching order location: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить заказ")
+		}
+		if !currentUser(c).CanAccessLocation(locationID) {
+			return echo.NewHTTPError(http.StatusForbidden, "Нет доступа к точке")
+		}
+
+		return next(c)
+	}
+}
+
+func (srv *Server) GetLocations(c echo.Context) error {
+	locations, err := srv.uc.GetLocations(currentUser(c))
+	if err != nil {
+		log.Printf("Error fetching locations: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить точки")
+	}
+
+	return c.JSON(http.StatusOK, locations)
+}
+
+func (srv *Server) AddLocation(c echo.Context) error {
+	var input struct {
+		Name     string `json:"name"`
+		Address  string `json:"address"`
+		Timezone string `json:"timezone"`
+	}
+	if err := c.Bind(&input); err != nil || input.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные точки")
+	}
+	if input.Timezone != "" {
+		if _, err := time.LoadLocation(input.Timezone); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый часовой пояс")
+		}
+	}
+
+	location, err := srv.uc.AddLocation(Location{
+		Name:     input.Name,
+		Address:  input.Address,
+		Timezone: input.Timezone,
+	})
+	if err != nil {
+		log.Printf("Error adding location: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось добавить точку")
+	}
+
+	return c.JSON(http.StatusOK, location)
+}
+
+func (srv *Server) SetMenuLocationPrice(c echo.Context) error {
+	locationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID точки")
+	}
+	menuItemID, err := strconv.Atoi(c.Param("menuId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID")
+	}
+
+	// Пустая цена оставляет базовую цену меню, available = false скрывает позицию в точке
+	input := struct {
+		Price     *float64 `json:"price"`
+		Available *bool    `json:"available"`
+	}{}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные")
+	}
+	if input.Price != nil && *input.Price < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректная цена")
+	}
+	available := input.Available == nil || *input.Available
+
+	err = srv.uc.SetMenuLocationPrice(locationID, menuItemID, input.Price, available)
+	if err != nil {
+		if errors.Is(err, ErrLocationNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Точка или элемент меню не найдены")
+		}
+		log.Printf("Error setting location price: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось сохранить цену")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Цена точки сохранена"})
+}
+
+func (srv *Server) DeleteMenuLocationPrice(c echo.Context) error {
+	locationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID точки")
+	}
+	menuItemID, err := strconv.Atoi(c.Param("menuId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID")
+	}
+
+	if err := srv.uc.DeleteMenuLocationPrice(locationID, menuItemID); err != nil {
+		log.Printf("Error deleting location price: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось удалить цену")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Цена точки удалена"})
+}
+
+func (srv *Server) GrantLocation(c echo.Context) error {
+	locationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID точки")
+	}
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID пользователя")
+	}
+
+	if err := srv.uc.GrantLocation(userID, locationID); err != nil {
+		if errors.Is(err, ErrLocationNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Точка или пользователь не найдены")
+		}
+		log.Printf("Error granting location: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось выдать доступ")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Доступ к точке выдан"})
+}
+
+func (srv *Server) RevokeLocation(c echo.Context) error {
+	locationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID точки")
+	}
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID пользователя")
+	}
+
+	if err := srv.uc.RevokeLocation(userID, locationID); err != nil {
+		log.Printf("Error revoking location: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось отозвать доступ")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Доступ к точке отозван"})
+}
+
+func shiftError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrNoOpenShift):
+		return echo.NewHTTPError(http.StatusNotFound, "Нет открытой смены")
+	case errors.Is(err, ErrShiftNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Смена не найдена")
+	case errors.Is(err, ErrShiftAlreadyOpen):
+		return echo.NewHTTPError(http.StatusConflict, "Смена уже открыта")
+	case errors.Is(err, ErrInvalidCashOperation):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	log.Printf("Error with shift (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+// Открытие смены текущего сотрудника в выбранной точке
+func (srv *Server) OpenShift(c echo.Context) error {
+	var input struct {
+		OpeningFloat float64 `json:"openingFloat"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные смены")
+	}
+	if input.OpeningFloat < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Разменная сумма не может быть отрицательной")
+	}
+
+	user := currentUser(c)
+	if user.UserID == 0 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Войдите заново, чтобы открыть смену")
+	}
+	locationID, err := srv.writeLocation(c)
+	if err != nil {
+		return err
+	}
+
+	shift, err := srv.uc.OpenShift(user.UserID, locationID, input.OpeningFloat)
+	if err != nil {
+		return shiftError(err, "открыть смену")
+	}
+	return c.JSON(http.StatusOK, shift)
+}
+
+// Смены: владельцу все смены выбранной точки, сотруднику только свои
+func (srv *Server) GetShifts(c echo.Context) error {
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+	user := currentUser(c)
+	userID := user.UserID
+	if user.Role == vars.RoleOwner {
+		userID = 0
+	}
+
+	shifts, err := srv.uc.GetShifts(userID, locationID)
+	if err != nil {
+		return shiftError(err, "загрузить смены")
+	}
+	return c.JSON(http.StatusOK, shifts)
+}
+
+func (srv *Server) GetCurrentShift(c echo.Context) error {
+	shift, err := srv.uc.GetCurrentShift(currentUser(c).UserID)
+	if err != nil {
+		return shiftError(err, "загрузить смену")
+	}
+	return c.JSON(http.StatusOK, shift)
+}
+
+// Внесение (kind = in) или изъятие (kind = out) наличных
+func (srv *Server) AddCashOperation(c echo.Context) error {
+	var input struct {
+		Kind    string  `json:"kind"`
+		Amount  float64 `json:"amount"`
+		Comment string  `json:"comment"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные операции")
+	}
+
+	user := currentUser(c)
+	op, err := srv.uc.AddCashOperation(user.UserID, CashOperation{
+		Kind:      input.Kind,
+		Amount:    input.Amount,
+		Comment:   sanitizeText(input.Comment, false),
+		CreatedBy: user.Username,
+	})
+	if err != nil {
+		return shiftError(err, "провести операцию")
+	}
+	return c.JSON(http.StatusOK, op)
+}
+
+func (srv *Server) GetXReport(c echo.Context) error {
+	report, err := srv.uc.GetXReport(currentUser(c).UserID)
+	if err != nil {
+		return shiftError(err, "сформировать X-отчёт")
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// Закрытие смены с пересчитанной суммой наличных, ответ — Z-отчёт
+func (srv *Server) CloseShift(c echo.Context) error {
+	var input struct {
+		CountedCash *float64 `json:"countedCash"`
+	}
+	if err := c.Bind(&input); err != nil || input.CountedCash == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Укажите сумму наличных в кассе")
+	}
+
+	report, err := srv.uc.CloseShift(currentUser(c).UserID, *input.CountedCash)
+	if err != nil {
+		return shiftError(err, "закрыть смену")
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// Отчёт по смене; сотруднику доступны только собственные смены
+func (srv *Server) GetShiftReport(c echo.Context) error {
+	shiftID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID смены")
+	}
+
+	shift, err := srv.uc.GetShift(shiftID)
+	if err != nil {
+		return shiftError(err, "загрузить смену")
+	}
+	user := currentUser(c)
+	if user.Role != vars.RoleOwner && shift.UserID != user.UserID {
+		return echo.NewHTTPError(http.StatusForbidden, "Нет доступа к смене")
+	}
+
+	report, err := srv.uc.GetShiftReport(shiftID)
+	if err != nil {
+		return shiftError(err, "сформировать отчёт")
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func customerError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrCustomerNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Покупатель не найден")
+	case errors.Is(err, ErrCustomerExists):
+		return echo.NewHTTPError(http.StatusConflict, "Покупатель с таким телефоном уже есть")
+	case errors.Is(err, ErrInvalidPhone):
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректный номер телефона")
+	}
+	log.Printf("Error with customer (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+// Поиск покупателей по части телефона или имени (параметр q).
+// История визитов покупателя — GET /api/orders?customer_id=
+func (srv *Server) GetCustomers(c echo.Context) error {
+	customers, err := srv.uc.GetCustomers(strings.TrimSpace(c.QueryParam("q")))
+	if err != nil {
+		return customerError(err, "загрузить покупателей")
+	}
+	return c.JSON(http.StatusOK, customers)
+}
+
+func (srv *Server) GetCustomer(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID покупателя")
+	}
+	customer, err := srv.uc.GetCustomer(id)
+	if err != nil {
+		return customerError(err, "загрузить покупателя")
+	}
+	return c.JSON(http.StatusOK, customer)
+}
+
+func (srv *Server) AddCustomer(c echo.Context) error {
+	var input struct {
+		Phone string `json:"phone"`
+		Name  string `json:"name"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные покупателя")
+	}
+	name := sanitizeText(input.Name, false)
+	if utf8.RuneCountInString(name) > MaxCustomerNameSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "Имя гостя должно быть не длиннее "+strconv.Itoa(MaxCustomerNameSize)+" символов")
+	}
+
+	customer, err := srv.uc.AddCustomer(input.Phone, name)
+	if err != nil {
+		return customerError(err, "добавить покупателя")
+	}
+	return c.JSON(http.StatusOK, customer)
+}
+
+func (srv *Server) UpdateCustomer(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID покупателя")
+	}
+	var input struct {
+		Name string `json:"name"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные покупателя")
+	}
+	name := sanitizeText(input.Name, false)
+	if utf8.RuneCountInString(name) > MaxCustomerNameSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "Имя гостя должно быть не длиннее "+strconv.Itoa(MaxCustomerNameSize)+" символов")
+	}
+
+	customer, err := srv.uc.UpdateCustomer(id, name)
+	if err != nil {
+		return customerError(err, "обновить покупателя")
+	}
+	return c.JSON(http.StatusOK, customer)
+}
+
+// Журнал начислений и списаний баллов покупателя
+func (srv *Server) GetCustomerPoints(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID покупателя")
+	}
+	transactions, err := srv.uc.GetCustomerPoints(id)
+	if err != nil {
+		return customerError(err, "загрузить баллы")
+	}
+	return c.JSON(http.StatusOK, transactions)
+}
+
+func (srv *Server) GetCustomerStamps(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID покупателя")
+	}
+	cards, err := srv.uc.GetCustomerStamps(id)
+	if err != nil {
+		return customerError(err, "загрузить карты штампов")
+	}
+	return c.JSON(http.StatusOK, cards)
+}
+
+func (srv *Server) GetStampPrograms(c echo.Context) error {
+	programs, err := srv.uc.GetStampPrograms()
+	if err != nil {
+		log.Printf("Error fetching stamp programs: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить программы штампов")
+	}
+	return c.JSON(http.StatusOK, programs)
+}
+
+func bindStampProgram(c echo.Context) (StampProgram, error) {
+	var input struct {
+		Name           string   `json:"name"`
+		StampsRequired int      `json:"stampsRequired"`
+		MenuItemIDs    []int64  `json:"menuItemIds"`
+		Categories     []string `json:"categories"`
+		Active         *bool    `json:"active"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return StampProgram{}, echo.NewHTTPError(http.StatusBadRequest, "Неверные данные программы")
+	}
+	program := StampProgram{
+		Name:           sanitizeText(input.Name, false),
+		StampsRequired: input.StampsRequired,
+		MenuItemIDs:    input.MenuItemIDs,
+		Active:         input.Active == nil || *input.Active,
+	}
+	for _, category := range input.Categories {
+		if category = sanitizeText(category, false); category != "" {
+			program.Categories = append(program.Categories, category)
+		}
+	}
+	return program, nil
+}
+
+func stampProgramError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrStampProgramNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Программа штампов не найдена")
+	case errors.Is(err, ErrInvalidStampProgram):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	log.Printf("Error with stamp program (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+func (srv *Server) AddStampProgram(c echo.Context) error {
+	program, err := bindStampProgram(c)
+	if err != nil {
+		return err
+	}
+	created, err := srv.uc.AddStampProgram(program)
+	if err != nil {
+		return stampProgramError(err, "добавить программу штампов")
+	}
+	return c.JSON(http.StatusOK, created)
+}
+
+// Изменение программы; active = false выключает её без потери карт покупателей
+func (srv *Server) UpdateStampProgram(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID программы")
+	}
+	program, err := bindStampProgram(c)
+	if err != nil {
+		return err
+	}
+	program.ID = id
+	updated, err := srv.uc.UpdateStampProgram(program)
+	if err != nil {
+		return stampProgramError(err, "обновить программу штампов")
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+func isGiftCardError(err error) bool {
+	return errors.Is(err, ErrGiftCardNotFound) || errors.Is(err, ErrGiftCardExists) ||
+		errors.Is(err, ErrInvalidGiftCard) || errors.Is(err, ErrInvalidCardCode) ||
+		errors.Is(err, ErrGiftCardExpired) || errors.Is(err, ErrGiftCardNotActive)
+}
+
+func giftCardError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrGiftCardNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Подарочная карта не найдена")
+	case errors.Is(err, ErrGiftCardExists):
+		return echo.NewHTTPError(http.StatusConflict, "Карта с таким кодом уже выпущена")
+	case errors.Is(err, ErrInvalidCardCode):
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректный код карты")
+	case errors.Is(err, ErrGiftCardExpired):
+		return echo.NewHTTPError(http.StatusConflict, "Срок действия карты истёк")
+	case errors.Is(err, ErrGiftCardNotActive):
+		return echo.NewHTTPError(http.StatusConflict, "Карта не активирована или аннулирована")
+	case errors.Is(err, ErrInvalidGiftCard):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrNoOpenShift):
+		return echo.NewHTTPError(http.StatusConflict, "Откройте кассовую смену, чтобы принимать оплату")
+	case errors.Is(err, ErrOrderNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+	}
+	log.Printf("Error with gift card (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+// Выпуск карты; code указывается для уже напечатанных сертификатов
+func (srv *Server) IssueGiftCard(c echo.Context) error {
+	var input struct {
+		Code   string  `json:"code"`
+		Amount float64 `json:"amount"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные карты")
+	}
+
+	card, err := srv.uc.IssueGiftCard(input.Code, input.Amount, currentUser(c).Username)
+	if err != nil {
+		return giftCardError(err, "выпустить карту")
+	}
+	return c.JSON(http.StatusOK, card)
+}
+
+// Баланс и история операций по карте
+func (srv *Server) GetGiftCard(c echo.Context) error {
+	card, err := srv.uc.GetGiftCard(c.Param("code"))
+	if err != nil {
+		return giftCardError(err, "загрузить карту")
+	}
+	return c.JSON(http.StatusOK, card)
+}
+
+func (srv *Server) ActivateGiftCard(c echo.Context) error {
+	var input struct {
+		PaymentMethod string `json:"paymentMethod"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные карты")
+	}
+	if input.PaymentMethod == "" {
+		input.PaymentMethod = PaymentCash
+	}
+
+	user := currentUser(c)
+	card, err := srv.uc.ActivateGiftCard(c.Param("code"), input.PaymentMethod, user.UserID, user.Username)
+	if err != nil {
+		return giftCardError(err, "активировать карту")
+	}
+	return c.JSON(http.StatusOK, card)
+}
+
+func (srv *Server) TopUpGiftCard(c echo.Context) error {
+	var input struct {
+		Amount        float64 `json:"amount"`
+		PaymentMethod string  `json:"paymentMethod"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные пополнения")
+	}
+	if input.PaymentMethod == "" {
+		input.PaymentMethod = PaymentCash
+	}
+
+	user := currentUser(c)
+	card, err := srv.uc.TopUpGiftCard(c.Param("code"), input.Amount, input.PaymentMethod, user.UserID, user.Username)
+	if err != nil {
+		return giftCardError(err, "пополнить карту")
+	}
+	return c.JSON(http.StatusOK, card)
+}
+
+// Оплата картой части созданного заказа; без amount списывается сколько возможно
+func (srv *Server) RedeemGiftCard(c echo.Context) error {
+	var input struct {
+		OrderID int     `json:"orderId"`
+		Amount  float64 `json:"amount"`
+	}
+	if err := c.Bind(&input); err != nil || input.OrderID <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные оплаты")
+	}
+
+	locationID, err := srv.uc.GetOrderLocation(input.OrderID)
+	if err != nil {
+		return giftCardError(err, "загрузить заказ")
+	}
+	user := currentUser(c)
+	if !user.CanAccessLocation(locationID) {
+		return echo.NewHTTPError(http.StatusForbidden, "Нет доступа к точке")
+	}
+
+	order, err := srv.uc.RedeemGiftCard(c.Param("code"), input.OrderID, input.Amount, user.Username)
+	if err != nil {
+		return giftCardError(err, "оплатить картой")
+	}
+	return c.JSON(http.StatusOK, order)
+}
+
+func (srv *Server) VoidGiftCard(c echo.Context) error {
+	card, err := srv.uc.VoidGiftCard(c.Param("code"), currentUser(c).Username)
+	if err != nil {
+		return giftCardError(err, "аннулировать карту")
+	}
+	return c.JSON(http.StatusOK, card)
+}
+
+// Отчёт об обязательствах по неизрасходованным остаткам карт
+func (srv *Server) GetGiftCardLiability(c echo.Context) error {
+	liability, err := srv.uc.GetGiftCardLiability()
+	if err != nil {
+		return giftCardError(err, "сформировать отчёт")
+	}
+	return c.JSON(http.StatusOK, liability)
+}
+
+func reservationError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrTableNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Стол не найден")
+	case errors.Is(err, ErrTableExists):
+		return echo.NewHTTPError(http.StatusConflict, "Стол с таким номером уже есть")
+	case errors.Is(err, ErrLocationNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Точка не найдена")
+	case errors.Is(err, ErrReservationNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Бронь не найдена")
+	case errors.Is(err, ErrReservationConflict):
+		return echo.NewHTTPError(http.StatusConflict, "Стол уже забронирован на это время")
+	case errors.Is(err, ErrInvalidPhone):
+		return echo.NewHTTPError(http.StatusBadRequest, "Некорректный номер телефона")
+	case errors.Is(err, ErrInvalidReservation):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	log.Printf("Error with reservation (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+// Мидлварь: проверка доступа к точке брони из параметра :id
+func (srv *Server) reservationAccess(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID брони")
+		}
+		r, err := srv.uc.GetReservation(id)
+		if err != nil {
+			return reservationError(err, "загрузить бронь")
+		}
+		if !currentUser(c).CanAccessLocation(r.LocationID) {
+			return echo.NewHTTPError(http.StatusForbidden, "Нет доступа к точке")
+		}
+		return next(c)
+	}
+}
+
+func (srv *Server) GetTables(c echo.Context) error {
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+	tables, err := srv.uc.GetTables(locationID)
+	if err != nil {
+		return reservationError(err, "загрузить столы")
+	}
+	return c.JSON(http.StatusOK, tables)
+}
+
+func bindTable(c echo.Context) (DiningTable, error) {
+	var input struct {
+		Number   int    `json:"number"`
+		Capacity int    `json:"capacity"`
+		Zone     string `json:"zone"`
+		Active   *bool  `json:"active"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return DiningTable{}, echo.NewHTTPError(http.StatusBadRequest, "Неверные данные стола")
+	}
+	table := DiningTable{
+		Number:   input.Number,
+		Capacity: input.Capacity,
+		Zone:     sanitizeText(input.Zone, false),
+		Active:   input.Active == nil || *input.Active,
+	}
+	return table, nil
+}
+
+func (srv *Server) AddTable(c echo.Context) error {
+	table, err := bindTable(c)
+	if err != nil {
+		return err
+	}
+	if table.LocationID, err = srv.writeLocation(c); err != nil {
+		return err
+	}
+	created, err := srv.uc.AddTable(table)
+	if err != nil {
+		return reservationError(err, "добавить стол")
+	}
+	return c.JSON(http.StatusOK, created)
+}
+
+// Изменение стола; active = false выводит его из брони без удаления истории
+func (srv *Server) UpdateTable(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID стола")
+	}
+	table, err := bindTable(c)
+	if err != nil {
+		return err
+	}
+	table.ID = id
+	updated, err := srv.uc.UpdateTable(table)
+	if err != nil {
+		return reservationError(err, "обновить стол")
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+// Брони за рабочий день. Параметры: date (YYYY-MM-DD, по умолчанию сегодня), status.
+func (srv *Server) GetReservations(c echo.Context) error {
+	locationID, err := locationScope(c)
+	if err != nil {
+		return err
+	}
+	reservations, err := srv.uc.GetReservations(locationID, c.QueryParam("date"), c.QueryParam("status"))
+	if err != nil {
+		return reservationError(err, "загрузить брони")
+	}
+	return c.JSON(http.StatusOK, reservations)
+}
+
+func (srv *Server) GetReservation(c echo.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+	r, err := srv.uc.GetReservation(id)
+	if err != nil {
+		return reservationError(err, "загрузить бронь")
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// Данные брони из запроса; длительность в минутах, 0 — стандартная.
+// Доступ к точке проверяется по выбранному столу.
+func (srv *Server) bindReservation(c echo.Context) (Reservation, time.Duration, error) {
+	var input struct {
+		TableID         int       `json:"tableId"`
+		StartsAt        time.Time `json:"startsAt"`
+		DurationMinutes int       `json:"durationMinutes"`
+		PartySize       int       `json:"partySize"`
+		GuestName       string    `json:"guestName"`
+		Phone           string    `json:"phone"`
+		Comment         string    `json:"comment"`
+	}
+	if err := c.Bind(&input); err != nil || input.TableID <= 0 || input.StartsAt.IsZero() {
+		return Reservation{}, 0, echo.NewHTTPError(http.StatusBadRequest, "Неверные данные брони")
+	}
+	if input.DurationMinutes < 0 {
+		return Reservation{}, 0, echo.NewHTTPError(http.StatusBadRequest, "Некорректная длительность брони")
+	}
+	input.GuestName = sanitizeText(input.GuestName, false)
+	if utf8.RuneCountInString(input.GuestName) > MaxCustomerNameSize {
+		return Reservation{}, 0, echo.NewHTTPError(http.StatusBadRequest, "Имя гостя должно быть не длиннее "+strconv.Itoa(MaxCustomerNameSize)+" символов")
+	}
+	input.Comment = sanitizeText(input.Comment, true)
+	if utf8.RuneCountInString(input.Comment) > MaxOrderNoteSize {
+		return Reservation{}, 0, echo.NewHTTPError(http.StatusBadRequest, "Комментарий к брони должен быть не длиннее "+strconv.Itoa(MaxOrderNoteSize)+" символов")
+	}
+
+	table, err := srv.uc.GetTable(input.TableID)
+	if err != nil {
+		return Reservation{}, 0, reservationError(err, "загрузить стол")
+	}
+	if !currentUser(c).CanAccessLocation(table.LocationID) {
+		return Reservation{}, 0, echo.NewHTTPError(http.StatusForbidden, "Нет доступа к точке")
+	}
+
+	r := Reservation{
+		LocationID: table.LocationID,
+		TableID:    input.TableID,
+		StartsAt:   input.StartsAt,
+		PartySize:  input.PartySize,
+		GuestName:  input.GuestName,
+		Phone:      input.Phone,
+		Comment:    input.Comment,
+		CreatedBy:  currentUser(c).Username,
+	}
+	return r, time.Duration(input.DurationMinutes) * time.Minute, nil
+}
+
+func (srv *Server) AddReservation(c echo.Context) error {
+	r, duration, err := srv.bindReservation(c)
+	if err != nil {
+		return err
+	}
+	created, err := srv.uc.AddReservation(r, duration)
+	if err != nil {
+		return reservationError(err, "забронировать стол")
+	}
+	return c.JSON(http.StatusOK, created)
+}
+
+// Перенос брони на другое время или стол
+func (srv *Server) UpdateReservation(c echo.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+	r, duration, err := srv.bindReservation(c)
+	if err != nil {
+		return err
+	}
+	r.ID = id
+	updated, err := srv.uc.UpdateReservation(r, duration)
+	if err != nil {
+		return reservationError(err, "изменить бронь")
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+// Гости пришли (seated), не пришли (no_show) или бронь отменена (cancelled)
+func (srv *Server) SetReservationStatus(c echo.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var input struct {
+		Status string `json:"status"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный статус брони")
+	}
+	updated, err := srv.uc.SetReservationStatus(id, input.Status)
+	if err != nil {
+		return reservationError(err, "изменить статус брони")
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+// Свободное время столов на день. Параметры: date (YYYY-MM-DD), party_size.
+func (srv *Server) GetAvailability(c echo.Context) error {
+	locationID, err := srv.writeLocation(c)
+	if err != nil {
+		return err
+	}
+	partySize := 1
+	if v := c.QueryParam("party_size"); v != "" {
+		if partySize, err = strconv.Atoi(v); err != nil || partySize <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр party_size")
+		}
+	}
+
+	availability, err := srv.uc.GetAvailability(locationID, c.QueryParam("date"), partySize)
+	if err != nil {
+		return reservationError(err, "загрузить свободное время")
+	}
+	return c.JSON(http.StatusOK, availability)
+}
+
+// Открытие заказа в зале по брони: стол, имя и телефон гостя берутся из брони
+func (srv *Server) OpenReservationOrder(c echo.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var input struct {
+		Items         []orderItemInput `json:"items"`
+		Note          string           `json:"note"`
+		PaymentMethod string           `json:"paymentMethod"`
+	}
+
+	// Тело запроса сверяется при повторе, как у обычного заказа
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные заказа")
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные заказа")
+	}
+
+	orderItems, err := parseOrderItems(input.Items)
+	if err != nil {
+		return err
+	}
+	if input.PaymentMethod != "" && !PaymentMethods[input.PaymentMethod] {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый способ оплаты")
+	}
+	input.Note = sanitizeText(input.Note, true)
+	if utf8.RuneCountInString(input.Note) > MaxOrderNoteSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "Примечание к заказу должно быть не длиннее "+strconv.Itoa(MaxOrderNoteSize)+" символов")
+	}
+	hash := sha256.Sum256(body)
+
+	user := currentUser(c)
+	order, replayed, err := srv.uc.OpenReservationOrder(id, OrderRequest{
+		Items:         orderItems,
+		Note:          input.Note,
+		PaymentMethod: input.PaymentMethod,
+		UserID:        user.UserID,
+		UserName:      user.Username,
+		RequestHash:   hex.EncodeToString(hash[:]),
+	})
+	if err != nil {
+		if errors.Is(err, ErrReservationNotFound) || errors.Is(err, ErrInvalidReservation) {
+			return reservationError(err, "открыть заказ по брони")
+		}
+		return addOrderError(err)
+	}
+
+	if replayed {
+		c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+	}
+	return c.JSON(http.StatusOK, order)
+}
+
+func feedbackError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrInvalidFeedbackToken):
+		return echo.NewHTTPError(http.StatusForbidden, "Ссылка для отзыва недействительна")
+	case errors.Is(err, ErrOrderNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+	case errors.Is(err, ErrFeedbackNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Отзыва по заказу нет")
+	case errors.Is(err, ErrFeedbackExists):
+		return echo.NewHTTPError(http.StatusConflict, "Отзыв по этому заказу уже оставлен")
+	case errors.Is(err, ErrInvalidFeedback):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	log.Printf("Error with feedback (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+// Публичная отправка отзыва: заказ подтверждается подписью token с чека
+func (srv *Server) SubmitFeedback(c echo.Context) error {
+	var input struct {
+		OrderID int    `json:"orderId"`
+		Token   string `json:"token"`
+		Rating  int    `json:"rating"`
+		Comment string `json:"comment"`
+		Items   []struct {
+			OrderItemID int `json:"orderItemId"`
+			Rating      int `json:"rating"`
+		} `json:"items"`
+	}
+	if err := c.Bind(&input); err != nil || input.OrderID <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные отзыва")
+	}
+
+	feedback := Feedback{
+		OrderID: input.OrderID,
+		Rating:  input.Rating,
+		Comment: sanitizeText(input.Comment, true),
+		Items:   make([]FeedbackItem, len(input.Items)),
+	}
+	for i, item := range input.Items {
+		feedback.Items[i] = FeedbackItem{OrderItemID: item.OrderItemID, Rating: item.Rating}
+	}
+
+	created, err := srv.uc.SubmitFeedback(input.Token, feedback)
+	if err != nil {
+		return feedbackError(err, "сохранить отзыв")
+	}
+	return c.JSON(http.StatusOK, created)
+}
+
+func (srv *Server) GetOrderFeedback(c echo.Context) error {
+	orderID, _ := strconv.Atoi(c.Param("id"))
+	feedback, err := srv.uc.GetOrderFeedback(orderID)
+	if err != nil {
+		return feedbackError(err, "загрузить отзыв")
+	}
+	return c.JSON(http.StatusOK, feedback)
+}
+
+// Подпись для ссылки на отзыв, которую печатают на чеке
+func (srv *Server) GetFeedbackToken(c echo.Context) error {
+	orderID, _ := strconv.Atoi(c.Param("id"))
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"order_id": orderID,
+		"token":    srv.uc.GetFeedbackToken(orderID),
+	})
+}
+
+// Параметры: from, to, max_rating
+func (srv *Server) parseFeedbackFilter(c echo.Context) (FeedbackFilter, error) {
+	var filter FeedbackFilter
+	var loc *time.Location
+	var err error
+	if filter.LocationID, loc, err = srv.filterScope(c); err != nil {
+		return filter, err
+	}
+
+	if v := c.QueryParam("from"); v != "" {
+		from, _, err := parseDateParam(v, loc)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр from")
+		}
+		filter.From = &from
+	}
+	if v := c.QueryParam("to"); v != "" {
+		to, dateOnly, err := parseDateParam(v, loc)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр to")
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.To = &to
+	}
+	if v := c.QueryParam("max_rating"); v != "" {
+		rating, err := strconv.Atoi(v)
+		if err != nil || rating < 1 || rating > 5 {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр max_rating")
+		}
+		filter.MaxRating = rating
+	}
+	return filter, nil
+}
+
+// Отзывы, например недовольных гостей: GET /api/feedback?max_rating=2
+func (srv *Server) GetFeedback(c echo.Context) error {
+	filter, err := srv.parseFeedbackFilter(c)
+	if err != nil {
+		return err
+	}
+	feedback, err := srv.uc.GetFeedback(filter)
+	if err != nil {
+		return feedbackError(err, "загрузить отзывы")
+	}
+	return c.JSON(http.StatusOK, feedback)
+}
+
+func (srv *Server) GetFeedbackAnalytics(c echo.Context) error {
+	filter, err := srv.parseFeedbackFilter(c)
+	if err != nil {
+		return err
+	}
+	analytics, err := srv.uc.GetFeedbackAnalytics(filter)
+	if err != nil {
+		return feedbackError(err, "сформировать отчёт по отзывам")
+	}
+	return c.JSON(http.StatusOK, analytics)
+}
+
+// Чек заказа. Параметры: format (text, html, pdf; по умолчанию text)
+// и width — ширина ленты для текста, 58 или 80 мм.
+func (srv *Server) GetReceipt(c echo.Context) error {
+	orderID, _ := strconv.Atoi(c.Param("id"))
+
+	width := ReceiptWidth80
+	switch c.QueryParam("width") {
+	case "", "80":
+	case "58":
+		width = ReceiptWidth58
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр width")
+	}
+	format := c.QueryParam("format")
+	if format != "" && format != "text" && format != "html" && format != "pdf" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр format")
+	}
+
+	receipt, err := srv.uc.GetReceipt(orderID)
+	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+		}
+		log.Printf("Error building receipt: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось сформировать чек")
+	}
+
+	switch format {
+	case "html":
+		body, err := RenderReceiptHTML(receipt)
+		if err != nil {
+			log.Printf("Error rendering receipt: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось сформировать чек")
+		}
+		return c.HTMLBlob(http.StatusOK, body)
+	case "pdf":
+		body, err := RenderReceiptPDF(receipt)
+		if err != nil {
+			log.Printf("Error rendering receipt: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось сформировать чек")
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=receipt-%d.pdf", orderID))
+		return c.Blob(http.StatusOK, "application/pdf", body)
+	}
+	return c.String(http.StatusOK, RenderReceiptText(receipt, width))
+}
+
+func printError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+	case errors.Is(err, ErrNoPrinter):
+		return echo.NewHTTPError(http.StatusConflict, "Для точки не настроен подходящий принтер")
+	case errors.Is(err, ErrPrintJobNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Задание печати не найдено")
+	case errors.Is(err, ErrInvalidPrintJob):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	log.Printf("Error with printing (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+// Повторная печать: kind = receipt (по умолчанию) или kitchen
+func (srv *Server) PrintOrder(c echo.Context) error {
+	orderID, _ := strconv.Atoi(c.Param("id"))
+	var input struct {
+		Kind string `json:"kind"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные печати")
+	}
+	if input.Kind == "" {
+		input.Kind = PrintReceipt
+	}
+
+	queued, err := srv.uc.PrintOrder(orderID, input.Kind)
+	if err != nil {
+		return printError(err, "отправить на печать")
+	}
+	return c.JSON(http.StatusOK, map[string]int{"queued": queued})
+}
+
+// Очередь печати; параметр status: pending, done, failed
+func (srv *Server) GetPrintJobs(c echo.Context) error {
+	status := c.QueryParam("status")
+	if status != "" && status != PrintPending && status != PrintDone && status != PrintFailed {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр status")
+	}
+	jobs, err := srv.uc.GetPrintJobs(status)
+	if err != nil {
+		return printError(err, "загрузить очередь печати")
+	}
+	return c.JSON(http.StatusOK, jobs)
+}
+
+func (srv *Server) RetryPrintJob(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID задания")
+	}
+	job, err := srv.uc.RetryPrintJob(id)
+	if err != nil {
+		return printError(err, "повторить печать")
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func fiscalError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Заказ не найден")
+	case errors.Is(err, ErrFiscalDisabled):
+		return echo.NewHTTPError(http.StatusConflict, "Онлайн-касса не настроена")
+	case errors.Is(err, ErrFiscalNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Фискальный документ не найден")
+	case errors.Is(err, ErrInvalidFiscalRequest):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	log.Printf("Error with fiscal document (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+// Фискальные документы заказа с фискальным признаком и номером документа
+func (srv *Server) GetOrderFiscal(c echo.Context) error {
+	orderID, _ := strconv.Atoi(c.Param("id"))
+	docs, err := srv.uc.GetOrderFiscal(orderID)
+	if err != nil {
+		return fiscalError(err, "загрузить фискальные документы")
+	}
+	return c.JSON(http.StatusOK, docs)
+}
+
+// Пробить приход по заказу, если он ещё не пробит
+func (srv *Server) FiscalizeOrder(c echo.Context) error {
+	orderID, _ := strconv.Atoi(c.Param("id"))
+	doc, err := srv.uc.FiscalizeOrder(orderID)
+	if err != nil {
+		return fiscalError(err, "поставить чек в очередь")
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// Чек коррекции: type = self (самостоятельно) или instruction (по предписанию)
+func (srv *Server) CorrectOrderFiscal(c echo.Context) error {
+	orderID, _ := strconv.Atoi(c.Param("id"))
+	var input struct {
+		Type       string `json:"type"`
+		BaseDate   string `json:"baseDate"`
+		BaseNumber string `json:"baseNumber"`
+		Reason     string `json:"reason"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные коррекции")
+	}
+
+	doc, err := srv.uc.CorrectOrderFiscal(orderID, FiscalCorrection{
+		Type:       input.Type,
+		BaseDate:   input.BaseDate,
+		BaseNumber: sanitizeText(input.BaseNumber, false),
+		Reason:     sanitizeText(input.Reason, false),
+	})
+	if err != nil {
+		return fiscalError(err, "поставить чек коррекции в очередь")
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// Очередь фискальных документов; параметр status: pending, done, failed
+func (srv *Server) GetFiscalQueue(c echo.Context) error {
+	status := c.QueryParam("status")
+	if status != "" && status != FiscalPending && status != FiscalDone && status != FiscalFailed {
+		return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр status")
+	}
+	docs, err := srv.uc.GetFiscalQueue(status)
+	if err != nil {
+		return fiscalError(err, "загрузить очередь фискальных документов")
+	}
+	return c.JSON(http.StatusOK, docs)
+}
+
+func (srv *Server) RetryFiscalDocument(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID документа")
+	}
+	doc, err := srv.uc.RetryFiscalDocument(id)
+	if err != nil {
+		return fiscalError(err, "повторить отправку")
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// Не больше стольких байт тела запроса и ответа попадает в журнал
+const auditBodyLimit = 64 << 10
+
+// Копия ответа для журнала действий
+type auditRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditRecorder) Write(b []byte) (int, error) {
+	if w.body.Len()+len(b) <= auditBodyLimit {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Мидлварь: запись успешных изменяющих запросов в журнал действий.
+// Для известных сущностей сравнивается состояние до и после запроса,
+// для остальных в журнал попадает ответ или, если он пуст, тело запроса.
+func (srv *Server) auditLog(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions {
+			return next(c)
+		}
+
+		entity := auditEntity(c.Path())
+		entityID := c.Param("id")
+		if entityID == "" {
+			entityID = c.Param("code")
+		}
+		before, tracked := srv.uc.AuditState(entity, entityID)
+
+		var reqBody []byte
+		if req.Body != nil {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Не удалось прочитать запрос")
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			if len(body) <= auditBodyLimit {
+				reqBody = body
+			}
+		}
+
+		res := c.Response()
+		recorder := &auditRecorder{ResponseWriter: res.Writer}
+		res.Writer = recorder
+		err := next(c)
+		res.Writer = recorder.ResponseWriter
+		if err != nil || res.Status >= http.StatusBadRequest {
+			return err
+		}
+
+		var after interface{}
+		if tracked {
+			after, _ = srv.uc.AuditState(entity, entityID)
+		} else if json.Unmarshal(recorder.body.Bytes(), &after) != nil {
+			after = nil
+		}
+		if entityID == "" {
+			if m, ok := after.(map[string]interface{}); ok && m["id"] != nil {
+				entityID = fmt.Sprint(m["id"])
+			}
+		}
+
+		diff := auditDiff(before, after)
+		if len(diff) == 0 {
+			var input interface{}
+			if json.Unmarshal(reqBody, &input) == nil {
+				diff = auditDiff(nil, input)
+			}
+		}
+
+		user := currentUser(c)
+		entry := AuditEntry{
+			ActorID:  user.UserID,
+			Actor:    user.Username,
+			Role:     user.Role,
+			Action:   req.Method + " " + c.Path(),
+			Entity:   entity,
+			EntityID: entityID,
+			Diff:     diff,
+			IP:       c.RealIP(),
+		}
+		if err := srv.uc.RecordAudit(entry); err != nil {
+			log.Printf("Error recording audit entry %s: %v", entry.Action, err)
+		}
+		return nil
+	}
+}
+
+// Журнал действий, сначала новые. Фильтры: actor, actor_id, action, entity,
+// entity_id, from, to (даты по часовому поясу точки location_id или кафе);
+// постраничный вывод через limit и cursor.
+func (srv *Server) GetAudit(c echo.Context) error {
+	filter := AuditFilter{
+		Actor:    c.QueryParam("actor"),
+		Action:   c.QueryParam("action"),
+		Entity:   c.QueryParam("entity"),
+		EntityID: c.QueryParam("entity_id"),
+	}
+	// Журнал общий, location_id задаёт только часовой пояс дат
+	_, loc, err := srv.filterScope(c)
+	if err != nil {
+		return err
+	}
+
+	if v := c.QueryParam("actor_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр actor_id")
+		}
+		filter.ActorID = id
+	}
+	if v := c.QueryParam("from"); v != "" {
+		from, _, err := parseDateParam(v, loc)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр from")
+		}
+		filter.From = &from
+	}
+	if v := c.QueryParam("to"); v != "" {
+		to, dateOnly, err := parseDateParam(v, loc)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр to")
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.To = &to
+	}
+	if v := c.QueryParam("cursor"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Неверный курсор")
+		}
+		filter.BeforeID = id
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр limit")
+		}
+		filter.Limit = limit
+	}
+
+	page, err := srv.uc.GetAudit(filter)
+	if err != nil {
+		log.Printf("Error fetching audit log: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить журнал действий")
+	}
+	if page.NextCursor != 0 {
+		c.Response().Header().Set(HeaderNextCursor, strconv.FormatInt(page.NextCursor, 10))
+	}
+	return c.JSON(http.StatusOK, page.Entries)
+}
+
+func userError(err error, action string) error {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Пользователь не найден")
+	case errors.Is(err, ErrUserExists):
+		return echo.NewHTTPError(http.StatusConflict, "Пользователь с таким email уже есть")
+	case errors.Is(err, ErrLastOwner):
+		return echo.NewHTTPError(http.StatusConflict, "Нельзя отключить или понизить последнего владельца")
+	case errors.Is(err, ErrInviteNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Приглашение не найдено")
+	case errors.Is(err, ErrInviteExpired):
+		return echo.NewHTTPError(http.StatusGone, "Приглашение просрочено или уже использовано")
+	case errors.Is(err, ErrInvalidUser):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrWrongPassword):
+		return echo.NewHTTPError(http.StatusForbidden, "Неверный текущий пароль")
+	case errors.Is(err, ErrResetTokenInvalid):
+		return echo.NewHTTPError(http.StatusBadRequest, "Ссылка для сброса недействительна, просрочена или уже использована")
+	}
+	log.Printf("Error with users (%s): %v", action, err)
+	return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось "+action)
+}
+
+// Мидлварь: токены отключённых пользователей и токены, выданные до смены
+// пароля, не принимаются, даже если срок их действия ещё не истёк
+func (srv *Server) activeUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := srv.uc.CheckSession(currentUser(c))
+		if errors.Is(err, ErrUserInactive) || errors.Is(err, ErrUserNotFound) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Учётная запись отключена")
+		}
+		if errors.Is(err, ErrSessionRevoked) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Сессия завершена, войдите заново")
+		}
+		if err != nil {
+			log.Printf("Error checking user status: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось проверить пользователя")
+		}
+		return next(c)
+	}
+}
+
+func (srv *Server) checkPassword(password string) error {
+	if len(password) < srv.minPassword || len(password) > srv.maxPassword {
+		return echo.NewHTTPError(http.StatusBadRequest, "Password should be "+strconv.Itoa(srv.minPassword)+"-"+strconv.Itoa(srv.maxPassword)+" length")
+	}
+	return nil
+}
+
+// Профиль текущего пользователя
+func (srv *Server) GetMe(c echo.Context) error {
+	user, err := srv.uc.GetMe(currentUser(c).UserID)
+	if err != nil {
+		return userError(err, "загрузить профиль")
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func (srv *Server) GetUsers(c echo.Context) error {
+	users, err := srv.uc.GetUsers()
+	if err != nil {
+		return userError(err, "загрузить пользователей")
+	}
+	return c.JSON(http.StatusOK, users)
+}
+
+// Приглашение сотрудника; токен из ответа передаётся приглашённому
+func (srv *Server) InviteUser(c echo.Context) error {
+	var input struct {
+		Email     string  `json:"email"`
+		Role      string  `json:"role"`
+		Locations []int64 `json:"locations"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные приглашения")
+	}
+
+	invite, err := srv.uc.InviteUser(input.Email, input.Role, input.Locations, currentUser(c).Username)
+	if err != nil {
+		return userError(err, "создать приглашение")
+	}
+	return c.JSON(http.StatusOK, invite)
+}
+
+func (srv *Server) GetInvites(c echo.Context) error {
+	invites, err := srv.uc.GetInvites()
+	if err != nil {
+		return userError(err, "загрузить приглашения")
+	}
+	return c.JSON(http.StatusOK, invites)
+}
+
+func (srv *Server) RevokeInvite(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID приглашения")
+	}
+	if err := srv.uc.RevokeInvite(id); err != nil {
+		return userError(err, "отозвать приглашение")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Регистрация по приглашению без входа в систему
+func (srv *Server) AcceptInvite(c echo.Context) error {
+	var input struct {
+		Token    string `json:"token"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := c.Bind(&input); err != nil || input.Token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные приглашения")
+	}
+	if len(input.Name) < srv.minUsername || len(input.Name) > srv.maxUsername {
+		return echo.NewHTTPError(http.StatusBadRequest, "Username should be "+strconv.Itoa(srv.minUsername)+"-"+strconv.Itoa(srv.maxUsername)+" length")
+	}
+	if err := srv.checkPassword(input.Password); err != nil {
+		return err
+	}
+
+	if err := srv.uc.AcceptInvite(input.Token, input.Name, input.Password); err != nil {
+		return userError(err, "принять приглашение")
+	}
+	return c.JSON(http.StatusOK, "OK!")
+}
+
+func (srv *Server) SetUserRole(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID пользователя")
+	}
+	var input struct {
+		Role string `json:"role"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные роли")
+	}
+
+	user, err := srv.uc.SetUserRole(id, input.Role)
+	if err != nil {
+		return userError(err, "изменить роль")
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func (srv *Server) DeactivateUser(c echo.Context) error {
+	return srv.setUserActive(c, false)
+}
+
+func (srv *Server) ActivateUser(c echo.Context) error {
+	return srv.setUserActive(c, true)
+}
+
+func (srv *Server) setUserActive(c echo.Context, active bool) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID пользователя")
+	}
+	user, err := srv.uc.SetUserActive(id, active)
+	if err != nil {
+		return userError(err, "изменить статус пользователя")
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+// Сброс пароля владельцем; без password в ответе возвращается временный пароль
+func (srv *Server) ResetUserPassword(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID пользователя")
+	}
+	var input struct {
+		Password string `json:"password"`
+	}
+	if err := c.Bind(&input); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные пароля")
+	}
+	if input.Password != "" {
+		if err := srv.checkPassword(input.Password); err != nil {
+			return err
+		}
+	}
+
+	password, err := srv.uc.ResetUserPassword(id, input.Password)
+	if err != nil {
+		return userError(err, "сбросить пароль")
+	}
+	return c.JSON(http.StatusOK, echo.Map{"password": password})
+}
+
+// Смена своего пароля; в ответе новый токен взамен отозванных
+func (srv *Server) ChangePassword(c echo.Context) error {
+	var input struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := c.Bind(&input); err != nil || input.CurrentPassword == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные пароля")
+	}
+	if err := srv.checkPassword(input.NewPassword); err != nil {
+		return err
+	}
+
+	token, err := srv.uc.ChangePassword(currentUser(c).UserID, input.CurrentPassword, input.NewPassword)
+	if err != nil {
+		return userError(err, "сменить пароль")
+	}
+	return c.JSON(http.StatusOK, echo.Map{"token": token})
+}
+
+// Запрос ссылки для сброса пароля. Ответ одинаковый для любого адреса;
+// частые запросы с одного IP или на один адрес получают 429.
+func (srv *Server) ForgotPassword(c echo.Context) error {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := c.Bind(&input); err != nil || input.Email == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Укажите email")
+	}
+
+	var throttled *LoginThrottledError
+	if err := srv.uc.RequestPasswordReset(input.Email, c.RealIP()); errors.As(err, &throttled) {
+		return tooManyRequests(c, throttled, "Слишком много запросов, попробуйте позже")
+	}
+	return c.JSON(http.StatusOK, "Если адрес зарегистрирован, на него отправлена ссылка для сброса пароля")
+}
+
+func (srv *Server) ResetPassword(c echo.Context) error {
+	var input struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := c.Bind(&input); err != nil || input.Token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Неверные данные сброса")
+	}
+	if err := srv.checkPassword(input.Password); err != nil {
+		return err
+	}
+
+	if err := srv.uc.ResetPassword(input.Token, input.Password); err != nil {
+		return userError(err, "сбросить пароль")
+	}
+	return c.JSON(http.StatusOK, "OK!")
+}
+
+// Блокировки входа из-за перебора паролей; фильтр по периоду from и to,
+// даты читаются по часовому поясу точки location_id или кафе
+func (srv *Server) GetLoginLockouts(c echo.Context) error {
+	_, loc, err := srv.filterScope(c)
+	if err != nil {
+		return err
+	}
+	var from, to *time.Time
+	if v := c.QueryParam("from"); v != "" {
+		t, _, err := parseDateParam(v, loc)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр from")
+		}
+		from = &t
+	}
+	if v := c.QueryParam("to"); v != "" {
+		t, dateOnly, err := parseDateParam(v, loc)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Недопустимый параметр to")
+		}
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		to = &t
+	}
+
+	lockouts, err := srv.uc.GetLoginLockouts(from, to)
+	if err != nil {
+		log.Printf("Error fetching login lockouts: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Не удалось загрузить блокировки входа")
+	}
+	return c.JSON(http.StatusOK, lockouts)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Запись журнала действий: кто (из JWT), что сделал (метод и маршрут),
+// с какой сущностью, изменения полей, IP и время. Журнал только дополняется;
+// старые записи удаляются по сроку хранения.
+type AuditEntry struct {
+	ID        int64                  `json:"id"`
+	ActorID   int                    `json:"actor_id"`
+	Actor     string                 `json:"actor"`
+	Role      string                 `json:"role"`
+	Action    string                 `json:"action"`
+	Entity    string                 `json:"entity"`
+	EntityID  string                 `json:"entity_id"`
+	Diff      map[string]AuditChange `json:"diff"`
+	IP        string                 `json:"ip"`
+	CreatedAt string                 `json:"created_at"`
+}
+
+// Значение поля до и после действия; null — поля не было
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Отбор записей журнала; BeforeID — курсор для следующей страницы
+type AuditFilter struct {
+	ActorID  int
+	Actor    string
+	Action   string
+	Entity   string
+	EntityID string
+	From     *time.Time
+	To       *time.Time
+	BeforeID int64
+	Limit    int
+}
+
+// Страница журнала; NextCursor = 0 — записей больше нет
+type AuditPage struct {
+	Entries    []AuditEntry
+	NextCursor int64
+}
+
+const (
+	DefaultAuditLimit = 50
+	MaxAuditLimit     = 200
+)
+
+// Поля с секретами не попадают в журнал. Ссылка url тоже скрывается:
+// в ссылках приглашений и сброса пароля передаётся токен.
+func auditSensitive(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "password") || strings.Contains(key, "token") || strings.Contains(key, "secret") ||
+		key == "url"
+}
+
+// Вложенные коллекции со своими идентификаторами: их :id не относится
+// к родительской сущности
+var auditSubresources = map[string]bool{
+	"users/invites": true,
+}
+
+// Сущность журнала по маршруту: первый сегмент после /api/ или вложенная
+// коллекция из auditSubresources
+func auditEntity(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/api/"), "/", 3)
+	if len(segments) > 1 && auditSubresources[segments[0]+"/"+segments[1]] {
+		return segments[0] + "/" + segments[1]
+	}
+	return segments[0]
+}
+
+// Приведение значения к JSON-виду со скрытием секретов
+func auditValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil
+	}
+	return redactAudit(out)
+}
+
+func redactAudit(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if auditSensitive(k) {
+				t[k] = "***"
+			} else {
+				t[k] = redactAudit(val)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactAudit(t[i])
+		}
+	}
+	return v
+}
+
+// Изменившиеся поля верхнего уровня. Значения, не являющиеся объектами,
+// сравниваются целиком под ключом value.
+func auditDiff(before, after interface{}) map[string]AuditChange {
+	b, a := auditValue(before), auditValue(after)
+	if b == nil && a == nil {
+		return nil
+	}
+
+	bm, bok := b.(map[string]interface{})
+	am, aok := a.(map[string]interface{})
+	if (b != nil && !bok) || (a != nil && !aok) {
+		return map[string]AuditChange{"value": {Before: b, After: a}}
+	}
+
+	diff := make(map[string]AuditChange)
+	for k, bv := range bm {
+		av, ok := am[k]
+		if !ok || !auditEqual(bv, av) {
+			diff[k] = AuditChange{Before: bv, After: av}
+		}
+	}
+	for k, av := range am {
+		if _, ok := bm[k]; !ok {
+			diff[k] = AuditChange{Before: nil, After: av}
+		}
+	}
+	return diff
+}
+
+func auditEqual(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// Текущее состояние сущностей для журнала по сегменту пути и параметру :id
+// (:code у подарочных карт). Удалённая сущность возвращает nil.
+var auditLoaders = map[string]func(u *Usecase, id string) (interface{}, error){
+	"menu": func(u *Usecase, id string) (interface{}, error) {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, nil
+		}
+		return auditFound(u.p.FetchMenuItem(n))
+	},
+	"orders": func(u *Usecase, id string) (interface{}, error) {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, nil
+		}
+		return auditFound(u.p.FetchOrder(n))
+	},
+	"customers": func(u *Usecase, id string) (interface{}, error) {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, nil
+		}
+		return auditFound(u.p.FetchCustomer(n))
+	},
+	"tables": func(u *Usecase, id string) (interface{}, error) {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, nil
+		}
+		return auditFound(u.p.FetchTable(n))
+	},
+	"reservations": func(u *Usecase, id string) (interface{}, error) {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, nil
+		}
+		return auditFound(u.p.FetchReservation(n))
+	},
+	"locations": func(u *Usecase, id string) (interface{}, error) {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, nil
+		}
+		return auditFound(u.p.FetchLocation(n))
+	},
+	"users": func(u *Usecase, id string) (interface{}, error) {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, nil
+		}
+		return auditFound(u.p.FetchUser(n))
+	},
+	"gift-cards": func(u *Usecase, id string) (interface{}, error) {
+		code, err := normalizeGiftCardCode(id)
+		if err != nil {
+			return nil, nil
+		}
+		card, err := u.p.FetchGiftCard(code)
+		// История операций в сравнение не входит, баланс меняется и так
+		card.Transactions = nil
+		return auditFound(card, err)
+	},
+}
+
+// Ненайденная сущность означает, что её нет (ещё нет или уже удалена)
+func auditFound[T any](v T, err error) (interface{}, error) {
+	if err != nil {
+		if errors.Is(err, ErrMenuItemNotFound) || errors.Is(err, ErrOrderNotFound) ||
+			errors.Is(err, ErrCustomerNotFound) || errors.Is(err, ErrTableNotFound) ||
+			errors.Is(err, ErrReservationNotFound) || errors.Is(err, ErrLocationNotFound) ||
+			errors.Is(err, ErrGiftCardNotFound) || errors.Is(err, ErrUserNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// Состояние сущности для журнала; ok = false, если сущность не отслеживается
+func (u *Usecase) AuditState(entity, id string) (state interface{}, ok bool) {
+	loader, ok := auditLoaders[entity]
+	if !ok || id == "" {
+		return nil, false
+	}
+	state, err := loader(u, id)
+	if err != nil {
+		log.Printf("Error loading %s %s for audit: %v", entity, id, err)
+	}
+	return state, true
+}
+
+func (u *Usecase) RecordAudit(entry AuditEntry) error {
+	return u.p.AddAuditEntry(entry)
+}
+
+func (u *Usecase) GetAudit(filter AuditFilter) (AuditPage, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultAuditLimit
+	}
+	if filter.Limit > MaxAuditLimit {
+		filter.Limit = MaxAuditLimit
+	}
+	return u.p.FetchAudit(filter)
+}
+
+// Удаление записей журнала старше срока хранения
+func (u *Usecase) RunAuditRetention(interval time.Duration) {
+	days := u.audit.RetentionDays
+	if days <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		n, err := u.p.PurgeAudit(time.Duration(days) * 24 * time.Hour)
+		if err != nil {
+			log.Printf("Error purging audit log: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Audit log: removed %d entries older than %d days", n, days)
+		}
+	}
+}
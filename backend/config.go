@@ -11,10 +11,164 @@ type Config struct {
 	IP   string `yaml:"ip"`
 	Port int    `yaml:"port"`
 
-	API     APIConfig     `yaml:"api"`
-	Usecase UsecaseConfig `yaml:"usecase"`
-	DB      DBConfig      `yaml:"db"`
-	JWT     JWTConfig     `yaml:"jwt"`
+	API          APIConfig          `yaml:"api"`
+	Usecase      UsecaseConfig      `yaml:"usecase"`
+	DB           DBConfig           `yaml:"db"`
+	JWT          JWTConfig          `yaml:"jwt"`
+	Preorders    PreorderConfig     `yaml:"preorders"`
+	Business     BusinessConfig     `yaml:"business"`
+	Locations    LocationsConfig    `yaml:"locations"`
+	Shifts       ShiftsConfig       `yaml:"shifts"`
+	Loyalty      LoyaltyConfig      `yaml:"loyalty"`
+	GiftCards    GiftCardsConfig    `yaml:"gift_cards"`
+	Reservations ReservationsConfig `yaml:"reservations"`
+	Receipt      ReceiptConfig      `yaml:"receipt"`
+	Printing     PrintingConfig     `yaml:"printing"`
+	Fiscal       FiscalConfig       `yaml:"fiscal"`
+	Audit        AuditConfig        `yaml:"audit"`
+	Users        UsersConfig        `yaml:"users"`
+	Notifier     NotifierConfig     `yaml:"notifier"`
+	LoginLimit   LoginLimitConfig   `yaml:"login_limit"`
+}
+
+// Защита входа от перебора паролей
+type LoginLimitConfig struct {
+	// Неудач подряд без задержки для учётной записи и для IP
+	AccountFree int `yaml:"account_free"`
+	IPFree      int `yaml:"ip_free"`
+	// После стольких неудач ключ блокируется; -1 — не блокировать
+	AccountLockout int `yaml:"account_lockout"`
+	IPLockout      int `yaml:"ip_lockout"`
+	// Пауза после первой лишней неудачи, удваивается с каждой следующей
+	BaseDelaySeconds int `yaml:"base_delay_seconds"`
+	MaxDelaySeconds  int `yaml:"max_delay_seconds"`
+	LockoutMinutes   int `yaml:"lockout_minutes"`
+	// Счётчик забывается, если неудач не было столько минут
+	ResetAfterMinutes int `yaml:"reset_after_minutes"`
+}
+
+// Доставка писем пользователям
+type NotifierConfig struct {
+	// Способ доставки: smtp, file (дописывать в файл) или log (по умолчанию)
+	Driver string `yaml:"driver"`
+	File   string `yaml:"file"`
+	// SMTP-сервер; порт по умолчанию 587
+	SMTPHost string `yaml:"smtp_host"`
+	SMTPPort int    `yaml:"smtp_port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+type UsersConfig struct {
+	// Разрешить самостоятельную регистрацию; по умолчанию сотрудники
+	// появляются только по приглашению владельца
+	OpenRegistration bool `yaml:"open_registration"`
+	// Срок действия приглашения в часах
+	InviteTTLHours int `yaml:"invite_ttl_hours"`
+	// Ссылка на форму регистрации с подстановкой {token}; пустая — только токен
+	InviteURL string `yaml:"invite_url"`
+	// Срок действия ссылки для сброса пароля в минутах
+	ResetTTLMinutes int `yaml:"reset_ttl_minutes"`
+	// Ссылка на форму нового пароля с подстановкой {token}
+	ResetURL string `yaml:"reset_url"`
+	// Ограничение запросов сброса пароля по адресу и IP; поля как в login_limit
+	ResetLimit LoginLimitConfig `yaml:"reset_limit"`
+}
+
+type AuditConfig struct {
+	// Сколько дней хранить журнал действий; 0 — хранить бессрочно
+	RetentionDays int `yaml:"retention_days"`
+}
+
+// Онлайн-касса по 54-ФЗ
+type FiscalConfig struct {
+	// Драйвер кассы: http, stub (заглушка для разработки); пусто — фискализация выключена
+	Driver string `yaml:"driver"`
+	// Адрес HTTP-шлюза кассы и токен доступа для драйвера http
+	URL            string `yaml:"url"`
+	Token          string `yaml:"token"`
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+	// Система налогообложения: osn, usn_income, usn_income_outcome, esn, patent
+	Taxation string `yaml:"taxation"`
+	// Ставка НДС по умолчанию и ставки по категориям меню
+	VAT           string            `yaml:"vat"`
+	VATByCategory map[string]string `yaml:"vat_by_category"`
+	// Предмет расчёта позиций меню: commodity (товар) или service (услуга)
+	PaymentObject string `yaml:"payment_object"`
+	// Когда пробивать приход: created — при оформлении, completed — при выдаче
+	IssueOn      string `yaml:"issue_on"`
+	RetrySeconds int    `yaml:"retry_seconds"`
+	MaxAttempts  int    `yaml:"max_attempts"`
+}
+
+type PrintingConfig struct {
+	// Пауза перед повторной отправкой, удваивается с каждой попыткой
+	RetrySeconds int `yaml:"retry_seconds"`
+	// После стольких неудачных попыток задание помечается failed
+	MaxAttempts    int             `yaml:"max_attempts"`
+	TimeoutSeconds int             `yaml:"timeout_seconds"`
+	Printers       []PrinterConfig `yaml:"printers"`
+}
+
+// Сетевой термопринтер ESC/POS
+type PrinterConfig struct {
+	Name string `yaml:"name"`
+	// Адрес host:port, обычно порт 9100
+	Address string `yaml:"address"`
+	// Точка, заказы которой печатает принтер; 0 — все точки
+	LocationID int `yaml:"location_id"`
+	// Символов в строке: 32 для ленты 58 мм, 48 для 80 мм (по умолчанию)
+	Width int `yaml:"width"`
+	// Кодовая страница кириллицы: cp866 (по умолчанию) или cp1251
+	CodePage string `yaml:"code_page"`
+	// Печатать чеки и кухонные тикеты
+	Receipts bool `yaml:"receipts"`
+	Kitchen  bool `yaml:"kitchen"`
+	// Станция, позиции которой попадают в кухонный тикет; 0 — все позиции
+	StationID int `yaml:"station_id"`
+}
+
+// Реквизиты кафе в шапке чека
+type ReceiptConfig struct {
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"`
+	Phone   string `yaml:"phone"`
+	TaxID   string `yaml:"tax_id"`
+	Footer  string `yaml:"footer"`
+	// Ссылка на отзыв с подстановками {order} и {token}; пустая — без ссылки
+	FeedbackURL string `yaml:"feedback_url"`
+}
+
+type ReservationsConfig struct {
+	// Длительность брони, если она не указана явно
+	DefaultDurationMinutes int `yaml:"default_duration_minutes"`
+}
+
+type GiftCardsConfig struct {
+	// Срок действия карты со дня активации; 0 — бессрочно
+	ValidityDays int `yaml:"validity_days"`
+}
+
+type LoyaltyConfig struct {
+	// Баллов за рубль, оплаченный деньгами, например 0.05 — 5% от суммы
+	EarnRate float64 `yaml:"earn_rate"`
+	// Стоимость балла в рублях при списании
+	PointValue float64 `yaml:"point_value"`
+	// Наибольшая доля заказа, которую можно оплатить баллами
+	MaxRedeemShare float64 `yaml:"max_redeem_share"`
+	// Баллы сгорают, если за это время не было новых начислений
+	ExpiryDays int `yaml:"expiry_days"`
+}
+
+type ShiftsConfig struct {
+	// Отклонять заказы, если у кассира нет открытой смены
+	RequireOpen bool `yaml:"require_open"`
+}
+
+type LocationsConfig struct {
+	// Точка для новых пользователей и заказов без явного указания точки
+	DefaultID int `yaml:"default_id"`
 }
 
 type APIConfig struct {
@@ -22,10 +176,49 @@ type APIConfig struct {
 	MaxPasswordSize int `yaml:"max_password_size"`
 	MinUsernameSize int `yaml:"min_username_size"`
 	MaxUsernameSize int `yaml:"max_username_size"`
+	// Адреса или подсети обратных прокси, которым можно доверить X-Forwarded-For.
+	// Пустой список — клиентом считается адрес соединения.
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 type UsecaseConfig struct {
 	DefaultMessage string `yaml:"default_message"`
+	// Время хранения ключей идемпотентности заказов
+	IdempotencyTTLMinutes int `yaml:"idempotency_ttl_minutes"`
+}
+
+type PreorderConfig struct {
+	// Длительность слота выдачи и число заказов, которое кухня успевает за слот
+	SlotMinutes  int `yaml:"slot_minutes"`
+	SlotCapacity int `yaml:"slot_capacity"`
+	// За сколько минут до выдачи предзаказ попадает в работу
+	ReleaseMinutes int `yaml:"release_minutes"`
+	// Минимальное время на приготовление и горизонт предзаказа
+	MinLeadMinutes int `yaml:"min_lead_minutes"`
+	MaxDaysAhead   int `yaml:"max_days_ahead"`
+}
+
+type BusinessConfig struct {
+	// Часовой пояс кафе в формате IANA, например Europe/Moscow
+	Timezone string `yaml:"timezone"`
+	// Граница рабочего дня в формате HH:MM
+	DayCutoff string `yaml:"day_cutoff"`
+	// Часы работы по дням недели: mon, tue, wed, thu, fri, sat, sun
+	OpeningHours map[string]HoursConfig `yaml:"opening_hours"`
+	Holidays     []HolidayConfig        `yaml:"holidays"`
+	// Принимать заказы в нерабочее время без явного подтверждения
+	AcceptWhenClosed bool `yaml:"accept_when_closed"`
+}
+
+type HoursConfig struct {
+	Open   string `yaml:"open"`
+	Close  string `yaml:"close"`
+	Closed bool   `yaml:"closed"`
+}
+
+type HolidayConfig struct {
+	Date        string `yaml:"date"`
+	HoursConfig `yaml:",inline"`
 }
 
 type DBConfig struct {
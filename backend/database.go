@@ -1,23 +1,30 @@
 package main
 
 import (
+	"backend/pkg/vars"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Provider struct {
 	conn *sql.DB
 }
 
-func NewProvider(host string, port int, user, password, dbName string) *Provider {
+func NewProvider(host string, port int, user, password, dbName, timezone string) *Provider {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable timezone=Europe/Moscow",
-		host, port, user, password, dbName)
+		"password=%s dbname=%s sslmode=disable timezone=%s",
+		host, port, user, password, dbName, timezone)
 
 	conn, err := sql.Open("postgres", psqlInfo)
 	if err != nil {
@@ -33,14 +40,72 @@ func NewProvider(host string, port int, user, password, dbName string) *Provider
 	return &Provider{conn: conn}
 }
 
-func (p *Provider) CreateUser(username, email, hashedPassword string) error {
-	_, err := p.conn.Exec("INSERT INTO users (name, email, password) VALUES ($1, $2, $3)", username, email, hashedPassword)
+// Новый пользователь получает роль role и доступ к точке по умолчанию
+func (p *Provider) CreateUser(username, email, hashedPassword, role string, locationID int) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		return insertUser(tx, username, email, hashedPassword, role, locationID)
+	})
+}
+
+// Первый пользователь в пустой базе. Таблица блокируется до конца транзакции,
+// чтобы две одновременные регистрации не создали двух владельцев.
+func (p *Provider) CreateFirstUser(username, email, hashedPassword, role string, locationID int) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+			return err
+		}
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users)").Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrRegistrationClose
+		}
+		return insertUser(tx, username, email, hashedPassword, role, locationID)
+	})
+}
+
+func insertUser(tx *sql.Tx, username, email, hashedPassword, role string, locationID int) error {
+	var userID int
+	err := tx.QueryRow(
+		"INSERT INTO users (name, email, password, role) VALUES ($1, $2, $3, $4) RETURNING id",
+		username, email, hashedPassword, role,
+	).Scan(&userID)
 	if err != nil {
 		log.Printf("Error creating user in database: %v", err)
+		return err
+	}
+	if locationID > 0 {
+		_, err = tx.Exec("INSERT INTO user_locations (user_id, location_id) VALUES ($1, $2)", userID, locationID)
 	}
 	return err
 }
 
+func (p *Provider) FetchUserAccess(email string) (UserAccess, error) {
+	var access UserAccess
+	err := p.conn.QueryRow("SELECT id, name, role, active FROM users WHERE email = $1", email).Scan(&access.ID, &access.Name, &access.Role, &access.Active)
+	if err != nil {
+		return UserAccess{}, err
+	}
+
+	rows, err := p.conn.Query("SELECT location_id FROM user_locations WHERE user_id = $1 ORDER BY location_id ASC", access.ID)
+	if err != nil {
+		return UserAccess{}, err
+	}
+	defer rows.Close()
+
+	access.Locations = []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return UserAccess{}, err
+		}
+		access.Locations = append(access.Locations, id)
+	}
+
+	return access, rows.Err()
+}
+
 func (p *Provider) CheckUserByEmail(email string) (bool, error) {
 	err := p.conn.QueryRow("SELECT (email) FROM users WHERE email = $1", email).Scan(&email)
 	if err != nil {
@@ -63,8 +128,16 @@ func (p *Provider) GetUsernameAndHashedPassword(email string) (string, string, e
 
 	return name, password_db, nil
 }
-func (p *Provider) FetchMenuItems() ([]MenuItem, error) {
-	rows, err := p.conn.Query("SELECT id, name, description, price, created_at FROM menu ORDER BY id ASC")
+
+// Меню точки с учётом переопределённых цен; locationID = 0 возвращает базовое меню
+func (p *Provider) FetchMenuItems(locationID int) ([]MenuItem, error) {
+	rows, err := p.conn.Query(`
+        SELECT m.id, m.name, m.description, COALESCE(mlp.price, m.price), m.station_id, m.category, m.created_at
+        FROM menu m
+        LEFT JOIN menu_location_prices mlp ON mlp.menu_item_id = m.id AND mlp.location_id = $1
+        WHERE mlp.available IS NOT FALSE
+        ORDER BY m.id ASC
+    `, locationID)
 	if err != nil {
 		return nil, err
 	}
@@ -74,7 +147,7 @@ func (p *Provider) FetchMenuItems() ([]MenuItem, error) {
 	for rows.Next() {
 		var item MenuItem
 		var createdAt time.Time
-		err := rows.Scan(&item.ID, &item.Name, &item.Description, &item.Price, &createdAt)
+		err := rows.Scan(&item.ID, &item.Name, &item.Description, &item.Price, &item.StationID, &item.Category, &createdAt)
 		if err != nil {
 			return nil, err
 		}
@@ -88,23 +161,40 @@ func (p *Provider) FetchMenuItems() ([]MenuItem, error) {
 
 	return menuItems, nil
 }
+
+// Позиция базового меню без переопределений точек
+func (p *Provider) FetchMenuItem(id int) (MenuItem, error) {
+	var item MenuItem
+	var createdAt time.Time
+	err := p.conn.QueryRow("SELECT id, name, description, price, station_id, category, created_at FROM menu WHERE id = $1", id).
+		Scan(&item.ID, &item.Name, &item.Description, &item.Price, &item.StationID, &item.Category, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return MenuItem{}, ErrMenuItemNotFound
+	}
+	if err != nil {
+		return MenuItem{}, err
+	}
+	item.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	return item, nil
+}
+
 func (p *Provider) DeleteMenuItem(id int) error {
 	_, err := p.conn.Exec("DELETE FROM menu WHERE id = $1", id)
 	return err
 }
 
 func (p *Provider) UpdateMenuItem(item MenuItem) (MenuItem, error) {
-	_, err := p.conn.Exec("UPDATE menu SET name = $1, description = $2, price = $3 WHERE id = $4",
-		item.Name, item.Description, item.Price, item.ID)
+	_, err := p.conn.Exec("UPDATE menu SET name = $1, description = $2, price = $3, category = $4 WHERE id = $5",
+		item.Name, item.Description, item.Price, item.Category, item.ID)
 	if err != nil {
 		return MenuItem{}, err
 	}
 
 	// Возвращаем обновленный элемент
-	row := p.conn.QueryRow("SELECT id, name, description, price, created_at FROM menu WHERE id = $1", item.ID)
+	row := p.conn.QueryRow("SELECT id, name, description, price, station_id, category, created_at FROM menu WHERE id = $1", item.ID)
 	var updatedItem MenuItem
 	var createdAt time.Time
-	err = row.Scan(&updatedItem.ID, &updatedItem.Name, &updatedItem.Description, &updatedItem.Price, &createdAt)
+	err = row.Scan(&updatedItem.ID, &updatedItem.Name, &updatedItem.Description, &updatedItem.Price, &updatedItem.StationID, &updatedItem.Category, &createdAt)
 	if err != nil {
 		return MenuItem{}, err
 	}
@@ -116,16 +206,17 @@ func (p *Provider) AddMenuItem(item MenuItem) (MenuItem, error) {
 	var newItem MenuItem
 	var createdAt time.Time
 	err := p.conn.QueryRow(
-		"INSERT INTO menu (name, description, price) VALUES ($1, $2, $3) RETURNING id, name, description, price, created_at",
-		item.Name, item.Description, item.Price,
-	).Scan(&newItem.ID, &newItem.Name, &newItem.Description, &newItem.Price, &createdAt)
+		"INSERT INTO menu (name, description, price, station_id, category) VALUES ($1, $2, $3, $4, $5) RETURNING id, name, description, price, station_id, category, created_at",
+		item.Name, item.Description, item.Price, item.StationID, item.Category,
+	).Scan(&newItem.ID, &newItem.Name, &newItem.Description, &newItem.Price, &newItem.StationID, &newItem.Category, &createdAt)
 	if err != nil {
 		return MenuItem{}, err
 	}
 	newItem.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
 	return newItem, nil
 }
-func (p *Provider) AddOrder(items []OrderItem) (Order, error) {
+func (p *Provider) AddOrder(req OrderRequest) (Order, error) {
+	items := req.Items
 	tx, err := p.conn.Begin()
 	if err != nil {
 		log.Printf("Failed to begin transaction: %v", err)
@@ -152,22 +243,104 @@ func (p *Provider) AddOrder(items []OrderItem) (Order, error) {
 		}
 	}()
 
-	// Insert new order with default status "In work" and total 0
+	// Reserve the idempotency key first: a concurrent request with the same key
+	// waits on the primary key until this transaction finishes
+	if req.IdempotencyKey != "" {
+		var res sql.Result
+		res, err = tx.Exec(
+			"INSERT INTO idempotency_keys (user_id, key, request_hash) VALUES ($1, $2, $3) ON CONFLICT (user_id, key) DO NOTHING",
+			req.IdempotencyUserID, req.IdempotencyKey, req.RequestHash,
+		)
+		if err != nil {
+			return Order{}, fmt.Errorf("failed to reserve idempotency key: %v", err)
+		}
+		var affected int64
+		affected, err = res.RowsAffected()
+		if err != nil {
+			return Order{}, err
+		}
+		if affected == 0 {
+			err = ErrIdempotencyKeyExists
+			return Order{}, err
+		}
+	}
+
+	// Every order belongs to the cashier's open shift at this location
+	var shiftID sql.NullInt64
 	err = tx.QueryRow(
-		"INSERT INTO orders (total, status) VALUES ($1, $2) RETURNING id, total, status, created_at",
-		0, "В работе",
-	).Scan(&newOrder.ID, &newOrder.Total, &newOrder.Status, &newOrder.CreatedAt)
+		"SELECT id FROM shifts WHERE user_id = $1 AND location_id = $2 AND closed_at IS NULL",
+		req.UserID, req.LocationID,
+	).Scan(&shiftID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to find open shift: %v", err)
+	}
+	if !shiftID.Valid && req.RequireShift {
+		err = ErrNoOpenShift
+		return Order{}, err
+	}
+
+	// Short queue number for call-out, restarting every business day. The upsert locks
+	// the day's counter row, so concurrent orders never share a number
+	var queueNumber int
+	err = tx.QueryRow(`
+        INSERT INTO order_queue (location_id, day, last_number) VALUES ($1, $2::date, 1)
+        ON CONFLICT (location_id, day) DO UPDATE SET last_number = order_queue.last_number + 1
+        RETURNING last_number
+    `, req.LocationID, req.BusinessDate).Scan(&queueNumber)
+	if err != nil {
+		log.Printf("Failed to allocate queue number: %v", err)
+		return Order{}, fmt.Errorf("failed to allocate queue number: %v", err)
+	}
+
+	// Pre-orders are limited by kitchen capacity per pickup slot. The advisory
+	// lock serializes orders competing for the same slot
+	if req.Slot != nil && req.Slot.Capacity > 0 {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", req.Slot.Start.Unix()*1000+int64(req.LocationID))
+		if err != nil {
+			return Order{}, fmt.Errorf("failed to lock pickup slot: %v", err)
+		}
+		var taken int
+		err = tx.QueryRow(
+			"SELECT COUNT(*) FROM orders WHERE location_id = $1 AND pickup_at >= $2::timestamptz AND pickup_at < $3::timestamptz AND status <> $4",
+			req.LocationID, req.Slot.Start, req.Slot.End, "Отменен",
+		).Scan(&taken)
+		if err != nil {
+			return Order{}, fmt.Errorf("failed to count pickup slot orders: %v", err)
+		}
+		if taken >= req.Slot.Capacity {
+			err = ErrSlotFull
+			return Order{}, err
+		}
+	}
+
+	// Insert new order with total 0
+	err = scanOrder(tx.QueryRow(
+		"INSERT INTO orders AS o (total, status, order_type, table_number, customer_name, queue_number, note, pickup_at, location_id, payment_method, shift_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8::timestamptz, $9, $10, $11) RETURNING "+orderColumns,
+		0, req.Status, req.Type, req.TableNumber, req.CustomerName, queueNumber, req.Note, req.PickupAt, req.LocationID, req.PaymentMethod, shiftID,
+	), &newOrder)
 	if err != nil {
 		log.Printf("Failed to insert new order: %v", err)
 		return Order{}, fmt.Errorf("failed to insert new order: %v", err)
 	}
 	log.Printf("Inserted new order with ID: %d", newOrder.ID)
 
+	// The customer is resolved before pricing: a full stamp card makes one item free
+	var customerID int
+	if req.CustomerPhone != "" {
+		customerID, err = upsertCustomer(tx, req.CustomerPhone, req.CustomerName)
+		if err != nil {
+			return Order{}, err
+		}
+	}
+
 	var total float64
-	for _, item := range items {
+	for i, item := range items {
 		var price float64
-		// Get price of the menu item
-		err = tx.QueryRow("SELECT price FROM menu WHERE id = $1", item.MenuItemId).Scan(&price)
+		// Get price of the menu item, taking the location's override into account
+		err = tx.QueryRow(menuPriceQuery, item.MenuItemId, req.LocationID).Scan(&price)
 		if err != nil {
 			log.Printf("Failed to get price for menu item ID %d: %v", item.MenuItemId, err)
 			return Order{}, fmt.Errorf("failed to get price for menu item ID %d: %v", item.MenuItemId, err)
@@ -177,19 +350,29 @@ func (p *Provider) AddOrder(items []OrderItem) (Order, error) {
 		total += price * float64(item.Quantity)
 		log.Printf("Added %.2f to total. Current total: %.2f", price*float64(item.Quantity), total)
 
-		// Insert into order_items
-		_, err = tx.Exec(
-			"INSERT INTO order_items (order_id, menu_item_id, quantity) VALUES ($1, $2, $3)",
-			newOrder.ID, item.MenuItemId, item.Quantity,
-		)
+		// Insert into order_items, fixing the price at the moment of sale
+		err = tx.QueryRow(
+			"INSERT INTO order_items (order_id, menu_item_id, quantity, price, comment) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			newOrder.ID, item.MenuItemId, item.Quantity, price, item.Comment,
+		).Scan(&items[i].ID)
 		if err != nil {
 			log.Printf("Failed to insert order item (OrderID: %d, MenuItemID: %d, Quantity: %d): %v",
 				newOrder.ID, item.MenuItemId, item.Quantity, err)
 			return Order{}, fmt.Errorf("failed to insert order item: %v", err)
 		}
+		items[i].Price = price
 		log.Printf("Inserted order item (MenuItemID: %d, Quantity: %d)", item.MenuItemId, item.Quantity)
 	}
 
+	if customerID != 0 {
+		var discount float64
+		items, discount, err = applyStampRewards(tx, newOrder.ID, customerID, items)
+		if err != nil {
+			return Order{}, err
+		}
+		total -= discount
+	}
+
 	// Update the total in orders table
 	_, err = tx.Exec("UPDATE orders SET total = $1 WHERE id = $2", total, newOrder.ID)
 	if err != nil {
@@ -201,77 +384,428 @@ func (p *Provider) AddOrder(items []OrderItem) (Order, error) {
 	newOrder.Total = total
 	newOrder.Items = items
 
+	// Points are redeemed and earned in the same transaction as the order
+	if customerID != 0 {
+		err = applyOrderLoyalty(tx, &newOrder, customerID, req)
+		if err != nil {
+			return Order{}, err
+		}
+	}
+	if req.GiftCardCode != "" {
+		err = redeemGiftCard(tx, &newOrder, req.GiftCardCode, req.GiftCardAmount, req.UserName)
+		if err != nil {
+			return Order{}, err
+		}
+	}
+
+	// Store the result to replay it for retries with the same key
+	if req.IdempotencyKey != "" {
+		var response []byte
+		response, err = json.Marshal(newOrder)
+		if err != nil {
+			return Order{}, err
+		}
+		_, err = tx.Exec(
+			"UPDATE idempotency_keys SET order_id = $1, response = $2 WHERE user_id = $3 AND key = $4",
+			newOrder.ID, string(response), req.IdempotencyUserID, req.IdempotencyKey,
+		)
+		if err != nil {
+			log.Printf("Failed to store idempotent response (OrderID: %d): %v", newOrder.ID, err)
+			return Order{}, fmt.Errorf("failed to store idempotent response: %v", err)
+		}
+	}
+
 	return newOrder, nil
 }
-func (p *Provider) FetchOrders() ([]Order, error) {
-	rows, err := p.conn.Query("SELECT id, total, status, created_at FROM orders ORDER BY id ASC")
+
+func (p *Provider) FetchIdempotencyKey(userID int, key string) (string, []byte, error) {
+	var hash, response string
+	err := p.conn.QueryRow("SELECT request_hash, response FROM idempotency_keys WHERE user_id = $1 AND key = $2", userID, key).Scan(&hash, &response)
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+	return hash, []byte(response), nil
+}
+
+// Удаление ключей идемпотентности старше ttl
+func (p *Provider) PurgeIdempotencyKeys(ttl time.Duration) error {
+	_, err := p.conn.Exec(
+		"DELETE FROM idempotency_keys WHERE created_at < NOW() - $1::integer * INTERVAL '1 second'",
+		int(ttl.Seconds()),
+	)
+	return err
+}
+
+// Колонки заказа в порядке, ожидаемом scanOrder
+const orderColumns = "o.id, o.total, o.status, o.created_at, o.order_type, o.table_number, o.customer_name, o.queue_number, o.note, o.pickup_at, o.location_id, o.payment_method, o.shift_id, " +
+	"o.customer_id, o.points_redeemed, o.points_amount, o.points_earned, o.gift_card_amount"
+
+// Цена позиции меню в точке ($2); недоступная в точке позиция не находится
+const menuPriceQuery = `
+    SELECT COALESCE(mlp.price, m.price)
+    FROM menu m
+    LEFT JOIN menu_location_prices mlp ON mlp.menu_item_id = m.id AND mlp.location_id = $2
+    WHERE m.id = $1 AND mlp.available IS NOT FALSE
+`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Чтение строки с колонками orderColumns; extra дописываются после них
+func scanOrder(row rowScanner, order *Order, extra ...interface{}) error {
+	var queueNumber sql.NullInt64
+	var pickupAt sql.NullTime
+	dest := []interface{}{
+		&order.ID, &order.Total, &order.Status, &order.CreatedAt,
+		&order.Type, &order.TableNumber, &order.CustomerName, &queueNumber, &order.Note, &pickupAt,
+		&order.LocationID, &order.PaymentMethod, &order.ShiftID,
+		&order.CustomerID, &order.PointsRedeemed, &order.PointsAmount, &order.PointsEarned,
+		&order.GiftCardAmount,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	order.QueueNumber = int(queueNumber.Int64)
+	if pickupAt.Valid {
+		order.PickupAt = &pickupAt.Time
+	}
+	return nil
+}
+
+// Колонки, по которым допускается сортировка списка заказов
+var orderSortColumns = map[string]string{
+	"id":         "o.id",
+	"created_at": "o.created_at",
+	"total":      "o.total",
+}
+
+// Курсор указывает на последнюю строку страницы: значение сортировки и id.
+// Сортировка и направление сохраняются в курсоре, чтобы курсор от другого
+// порядка не применялся к текущему.
+type orderCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func encodeOrderCursor(cur orderCursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Разбор курсора для сортировки f; возвращает значение сортировки,
+// приведённое к типу колонки (nil для сортировки по id)
+func decodeOrderCursor(s string, f OrderFilter) (orderCursor, interface{}, error) {
+	var cur orderCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, nil, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &cur); err != nil || cur.ID <= 0 {
+		return cur, nil, ErrInvalidCursor
+	}
+	if cur.Sort != f.Sort || cur.Desc != f.Desc {
+		return cur, nil, ErrInvalidCursor
+	}
+
+	switch f.Sort {
+	case "created_at":
+		t, err := time.Parse(time.RFC3339Nano, cur.Value)
+		if err != nil {
+			return cur, nil, ErrInvalidCursor
+		}
+		return cur, t, nil
+	case "total":
+		v, err := strconv.ParseFloat(cur.Value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return cur, nil, ErrInvalidCursor
+		}
+		// Строка передаётся как есть, чтобы numeric сравнивался без потери точности
+		return cur, cur.Value, nil
+	}
+	return cur, nil, nil
+}
+
+// Условия WHERE для фильтров списка заказов
+func orderFilterConditions(f OrderFilter) ([]string, []interface{}) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.LocationID > 0 {
+		add("o.location_id = $%d", f.LocationID)
+	}
+	if f.Status != "" {
+		add("o.status = $%d", f.Status)
+	}
+	if f.Type != "" {
+		add("o.order_type = $%d", f.Type)
+	}
+	if f.TableNumber > 0 {
+		add("o.table_number = $%d", f.TableNumber)
+	}
+	if f.Upcoming {
+		where = append(where, "o.pickup_at >= NOW()")
+	}
+	if f.From != nil {
+		add("o.created_at >= $%d::timestamptz", *f.From)
+	}
+	if f.To != nil {
+		add("o.created_at < $%d::timestamptz", *f.To)
+	}
+	if f.MinTotal != nil {
+		add("o.total >= $%d", *f.MinTotal)
+	}
+	if f.MaxTotal != nil {
+		add("o.total <= $%d", *f.MaxTotal)
+	}
+	if f.MenuItemID > 0 {
+		add("EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = o.id AND oi.menu_item_id = $%d)", f.MenuItemID)
+	}
+	if f.CustomerID > 0 {
+		add("o.customer_id = $%d", f.CustomerID)
+	}
+
+	return where, args
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+func (p *Provider) FetchOrders(f OrderFilter) (OrderPage, error) {
+	column, ok := orderSortColumns[f.Sort]
+	if !ok {
+		return OrderPage{}, fmt.Errorf("invalid sort column %q", f.Sort)
+	}
+	direction, cmp := "ASC", ">"
+	if f.Desc {
+		direction, cmp = "DESC", "<"
+	}
+
+	where, args := orderFilterConditions(f)
+
+	var page OrderPage
+	err := p.conn.QueryRow("SELECT COUNT(*) FROM orders o "+whereClause(where), args...).Scan(&page.TotalCount)
+	if err != nil {
+		return OrderPage{}, err
+	}
+
+	if f.Cursor != "" {
+		cur, value, err := decodeOrderCursor(f.Cursor, f)
+		if err != nil {
+			return OrderPage{}, err
+		}
+		switch f.Sort {
+		case "created_at":
+			args = append(args, value, cur.ID)
+			where = append(where, fmt.Sprintf("(%s, o.id) %s ($%d::timestamptz, $%d)", column, cmp, len(args)-1, len(args)))
+		case "total":
+			args = append(args, value, cur.ID)
+			where = append(where, fmt.Sprintf("(%s, o.id) %s ($%d::numeric, $%d)", column, cmp, len(args)-1, len(args)))
+		default:
+			args = append(args, cur.ID)
+			where = append(where, fmt.Sprintf("o.id %s $%d", cmp, len(args)))
+		}
+	}
+
+	// Лишняя строка показывает, есть ли следующая страница
+	args = append(args, f.Limit+1)
+	query := fmt.Sprintf(`
+        SELECT %s, %s
+        FROM orders o
+        %s
+        ORDER BY %s %s, o.id %s
+        LIMIT $%d
+    `, orderColumns, column, whereClause(where), column, direction, direction, len(args))
+
+	rows, err := p.conn.Query(query, args...)
+	if err != nil {
+		return OrderPage{}, err
 	}
 	defer rows.Close()
 
-	var orders []Order
+	orders := []Order{}
+	var sortValues []string
 	for rows.Next() {
 		var order Order
-		err := rows.Scan(&order.ID, &order.Total, &order.Status, &order.CreatedAt)
-		if err != nil {
-			return nil, err
+		var sortValue string
+		var sortTime time.Time
+		var dest interface{} = &sortValue
+		if f.Sort == "created_at" {
+			dest = &sortTime
+		}
+		if err := scanOrder(rows, &order, dest); err != nil {
+			return OrderPage{}, err
 		}
+		if f.Sort == "created_at" {
+			sortValue = sortTime.Format(time.RFC3339Nano)
+		}
+		order.Items = []OrderItem{}
 		orders = append(orders, order)
+		sortValues = append(sortValues, sortValue)
 	}
-
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return OrderPage{}, err
+	}
+
+	if len(orders) > f.Limit {
+		orders = orders[:f.Limit]
+		last := len(orders) - 1
+		page.NextCursor = encodeOrderCursor(orderCursor{Sort: f.Sort, Desc: f.Desc, Value: sortValues[last], ID: orders[last].ID})
+	}
+
+	if err := p.fillOrderItems(orders); err != nil {
+		return OrderPage{}, err
 	}
+	page.Orders = orders
 
-	return orders, nil
+	return page, nil
 }
-func (p *Provider) UpdateOrderStatus(orderID int, status string) error {
-	_, err := p.conn.Exec("UPDATE orders SET status = $1 WHERE id = $2", status, orderID)
-	return err
+
+// Загрузка позиций для набора заказов одним запросом
+func (p *Provider) fillOrderItems(orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(orders))
+	index := make(map[int]int, len(orders))
+	for i, order := range orders {
+		ids[i] = int64(order.ID)
+		index[order.ID] = i
+	}
+
+	rows, err := p.conn.Query(
+		"SELECT id, order_id, menu_item_id, quantity, price, comment, stamp_program_id FROM order_items WHERE order_id = ANY($1) ORDER BY id ASC",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		var item OrderItem
+		if err := rows.Scan(&item.ID, &orderID, &item.MenuItemId, &item.Quantity, &item.Price, &item.Comment, &item.StampProgramID); err != nil {
+			return err
+		}
+		if i, ok := index[orderID]; ok {
+			orders[i].Items = append(orders[i].Items, item)
+		}
+	}
+
+	return rows.Err()
 }
 
-func (p *Provider) FetchRevenue(period string) ([]RevenueData, error) {
-	var query string
+// Обновление статуса; возвращает точку заказа для оповещения подписчиков
+// Смена статуса заказа. При отмене покупателю возвращаются списанные баллы
+// и оплата подарочными картами, а начисленные за заказ баллы снимаются —
+// с учётом уже проведённых возвратов.
+func (p *Provider) UpdateOrderStatus(orderID int, status, user string) (int, error) {
+	var locationID int
+	err := p.inTx(func(tx *sql.Tx) error {
+		var current string
+		var pointsRedeemed, pointsEarned int
+		var giftCardAmount float64
+		var customerID sql.NullInt64
+		err := tx.QueryRow(
+			"SELECT status, location_id, customer_id, points_redeemed, points_earned, gift_card_amount FROM orders WHERE id = $1 FOR UPDATE",
+			orderID,
+		).Scan(&current, &locationID, &customerID, &pointsRedeemed, &pointsEarned, &giftCardAmount)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if current == status {
+			return nil
+		}
+		// Баллы отменённого заказа уже возвращены, вернуть его в оборот нельзя
+		if current == "Отменен" {
+			return ErrOrderNotEditable
+		}
 
-	switch period {
-	case "day":
-		query = `
-            SELECT to_char(created_at, 'HH24:00') AS time_unit, SUM(total) AS total
-            FROM orders
-            WHERE created_at >= NOW() - INTERVAL '1 day'
-            GROUP BY time_unit
-            ORDER BY time_unit ASC
-        `
-	case "week":
-		query = `
-            SELECT to_char(created_at, 'YYYY-MM-DD') AS time_unit, SUM(total) AS total
-            FROM orders
-            WHERE created_at >= NOW() - INTERVAL '1 week'
-            GROUP BY time_unit
-            ORDER BY time_unit ASC
-        `
-	case "month":
-		query = `
-            SELECT to_char(created_at, 'YYYY-MM-DD') AS time_unit, SUM(total) AS total
-            FROM orders
-            WHERE created_at >= NOW() - INTERVAL '1 month'
-            GROUP BY time_unit
-            ORDER BY time_unit ASC
-        `
-	case "year":
-		query = `
-            SELECT to_char(created_at, 'YYYY-MM') AS time_unit, SUM(total) AS total
-            FROM orders
-            WHERE created_at >= NOW() - INTERVAL '1 year'
-            GROUP BY time_unit
-            ORDER BY time_unit ASC
-        `
-	default:
-		return nil, errors.New("invalid period")
+		if _, err := tx.Exec("UPDATE orders SET status = $1 WHERE id = $2", status, orderID); err != nil {
+			return err
+		}
+		if status == "Отменен" && customerID.Valid {
+			if err := settleOrderPoints(tx, orderID, int(customerID.Int64), pointsRedeemed, pointsEarned, 1); err != nil {
+				return err
+			}
+		}
+		// Оплата картами, ещё не возвращённая по возвратам, зачисляется обратно на карты
+		if status == "Отменен" && giftCardAmount > 0 {
+			var refunded float64
+			err := tx.QueryRow("SELECT COALESCE(SUM(gift_card_amount), 0) FROM refunds WHERE order_id = $1", orderID).Scan(&refunded)
+			if err != nil {
+				return err
+			}
+			if left := roundMoney(giftCardAmount - refunded); left > 0 {
+				if err := returnGiftCardPayment(tx, orderID, left, user); err != nil {
+					return err
+				}
+			}
+		}
+		return syncOrderStamps(tx, orderID, status)
+	})
+	return locationID, err
+}
+
+// Возврат баллов по заказу в доле share от 0 до 1: списанные при оплате
+// баллы возвращаются, начисленные за заказ снимаются, но не больше баланса.
+// Уже проведённые по заказу возвраты баллов учитываются.
+func settleOrderPoints(tx *sql.Tx, orderID, customerID, redeemed, earned int, share float64) error {
+	target := int(math.Round(float64(redeemed)*share)) - int(math.Round(float64(earned)*share))
+	var applied int
+	err := tx.QueryRow(
+		"SELECT COALESCE(SUM(points), 0) FROM loyalty_transactions WHERE order_id = $1 AND kind = $2",
+		orderID, LoyaltyRefund,
+	).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	balance, err := lockCustomer(tx, customerID)
+	if err != nil {
+		return err
+	}
+	delta := target - applied
+	if delta < -balance {
+		delta = -balance
 	}
+	if delta == 0 {
+		return nil
+	}
+	return changePoints(tx, customerID, &orderID, LoyaltyRefund, delta, 0)
+}
 
-	rows, err := p.conn.Query(query)
+// Выручка считается по датам заказов за вычетом возвратов на дату возврата.
+// Отменённые заказы и возвраты по ним не учитываются, как и в отчёте смены.
+func (p *Provider) FetchRevenue(r AnalyticsRange, orderType string) ([]RevenueData, error) {
+	query := fmt.Sprintf(`
+            SELECT to_char((created_at AT TIME ZONE $4) - $2::integer * INTERVAL '1 second', '%s') AS time_unit, SUM(total) AS total
+            FROM (
+                SELECT created_at, total, order_type, location_id FROM orders WHERE status <> 'Отменен'
+                UNION ALL
+                SELECT r.created_at, -r.amount, o.order_type, o.location_id FROM refunds r JOIN orders o ON o.id = r.order_id
+                WHERE o.status <> 'Отменен'
+            ) AS movements
+            WHERE created_at >= $1::timestamptz AND ($3 = '' OR order_type = $3) AND ($5 = 0 OR location_id = $5)
+            GROUP BY time_unit
+            ORDER BY MIN(created_at) ASC
+        `, r.Format)
+
+	rows, err := p.conn.Query(query, r.Since, int(r.Shift.Seconds()), orderType, r.Location.String(), r.LocationID)
 	if err != nil {
 		return nil, err
 	}
@@ -291,47 +825,17 @@ func (p *Provider) FetchRevenue(period string) ([]RevenueData, error) {
 }
 
 // Добавляем метод для получения количества заказов
-func (p *Provider) FetchOrderCounts(period string) ([]OrderCountData, error) {
-	var query string
-
-	switch period {
-	case "day":
-		query = `
-            SELECT to_char(created_at, 'HH24:00') AS time_unit, COUNT(*) AS count
-            FROM orders
-            WHERE created_at >= NOW() - INTERVAL '1 day'
-            GROUP BY time_unit
-            ORDER BY time_unit ASC
-        `
-	case "week":
-		query = `
-            SELECT to_char(created_at, 'YYYY-MM-DD') AS time_unit, COUNT(*) AS count
-            FROM orders
-            WHERE created_at >= NOW() - INTERVAL '1 week'
-            GROUP BY time_unit
-            ORDER BY time_unit ASC
-        `
-	case "month":
-		query = `
-            SELECT to_char(created_at, 'YYYY-MM-DD') AS time_unit, COUNT(*) AS count
-            FROM orders
-            WHERE created_at >= NOW() - INTERVAL '1 month'
-            GROUP BY time_unit
-            ORDER BY time_unit ASC
-        `
-	case "year":
-		query = `
-            SELECT to_char(created_at, 'YYYY-MM') AS time_unit, COUNT(*) AS count
+func (p *Provider) FetchOrderCounts(r AnalyticsRange, orderType string) ([]OrderCountData, error) {
+	query := fmt.Sprintf(`
+            SELECT to_char((created_at AT TIME ZONE $4) - $2::integer * INTERVAL '1 second', '%s') AS time_unit, COUNT(*) AS count
             FROM orders
-            WHERE created_at >= NOW() - INTERVAL '1 year'
+            WHERE created_at >= $1::timestamptz AND ($3 = '' OR order_type = $3) AND ($5 = 0 OR location_id = $5)
+              AND status <> 'Отменен'
             GROUP BY time_unit
-            ORDER BY time_unit ASC
-        `
-	default:
-		return nil, errors.New("invalid period")
-	}
+            ORDER BY MIN(created_at) ASC
+        `, r.Format)
 
-	rows, err := p.conn.Query(query)
+	rows, err := p.conn.Query(query, r.Since, int(r.Shift.Seconds()), orderType, r.Location.String(), r.LocationID)
 	if err != nil {
 		return nil, err
 	}
@@ -349,3 +853,3342 @@ func (p *Provider) FetchOrderCounts(period string) ([]OrderCountData, error) {
 
 	return orderCountData, nil
 }
+
+func (p *Provider) FetchOrderTypeBreakdown(r AnalyticsRange) ([]OrderTypeData, error) {
+	rows, err := p.conn.Query(`
+            SELECT o.order_type, COUNT(*) AS count, SUM(o.total - COALESCE(r.amount, 0)) AS total
+            FROM orders o
+            LEFT JOIN (SELECT order_id, SUM(amount) AS amount FROM refunds GROUP BY order_id) r ON r.order_id = o.id
+            WHERE o.created_at >= $1::timestamptz AND ($2 = 0 OR o.location_id = $2) AND o.status <> 'Отменен'
+            GROUP BY o.order_type
+            ORDER BY o.order_type ASC
+        `, r.Since, r.LocationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := []OrderTypeData{}
+	for rows.Next() {
+		var otd OrderTypeData
+		if err := rows.Scan(&otd.OrderType, &otd.Count, &otd.Total); err != nil {
+			return nil, err
+		}
+		data = append(data, otd)
+	}
+
+	return data, rows.Err()
+}
+
+// Выполнение функции в транзакции: откат при ошибке, иначе фиксация
+func (p *Provider) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := p.conn.Begin()
+	if err != nil {
+		log.Printf("Failed to begin transaction: %v", err)
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Printf("Transaction rollback failed: %v", rbErr)
+		}
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Printf("Failed to commit transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (p *Provider) AddRefund(orderID int, reason, comment, user string, userID int, items []RefundItem) (Refund, error) {
+	refund := Refund{
+		OrderID:   orderID,
+		Reason:    reason,
+		Comment:   comment,
+		CreatedBy: user,
+	}
+
+	err := p.inTx(func(tx *sql.Tx) error {
+		// Блокируем заказ, чтобы параллельные возвраты не превысили количество
+		var status string
+		var locationID, pointsRedeemed, pointsEarned int
+		var total, pointsAmount, giftCardAmount float64
+		var customerID sql.NullInt64
+		err := tx.QueryRow(
+			"SELECT status, location_id, total, customer_id, points_redeemed, points_amount, points_earned, gift_card_amount FROM orders WHERE id = $1 FOR UPDATE",
+			orderID,
+		).Scan(&status, &locationID, &total, &customerID, &pointsRedeemed, &pointsAmount, &pointsEarned, &giftCardAmount)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// Отмена уже вернула оплату баллами и картами, деньги по заказу не учитываются
+		if status == "Отменен" {
+			return fmt.Errorf("%w: order is cancelled", ErrInvalidRefund)
+		}
+
+		// Деньги возвращаются из кассы сотрудника, если у него открыта смена
+		var shiftID sql.NullInt64
+		err = tx.QueryRow(
+			"SELECT id FROM shifts WHERE user_id = $1 AND location_id = $2 AND closed_at IS NULL",
+			userID, locationID,
+		).Scan(&shiftID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		// Остаток к возврату по каждой позиции заказа
+		rows, err := tx.Query(`
+            SELECT oi.id, oi.price,
+                   oi.quantity - COALESCE((SELECT SUM(ri.quantity) FROM refund_items ri WHERE ri.order_item_id = oi.id), 0)
+            FROM order_items oi
+            WHERE oi.order_id = $1
+            ORDER BY oi.id ASC
+        `, orderID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var lineIDs []int
+		prices := make(map[int]float64)
+		remaining := make(map[int]int)
+		for rows.Next() {
+			var id, left int
+			var price float64
+			if err := rows.Scan(&id, &price, &left); err != nil {
+				return err
+			}
+			lineIDs = append(lineIDs, id)
+			prices[id] = price
+			remaining[id] = left
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			for _, id := range lineIDs {
+				if remaining[id] > 0 {
+					items = append(items, RefundItem{OrderItemId: id, Quantity: remaining[id]})
+				}
+			}
+		}
+		if len(items) == 0 {
+			return fmt.Errorf("%w: nothing left to refund", ErrInvalidRefund)
+		}
+
+		for i, item := range items {
+			left, ok := remaining[item.OrderItemId]
+			if !ok {
+				return fmt.Errorf("%w: order item %d does not belong to order %d", ErrInvalidRefund, item.OrderItemId, orderID)
+			}
+			if item.Quantity <= 0 || item.Quantity > left {
+				return fmt.Errorf("%w: quantity %d exceeds %d left for order item %d", ErrInvalidRefund, item.Quantity, left, item.OrderItemId)
+			}
+			remaining[item.OrderItemId] -= item.Quantity
+			items[i].Amount = prices[item.OrderItemId] * float64(item.Quantity)
+			refund.Amount += items[i].Amount
+		}
+
+		// Заказ, частично оплаченный баллами или подарочными картами, возвращается
+		// теми же способами в той же пропорции; начисленные за него баллы списываются
+		var share float64
+		if total > 0 && (customerID.Valid || giftCardAmount > 0) {
+			var refundedBefore, pointsAmountBefore, giftCardBefore float64
+			err = tx.QueryRow(
+				"SELECT COALESCE(SUM(amount), 0), COALESCE(SUM(points_amount), 0), COALESCE(SUM(gift_card_amount), 0) FROM refunds WHERE order_id = $1",
+				orderID,
+			).Scan(&refundedBefore, &pointsAmountBefore, &giftCardBefore)
+			if err != nil {
+				return err
+			}
+			share = math.Min((refundedBefore+refund.Amount)/total, 1)
+			refund.PointsAmount = math.Max(roundMoney(pointsAmount*share)-pointsAmountBefore, 0)
+			refund.GiftCardAmount = math.Max(roundMoney(giftCardAmount*share)-giftCardBefore, 0)
+			if refund.GiftCardAmount > 0 {
+				if err := returnGiftCardPayment(tx, orderID, refund.GiftCardAmount, user); err != nil {
+					return err
+				}
+			}
+		}
+		if customerID.Valid && total > 0 {
+			if err := settleOrderPoints(tx, orderID, int(customerID.Int64), pointsRedeemed, pointsEarned, share); err != nil {
+				return err
+			}
+		}
+
+		var createdAt time.Time
+		err = tx.QueryRow(
+			"INSERT INTO refunds (order_id, amount, reason, comment, created_by, shift_id, points_amount, gift_card_amount) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at",
+			orderID, refund.Amount, reason, comment, user, shiftID, refund.PointsAmount, refund.GiftCardAmount,
+		).Scan(&refund.ID, &createdAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert refund: %v", err)
+		}
+		refund.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+
+		for _, item := range items {
+			_, err = tx.Exec(
+				"INSERT INTO refund_items (refund_id, order_item_id, quantity, amount) VALUES ($1, $2, $3, $4)",
+				refund.ID, item.OrderItemId, item.Quantity, item.Amount,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to insert refund item: %v", err)
+			}
+		}
+		refund.Items = items
+
+		// Полностью возвращённый заказ считается отменённым
+		fullyRefunded := true
+		for _, left := range remaining {
+			if left > 0 {
+				fullyRefunded = false
+				break
+			}
+		}
+		if fullyRefunded && status != "Отменен" {
+			if _, err = tx.Exec("UPDATE orders SET status = $1 WHERE id = $2", "Отменен", orderID); err != nil {
+				return fmt.Errorf("failed to cancel refunded order: %v", err)
+			}
+			status = "Отменен"
+			refund.OrderCancelled = true
+		}
+
+		// Возвращённые позиции не дают штампов
+		if err := syncOrderStamps(tx, orderID, status); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Refund{}, err
+	}
+
+	return refund, nil
+}
+
+func (p *Provider) FetchRefunds(orderID int) ([]Refund, error) {
+	rows, err := p.conn.Query(
+		"SELECT id, order_id, amount, points_amount, gift_card_amount, reason, comment, created_by, created_at FROM refunds WHERE order_id = $1 ORDER BY id ASC",
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	index := make(map[int]int)
+	for rows.Next() {
+		var refund Refund
+		var createdAt time.Time
+		err := rows.Scan(&refund.ID, &refund.OrderID, &refund.Amount, &refund.PointsAmount, &refund.GiftCardAmount, &refund.Reason, &refund.Comment, &refund.CreatedBy, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		refund.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		refund.Items = []RefundItem{}
+		index[refund.ID] = len(refunds)
+		refunds = append(refunds, refund)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	itemRows, err := p.conn.Query(`
+        SELECT ri.refund_id, ri.order_item_id, ri.quantity, ri.amount
+        FROM refund_items ri
+        JOIN refunds r ON r.id = ri.refund_id
+        WHERE r.order_id = $1
+        ORDER BY ri.id ASC
+    `, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+
+	for itemRows.Next() {
+		var refundID int
+		var item RefundItem
+		if err := itemRows.Scan(&refundID, &item.OrderItemId, &item.Quantity, &item.Amount); err != nil {
+			return nil, err
+		}
+		if i, ok := index[refundID]; ok {
+			refunds[i].Items = append(refunds[i].Items, item)
+		}
+	}
+
+	return refunds, itemRows.Err()
+}
+
+func (p *Provider) FetchStations() ([]Station, error) {
+	rows, err := p.conn.Query("SELECT id, name FROM stations ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stations := []Station{}
+	for rows.Next() {
+		var station Station
+		if err := rows.Scan(&station.ID, &station.Name); err != nil {
+			return nil, err
+		}
+		stations = append(stations, station)
+	}
+
+	return stations, rows.Err()
+}
+
+func (p *Provider) AddStation(name string) (Station, error) {
+	var station Station
+	err := p.conn.QueryRow("INSERT INTO stations (name) VALUES ($1) RETURNING id, name", name).Scan(&station.ID, &station.Name)
+	return station, err
+}
+
+func (p *Provider) DeleteStation(id int) error {
+	_, err := p.conn.Exec("DELETE FROM stations WHERE id = $1", id)
+	return err
+}
+
+func (p *Provider) SetMenuItemStation(menuItemID int, stationID *int) error {
+	res, err := p.conn.Exec("UPDATE menu SET station_id = $1 WHERE id = $2", stationID, menuItemID)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrStationNotFound
+		}
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Неготовые позиции заказов в работе, направленные на станцию, старые сначала.
+// Возвращённое количество готовить не нужно.
+func (p *Provider) FetchStationLines(stationID, locationID int) ([]KDSLine, error) {
+	rows, err := p.conn.Query(`
+        SELECT oi.id, oi.order_id, oi.menu_item_id, m.name, oi.quantity - r.quantity, oi.comment, o.note, o.created_at,
+               EXTRACT(EPOCH FROM NOW() - o.created_at)::integer
+        FROM order_items oi
+        JOIN orders o ON o.id = oi.order_id
+        JOIN menu m ON m.id = oi.menu_item_id
+        CROSS JOIN LATERAL (
+            SELECT COALESCE(SUM(quantity), 0) AS quantity FROM refund_items WHERE order_item_id = oi.id
+        ) r
+        WHERE m.station_id = $1 AND oi.ready_at IS NULL AND o.status = $2 AND ($3 = 0 OR o.location_id = $3)
+          AND oi.quantity > r.quantity
+        ORDER BY o.created_at ASC, oi.id ASC
+    `, stationID, "В работе", locationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []KDSLine{}
+	for rows.Next() {
+		var line KDSLine
+		var createdAt time.Time
+		err := rows.Scan(&line.OrderItemID, &line.OrderID, &line.MenuItemID, &line.Name, &line.Quantity, &line.Comment, &line.OrderNote, &createdAt, &line.ElapsedSeconds)
+		if err != nil {
+			return nil, err
+		}
+		line.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+func (p *Provider) BumpOrderItem(orderItemID int) (Order, bool, error) {
+	var order Order
+	var ready bool
+
+	err := p.inTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(
+			"SELECT oi.order_id, o.location_id FROM order_items oi JOIN orders o ON o.id = oi.order_id WHERE oi.id = $1",
+			orderItemID,
+		).Scan(&order.ID, &order.LocationID)
+		orderID := order.ID
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderItemNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		// Блокировка заказа, чтобы два последних бампа не разминулись
+		status, err := lockEditableOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE order_items SET ready_at = NOW() WHERE id = $1 AND ready_at IS NULL", orderItemID)
+		if err != nil {
+			return err
+		}
+
+		var pending int
+		err = tx.QueryRow(`
+            SELECT COUNT(*)
+            FROM order_items oi
+            JOIN menu m ON m.id = oi.menu_item_id
+            WHERE oi.order_id = $1 AND m.station_id IS NOT NULL AND oi.ready_at IS NULL
+              AND oi.quantity > (SELECT COALESCE(SUM(ri.quantity), 0) FROM refund_items ri WHERE ri.order_item_id = oi.id)
+        `, orderID).Scan(&pending)
+		if err != nil {
+			return err
+		}
+		if pending > 0 || status != "В работе" {
+			return nil
+		}
+
+		if _, err := tx.Exec("UPDATE orders SET status = $1 WHERE id = $2", "Готов", orderID); err != nil {
+			return err
+		}
+		ready = true
+		order.Status = "Готов"
+		return nil
+	})
+	if err != nil {
+		return Order{}, false, err
+	}
+
+	return order, ready, nil
+}
+
+func (p *Provider) FetchOrder(orderID int) (Order, error) {
+	var order Order
+	err := scanOrder(p.conn.QueryRow("SELECT "+orderColumns+" FROM orders o WHERE o.id = $1", orderID), &order)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, err
+	}
+	order.Items = []OrderItem{}
+
+	orders := []Order{order}
+	if err := p.fillOrderItems(orders); err != nil {
+		return Order{}, err
+	}
+	return orders[0], nil
+}
+
+// Блокирует заказ до конца транзакции и проверяет, что его ещё можно менять
+func lockEditableOrder(tx *sql.Tx, orderID int) (string, error) {
+	var status string
+	err := tx.QueryRow("SELECT status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrOrderNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if status == "Выполнен" || status == "Отменен" {
+		return "", ErrOrderNotEditable
+	}
+	return status, nil
+}
+
+// Состав заказа с пробитым приходом меняется только возвратами
+func checkNotFiscalized(tx *sql.Tx, orderID int) error {
+	sold, err := hasFiscalSale(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if sold {
+		return ErrOrderFiscalized
+	}
+	return nil
+}
+
+// Пересчёт суммы заказа по его позициям. Часть, уже оплаченная баллами
+// и подарочными картами, не может стать больше суммы заказа; баллы за
+// оплаченную деньгами часть начисляются заново.
+func recalcOrderTotal(tx *sql.Tx, orderID int, loyalty LoyaltyConfig) error {
+	var total, pointsAmount, giftCardAmount float64
+	var pointsEarned int
+	var customerID sql.NullInt64
+	err := tx.QueryRow(`
+        UPDATE orders SET total = COALESCE((SELECT SUM(price * quantity) FROM order_items WHERE order_id = $1), 0)
+        WHERE id = $1
+        RETURNING total, points_amount, gift_card_amount, points_earned, customer_id
+    `, orderID).Scan(&total, &pointsAmount, &giftCardAmount, &pointsEarned, &customerID)
+	if err != nil {
+		return err
+	}
+	if prepaid := roundMoney(pointsAmount + giftCardAmount); total < prepaid {
+		return fmt.Errorf("%w: %.2f is already paid with points and gift cards", ErrInvalidOrderEdit, prepaid)
+	}
+	if !customerID.Valid {
+		return nil
+	}
+
+	earned := int(math.Floor((total - pointsAmount) * loyalty.EarnRate))
+	delta := earned - pointsEarned
+	if delta == 0 {
+		return nil
+	}
+	balance, err := lockCustomer(tx, int(customerID.Int64))
+	if err != nil {
+		return err
+	}
+	// Потраченные баллы не снимаются: баланс не уходит в минус
+	if delta < -balance {
+		delta = -balance
+	}
+	expiryDays := 0
+	if delta > 0 {
+		expiryDays = loyalty.ExpiryDays
+	}
+	if delta != 0 {
+		if err := changePoints(tx, int(customerID.Int64), &orderID, LoyaltyEarn, delta, expiryDays); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE orders SET points_earned = $1 WHERE id = $2", pointsEarned+delta, orderID)
+	return err
+}
+
+// Готовый заказ, в который добавили позиции, возвращается в работу
+func reopenReadyOrder(tx *sql.Tx, orderID int, status string) error {
+	if status != "Готов" {
+		return nil
+	}
+	_, err := tx.Exec("UPDATE orders SET status = $1 WHERE id = $2", "В работе", orderID)
+	return err
+}
+
+func addOrderAudit(tx *sql.Tx, entry OrderAuditEntry) error {
+	_, err := tx.Exec(`
+        INSERT INTO order_audit (order_id, action, order_item_id, menu_item_id, old_quantity, new_quantity, created_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, entry.OrderID, entry.Action, entry.OrderItemID, entry.MenuItemID, entry.OldQuantity, entry.NewQuantity, entry.CreatedBy)
+	return err
+}
+
+// Количество позиции, уже оформленное в возвратах
+func refundedQuantity(tx *sql.Tx, orderItemID int) (int, error) {
+	var refunded int
+	err := tx.QueryRow("SELECT COALESCE(SUM(quantity), 0) FROM refund_items WHERE order_item_id = $1", orderItemID).Scan(&refunded)
+	return refunded, err
+}
+
+func (p *Provider) AddOrderLine(orderID int, item OrderItem, user string, loyalty LoyaltyConfig) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		status, err := lockEditableOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if err := checkNotFiscalized(tx, orderID); err != nil {
+			return err
+		}
+
+		var locationID int
+		if err := tx.QueryRow("SELECT location_id FROM orders WHERE id = $1", orderID).Scan(&locationID); err != nil {
+			return err
+		}
+
+		var price float64
+		err = tx.QueryRow(menuPriceQuery, item.MenuItemId, locationID).Scan(&price)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: menu item %d not available", ErrInvalidOrderEdit, item.MenuItemId)
+		}
+		if err != nil {
+			return err
+		}
+
+		var orderItemID int
+		err = tx.QueryRow(
+			"INSERT INTO order_items (order_id, menu_item_id, quantity, price, comment) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			orderID, item.MenuItemId, item.Quantity, price, item.Comment,
+		).Scan(&orderItemID)
+		if err != nil {
+			return fmt.Errorf("failed to insert order item: %v", err)
+		}
+
+		if err := recalcOrderTotal(tx, orderID, loyalty); err != nil {
+			return err
+		}
+		if err := reopenReadyOrder(tx, orderID, status); err != nil {
+			return err
+		}
+
+		return addOrderAudit(tx, OrderAuditEntry{
+			OrderID:     orderID,
+			Action:      OrderAuditItemAdded,
+			OrderItemID: orderItemID,
+			MenuItemID:  item.MenuItemId,
+			NewQuantity: item.Quantity,
+			CreatedBy:   user,
+		})
+	})
+}
+
+func (p *Provider) ChangeOrderLine(orderID, orderItemID, quantity int, user string, loyalty LoyaltyConfig) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		status, err := lockEditableOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if err := checkNotFiscalized(tx, orderID); err != nil {
+			return err
+		}
+
+		var menuItemID, oldQuantity int
+		var reward bool
+		err = tx.QueryRow(
+			"SELECT menu_item_id, quantity, stamp_program_id IS NOT NULL FROM order_items WHERE id = $1 AND order_id = $2",
+			orderItemID, orderID,
+		).Scan(&menuItemID, &oldQuantity, &reward)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderItemNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if reward {
+			return fmt.Errorf("%w: order item %d is a stamp card reward", ErrInvalidOrderEdit, orderItemID)
+		}
+		if quantity == oldQuantity {
+			return nil
+		}
+
+		refunded, err := refundedQuantity(tx, orderItemID)
+		if err != nil {
+			return err
+		}
+		// Возвращённые единицы уже не в заказе: уменьшать можно только невозвращённые
+		if quantity <= refunded {
+			return fmt.Errorf("%w: %d already refunded, quantity must be at least %d", ErrInvalidOrderEdit, refunded, refunded+1)
+		}
+
+		// Добавленное количество нужно приготовить заново
+		if quantity > oldQuantity {
+			_, err = tx.Exec("UPDATE order_items SET quantity = $1, ready_at = NULL WHERE id = $2", quantity, orderItemID)
+		} else {
+			_, err = tx.Exec("UPDATE order_items SET quantity = $1 WHERE id = $2", quantity, orderItemID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := recalcOrderTotal(tx, orderID, loyalty); err != nil {
+			return err
+		}
+		if quantity > oldQuantity {
+			if err := reopenReadyOrder(tx, orderID, status); err != nil {
+				return err
+			}
+		}
+
+		return addOrderAudit(tx, OrderAuditEntry{
+			OrderID:     orderID,
+			Action:      OrderAuditItemChanged,
+			OrderItemID: orderItemID,
+			MenuItemID:  menuItemID,
+			OldQuantity: oldQuantity,
+			NewQuantity: quantity,
+			CreatedBy:   user,
+		})
+	})
+}
+
+func (p *Provider) RemoveOrderLine(orderID, orderItemID int, user string, loyalty LoyaltyConfig) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if _, err := lockEditableOrder(tx, orderID); err != nil {
+			return err
+		}
+		if err := checkNotFiscalized(tx, orderID); err != nil {
+			return err
+		}
+
+		var menuItemID, oldQuantity int
+		var reward bool
+		err := tx.QueryRow(
+			"SELECT menu_item_id, quantity, stamp_program_id IS NOT NULL FROM order_items WHERE id = $1 AND order_id = $2",
+			orderItemID, orderID,
+		).Scan(&menuItemID, &oldQuantity, &reward)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderItemNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if reward {
+			return fmt.Errorf("%w: order item %d is a stamp card reward", ErrInvalidOrderEdit, orderItemID)
+		}
+
+		refunded, err := refundedQuantity(tx, orderItemID)
+		if err != nil {
+			return err
+		}
+		if refunded > 0 {
+			return fmt.Errorf("%w: order item %d has refunds", ErrInvalidOrderEdit, orderItemID)
+		}
+
+		var remaining int
+		err = tx.QueryRow("SELECT COUNT(*) FROM order_items WHERE order_id = $1", orderID).Scan(&remaining)
+		if err != nil {
+			return err
+		}
+		if remaining <= 1 {
+			return fmt.Errorf("%w: order must contain at least one item", ErrInvalidOrderEdit)
+		}
+
+		if _, err = tx.Exec("DELETE FROM order_items WHERE id = $1", orderItemID); err != nil {
+			return err
+		}
+		if err := recalcOrderTotal(tx, orderID, loyalty); err != nil {
+			return err
+		}
+
+		return addOrderAudit(tx, OrderAuditEntry{
+			OrderID:     orderID,
+			Action:      OrderAuditItemRemoved,
+			OrderItemID: orderItemID,
+			MenuItemID:  menuItemID,
+			OldQuantity: oldQuantity,
+			CreatedBy:   user,
+		})
+	})
+}
+
+func (p *Provider) FetchOrderAudit(orderID int) ([]OrderAuditEntry, error) {
+	rows, err := p.conn.Query(`
+        SELECT id, order_id, action, order_item_id, menu_item_id, old_quantity, new_quantity, created_by, created_at
+        FROM order_audit
+        WHERE order_id = $1
+        ORDER BY id ASC
+    `, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []OrderAuditEntry{}
+	for rows.Next() {
+		var entry OrderAuditEntry
+		var createdAt time.Time
+		err := rows.Scan(&entry.ID, &entry.OrderID, &entry.Action, &entry.OrderItemID, &entry.MenuItemID,
+			&entry.OldQuantity, &entry.NewQuantity, &entry.CreatedBy, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// Перевод запланированных предзаказов в работу за releaseMinutes до выдачи
+func (p *Provider) ReleasePreorders(releaseMinutes int) ([]Order, error) {
+	rows, err := p.conn.Query(`
+        UPDATE orders SET status = $1
+        WHERE status = $2 AND pickup_at <= NOW() + $3::integer * INTERVAL '1 minute'
+        RETURNING id, location_id, status
+    `, "В работе", "Запланирован", releaseMinutes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		var order Order
+		if err := rows.Scan(&order.ID, &order.LocationID, &order.Status); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, rows.Err()
+}
+
+func (p *Provider) FetchOrderLocation(orderID int) (int, error) {
+	var locationID int
+	err := p.conn.QueryRow("SELECT location_id FROM orders WHERE id = $1", orderID).Scan(&locationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrOrderNotFound
+	}
+	return locationID, err
+}
+
+func (p *Provider) FetchOrderItemLocation(orderItemID int) (int, error) {
+	var locationID int
+	err := p.conn.QueryRow(
+		"SELECT o.location_id FROM order_items oi JOIN orders o ON o.id = oi.order_id WHERE oi.id = $1",
+		orderItemID,
+	).Scan(&locationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrOrderItemNotFound
+	}
+	return locationID, err
+}
+
+// Список точек; ids = nil возвращает все точки
+func (p *Provider) FetchLocations(ids []int) ([]Location, error) {
+	query := "SELECT id, name, address, timezone FROM locations ORDER BY id ASC"
+	var args []interface{}
+	if ids != nil {
+		filter := make([]int64, len(ids))
+		for i, id := range ids {
+			filter[i] = int64(id)
+		}
+		query = "SELECT id, name, address, timezone FROM locations WHERE id = ANY($1) ORDER BY id ASC"
+		args = append(args, pq.Array(filter))
+	}
+
+	rows, err := p.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := []Location{}
+	for rows.Next() {
+		var loc Location
+		if err := rows.Scan(&loc.ID, &loc.Name, &loc.Address, &loc.Timezone); err != nil {
+			return nil, err
+		}
+		locations = append(locations, loc)
+	}
+
+	return locations, rows.Err()
+}
+
+func (p *Provider) FetchLocation(id int) (Location, error) {
+	var loc Location
+	err := p.conn.QueryRow("SELECT id, name, address, timezone FROM locations WHERE id = $1", id).
+		Scan(&loc.ID, &loc.Name, &loc.Address, &loc.Timezone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Location{}, ErrLocationNotFound
+	}
+	return loc, err
+}
+
+func (p *Provider) AddLocation(loc Location) (Location, error) {
+	err := p.conn.QueryRow(
+		"INSERT INTO locations (name, address, timezone) VALUES ($1, $2, $3) RETURNING id",
+		loc.Name, loc.Address, loc.Timezone,
+	).Scan(&loc.ID)
+	return loc, err
+}
+
+// Переопределение цены и доступности позиции меню в точке
+func (p *Provider) SetMenuLocationPrice(locationID, menuItemID int, price *float64, available bool) error {
+	_, err := p.conn.Exec(`
+        INSERT INTO menu_location_prices (location_id, menu_item_id, price, available) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (location_id, menu_item_id) DO UPDATE SET price = EXCLUDED.price, available = EXCLUDED.available
+    `, locationID, menuItemID, price, available)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrLocationNotFound
+	}
+	return err
+}
+
+func (p *Provider) DeleteMenuLocationPrice(locationID, menuItemID int) error {
+	_, err := p.conn.Exec("DELETE FROM menu_location_prices WHERE location_id = $1 AND menu_item_id = $2", locationID, menuItemID)
+	return err
+}
+
+func (p *Provider) GrantLocation(userID, locationID int) error {
+	_, err := p.conn.Exec(
+		"INSERT INTO user_locations (user_id, location_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userID, locationID,
+	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrLocationNotFound
+	}
+	return err
+}
+
+func (p *Provider) RevokeLocation(userID, locationID int) error {
+	_, err := p.conn.Exec("DELETE FROM user_locations WHERE user_id = $1 AND location_id = $2", userID, locationID)
+	return err
+}
+
+// Колонки смены в порядке, ожидаемом scanShift
+const shiftColumns = "id, user_id, location_id, opening_float, counted_cash, expected_cash, opened_at, closed_at"
+
+func scanShift(row rowScanner, shift *Shift) error {
+	var openedAt time.Time
+	var closedAt sql.NullTime
+	err := row.Scan(&shift.ID, &shift.UserID, &shift.LocationID, &shift.OpeningFloat,
+		&shift.CountedCash, &shift.ExpectedCash, &openedAt, &closedAt)
+	if err != nil {
+		return err
+	}
+	shift.OpenedAt = openedAt.Format("2006-01-02 15:04:05")
+	if closedAt.Valid {
+		closed := closedAt.Time.Format("2006-01-02 15:04:05")
+		shift.ClosedAt = &closed
+	}
+	return nil
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (p *Provider) OpenShift(userID, locationID int, openingFloat float64) (Shift, error) {
+	var shift Shift
+	err := scanShift(p.conn.QueryRow(
+		"INSERT INTO shifts (user_id, location_id, opening_float) VALUES ($1, $2, $3) RETURNING "+shiftColumns,
+		userID, locationID, openingFloat,
+	), &shift)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return Shift{}, ErrShiftAlreadyOpen
+	}
+	return shift, err
+}
+
+func (p *Provider) FetchOpenShift(userID int) (Shift, error) {
+	var shift Shift
+	err := scanShift(p.conn.QueryRow(
+		"SELECT "+shiftColumns+" FROM shifts WHERE user_id = $1 AND closed_at IS NULL", userID,
+	), &shift)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Shift{}, ErrNoOpenShift
+	}
+	return shift, err
+}
+
+func (p *Provider) FetchShift(shiftID int) (Shift, error) {
+	var shift Shift
+	err := scanShift(p.conn.QueryRow("SELECT "+shiftColumns+" FROM shifts WHERE id = $1", shiftID), &shift)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Shift{}, ErrShiftNotFound
+	}
+	return shift, err
+}
+
+// Последние 100 смен; нулевые userID и locationID не ограничивают выборку
+func (p *Provider) FetchShifts(userID, locationID int) ([]Shift, error) {
+	rows, err := p.conn.Query(
+		"SELECT "+shiftColumns+" FROM shifts WHERE ($1 = 0 OR user_id = $1) AND ($2 = 0 OR location_id = $2) ORDER BY id DESC LIMIT 100",
+		userID, locationID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shifts := []Shift{}
+	for rows.Next() {
+		var shift Shift
+		if err := scanShift(rows, &shift); err != nil {
+			return nil, err
+		}
+		shifts = append(shifts, shift)
+	}
+	return shifts, rows.Err()
+}
+
+// Блокировка открытой смены сотрудника до конца транзакции
+func lockOpenShift(tx *sql.Tx, userID int) (Shift, error) {
+	var shift Shift
+	err := scanShift(tx.QueryRow(
+		"SELECT "+shiftColumns+" FROM shifts WHERE user_id = $1 AND closed_at IS NULL FOR UPDATE", userID,
+	), &shift)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Shift{}, ErrNoOpenShift
+	}
+	return shift, err
+}
+
+// Итоги смены report.Shift: продажи и возвраты по способам оплаты и движения наличных
+func shiftTotals(q queryer, report *ShiftReport) error {
+	shiftID := report.Shift.ID
+	report.Sales = make(map[string]float64)
+	report.Refunds = make(map[string]float64)
+	report.GiftCardSales = make(map[string]float64)
+
+	// Оплата баллами и подарочными картами выделяется из суммы заказа
+	// в отдельные способы оплаты. Отменённые заказы в продажи не входят,
+	// а их возвраты не вычитаются: деньги по ним не остаются в кассе.
+	rows, err := q.Query(
+		"SELECT payment_method, COUNT(*), SUM(total - points_amount - gift_card_amount), SUM(points_amount), SUM(gift_card_amount) FROM orders WHERE shift_id = $1 AND status <> $2 GROUP BY payment_method",
+		shiftID, "Отменен",
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var method string
+		var count int
+		var total, points, giftCards float64
+		if err := rows.Scan(&method, &count, &total, &points, &giftCards); err != nil {
+			return err
+		}
+		report.OrdersCount += count
+		report.Sales[method] += total
+		if points > 0 {
+			report.Sales[PaymentPoints] += points
+		}
+		if giftCards > 0 {
+			report.Sales[PaymentGiftCard] += giftCards
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	refundRows, err := q.Query(`
+        SELECT o.payment_method, SUM(r.amount - r.points_amount - r.gift_card_amount), SUM(r.points_amount), SUM(r.gift_card_amount)
+        FROM refunds r
+        JOIN orders o ON o.id = r.order_id
+        WHERE r.shift_id = $1 AND o.status <> $2
+        GROUP BY o.payment_method
+    `, shiftID, "Отменен")
+	if err != nil {
+		return err
+	}
+	defer refundRows.Close()
+	for refundRows.Next() {
+		var method string
+		var amount, points, giftCards float64
+		if err := refundRows.Scan(&method, &amount, &points, &giftCards); err != nil {
+			return err
+		}
+		report.Refunds[method] += amount
+		if points > 0 {
+			report.Refunds[PaymentPoints] += points
+		}
+		if giftCards > 0 {
+			report.Refunds[PaymentGiftCard] += giftCards
+		}
+	}
+	if err := refundRows.Err(); err != nil {
+		return err
+	}
+
+	cardRows, err := q.Query(
+		"SELECT payment_method, SUM(amount) FROM gift_card_transactions WHERE shift_id = $1 AND kind IN ($2, $3) GROUP BY payment_method",
+		shiftID, GiftCardActivate, GiftCardTopUp,
+	)
+	if err != nil {
+		return err
+	}
+	defer cardRows.Close()
+	for cardRows.Next() {
+		var method string
+		var amount float64
+		if err := cardRows.Scan(&method, &amount); err != nil {
+			return err
+		}
+		report.GiftCardSales[method] += amount
+	}
+	if err := cardRows.Err(); err != nil {
+		return err
+	}
+
+	opRows, err := q.Query(
+		"SELECT id, shift_id, kind, amount, comment, created_by, created_at FROM cash_operations WHERE shift_id = $1 ORDER BY id ASC",
+		shiftID,
+	)
+	if err != nil {
+		return err
+	}
+	defer opRows.Close()
+	report.Operations = []CashOperation{}
+	for opRows.Next() {
+		var op CashOperation
+		var createdAt time.Time
+		if err := opRows.Scan(&op.ID, &op.ShiftID, &op.Kind, &op.Amount, &op.Comment, &op.CreatedBy, &createdAt); err != nil {
+			return err
+		}
+		op.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		switch op.Kind {
+		case CashIn:
+			report.CashIn += op.Amount
+		case CashOut:
+			report.CashOut += op.Amount
+		}
+		report.Operations = append(report.Operations, op)
+	}
+	if err := opRows.Err(); err != nil {
+		return err
+	}
+
+	report.calcExpectedCash()
+	return nil
+}
+
+func (p *Provider) AddCashOperation(userID int, op CashOperation) (CashOperation, error) {
+	err := p.inTx(func(tx *sql.Tx) error {
+		shift, err := lockOpenShift(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		// Изъять можно не больше, чем должно быть в кассе
+		if op.Kind == CashOut {
+			report := ShiftReport{Shift: shift}
+			if err := shiftTotals(tx, &report); err != nil {
+				return err
+			}
+			if op.Amount > report.ExpectedCash {
+				return fmt.Errorf("%w: only %.2f in the drawer", ErrInvalidCashOperation, report.ExpectedCash)
+			}
+		}
+
+		var createdAt time.Time
+		err = tx.QueryRow(
+			"INSERT INTO cash_operations (shift_id, kind, amount, comment, created_by) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+			shift.ID, op.Kind, op.Amount, op.Comment, op.CreatedBy,
+		).Scan(&op.ID, &createdAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert cash operation: %v", err)
+		}
+		op.ShiftID = shift.ID
+		op.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		return nil
+	})
+	if err != nil {
+		return CashOperation{}, err
+	}
+	return op, nil
+}
+
+// Закрытие открытой смены сотрудника. Ожидаемая сумма фиксируется
+// в той же транзакции, чтобы Z-отчёт не менялся после закрытия.
+func (p *Provider) CloseShift(userID int, countedCash float64) (int, error) {
+	var shiftID int
+	err := p.inTx(func(tx *sql.Tx) error {
+		shift, err := lockOpenShift(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		report := ShiftReport{Shift: shift}
+		if err := shiftTotals(tx, &report); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE shifts SET closed_at = NOW(), counted_cash = $1, expected_cash = $2 WHERE id = $3",
+			countedCash, report.ExpectedCash, shift.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to close shift: %v", err)
+		}
+		shiftID = shift.ID
+		return nil
+	})
+	return shiftID, err
+}
+
+// Отчёт по смене: X для открытой, Z с расхождением для закрытой
+func (p *Provider) FetchShiftReport(shiftID int) (ShiftReport, error) {
+	shift, err := p.FetchShift(shiftID)
+	if err != nil {
+		return ShiftReport{}, err
+	}
+
+	report := ShiftReport{Kind: ReportX, Shift: shift}
+	if err := shiftTotals(p.conn, &report); err != nil {
+		return ShiftReport{}, err
+	}
+
+	if shift.ClosedAt != nil {
+		report.Kind = ReportZ
+		if shift.ExpectedCash != nil {
+			report.ExpectedCash = *shift.ExpectedCash
+		}
+		report.CountedCash = shift.CountedCash
+		if shift.CountedCash != nil {
+			discrepancy := *shift.CountedCash - report.ExpectedCash
+			report.Discrepancy = &discrepancy
+		}
+	}
+	return report, nil
+}
+
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// Блокировка покупателя до конца транзакции. Просроченные баллы сгорают
+// здесь же, поэтому возвращается уже актуальный баланс.
+func lockCustomer(tx *sql.Tx, customerID int) (int, error) {
+	var points int
+	var expireAt sql.NullTime
+	err := tx.QueryRow(
+		"SELECT points, points_expire_at FROM customers WHERE id = $1 FOR UPDATE", customerID,
+	).Scan(&points, &expireAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrCustomerNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if points > 0 && expireAt.Valid && expireAt.Time.Before(time.Now()) {
+		if err := changePoints(tx, customerID, nil, LoyaltyExpire, -points, 0); err != nil {
+			return 0, err
+		}
+		points = 0
+	}
+	return points, nil
+}
+
+// Изменение баланса с записью в журнал баллов. Положительный expiryDays
+// продлевает срок действия баллов от текущего момента.
+func changePoints(tx *sql.Tx, customerID int, orderID *int, kind string, delta, expiryDays int) error {
+	_, err := tx.Exec(
+		"INSERT INTO loyalty_transactions (customer_id, order_id, kind, points) VALUES ($1, $2, $3, $4)",
+		customerID, orderID, kind, delta,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert loyalty transaction: %v", err)
+	}
+	_, err = tx.Exec(`
+        UPDATE customers
+        SET points = points + $1,
+            points_expire_at = CASE WHEN $2 > 0 THEN NOW() + $2::integer * INTERVAL '1 day' ELSE points_expire_at END
+        WHERE id = $3
+    `, delta, expiryDays, customerID)
+	if err != nil {
+		return fmt.Errorf("failed to update customer points: %v", err)
+	}
+	return nil
+}
+
+// Покупатель по телефону; новый номер заводит профиль
+func upsertCustomer(tx *sql.Tx, phone, name string) (int, error) {
+	var customerID int
+	err := tx.QueryRow(`
+        INSERT INTO customers (phone, name) VALUES ($1, $2)
+        ON CONFLICT (phone) DO UPDATE SET name = CASE WHEN customers.name = '' THEN EXCLUDED.name ELSE customers.name END
+        RETURNING id
+    `, phone, name).Scan(&customerID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to upsert customer: %v", err)
+	}
+	return customerID, nil
+}
+
+// Привязка покупателя к заказу, списание
+// баллов в счёт оплаты и начисление за оплаченную деньгами часть
+func applyOrderLoyalty(tx *sql.Tx, order *Order, customerID int, req OrderRequest) error {
+	balance, err := lockCustomer(tx, customerID)
+	if err != nil {
+		return err
+	}
+
+	cfg := req.Loyalty
+	var amount float64
+	if req.RedeemPoints > 0 {
+		if req.RedeemPoints > balance {
+			return fmt.Errorf("%w: only %d points available", ErrInvalidRedemption, balance)
+		}
+		amount = roundMoney(float64(req.RedeemPoints) * cfg.PointValue)
+		if limit := roundMoney(order.Total * cfg.MaxRedeemShare); amount > limit {
+			return fmt.Errorf("%w: at most %.2f of the order can be paid with points", ErrInvalidRedemption, limit)
+		}
+		if err := changePoints(tx, customerID, &order.ID, LoyaltyRedeem, -req.RedeemPoints, 0); err != nil {
+			return err
+		}
+	}
+
+	earned := int(math.Floor((order.Total - amount) * cfg.EarnRate))
+	if earned > 0 {
+		if err := changePoints(tx, customerID, &order.ID, LoyaltyEarn, earned, cfg.ExpiryDays); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		"UPDATE orders SET customer_id = $1, points_redeemed = $2, points_amount = $3, points_earned = $4 WHERE id = $5",
+		customerID, req.RedeemPoints, amount, earned, order.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to attach customer to order: %v", err)
+	}
+
+	order.CustomerID = &customerID
+	order.PointsRedeemed = req.RedeemPoints
+	order.PointsAmount = amount
+	order.PointsEarned = earned
+	return nil
+}
+
+// Профиль покупателя со статистикой визитов; сгоревшие баллы показываются как 0
+const customerQuery = `
+    SELECT c.id, c.phone, c.name,
+           CASE WHEN c.points_expire_at < NOW() THEN 0 ELSE c.points END,
+           c.points_expire_at, c.created_at,
+           COUNT(o.id) FILTER (WHERE o.status <> 'Отменен'),
+           COALESCE(SUM(o.total) FILTER (WHERE o.status <> 'Отменен'), 0) - COALESCE((
+               SELECT SUM(r.amount) FROM refunds r JOIN orders ro ON ro.id = r.order_id
+               WHERE ro.customer_id = c.id AND ro.status <> 'Отменен'
+           ), 0),
+           MAX(o.created_at)
+    FROM customers c
+    LEFT JOIN orders o ON o.customer_id = c.id
+`
+
+func scanCustomer(row rowScanner, customer *Customer) error {
+	var expireAt, lastVisit sql.NullTime
+	var createdAt time.Time
+	err := row.Scan(&customer.ID, &customer.Phone, &customer.Name, &customer.Points,
+		&expireAt, &createdAt, &customer.Visits, &customer.TotalSpent, &lastVisit)
+	if err != nil {
+		return err
+	}
+	customer.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	if expireAt.Valid {
+		customer.PointsExpireAt = &expireAt.Time
+	}
+	if lastVisit.Valid {
+		customer.LastVisit = &lastVisit.Time
+	}
+	return nil
+}
+
+// Не более 50 покупателей, подходящих по части телефона или имени
+func (p *Provider) FetchCustomers(query string) ([]Customer, error) {
+	rows, err := p.conn.Query(
+		customerQuery+" WHERE $1 = '' OR c.phone LIKE '%' || $1 || '%' OR c.name ILIKE '%' || $1 || '%' GROUP BY c.id ORDER BY c.id DESC LIMIT 50",
+		query,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	customers := []Customer{}
+	for rows.Next() {
+		var customer Customer
+		if err := scanCustomer(rows, &customer); err != nil {
+			return nil, err
+		}
+		customers = append(customers, customer)
+	}
+	return customers, rows.Err()
+}
+
+func (p *Provider) FetchCustomer(id int) (Customer, error) {
+	var customer Customer
+	err := scanCustomer(p.conn.QueryRow(customerQuery+" WHERE c.id = $1 GROUP BY c.id", id), &customer)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Customer{}, ErrCustomerNotFound
+	}
+	return customer, err
+}
+
+func (p *Provider) AddCustomer(phone, name string) (Customer, error) {
+	var id int
+	err := p.conn.QueryRow("INSERT INTO customers (phone, name) VALUES ($1, $2) RETURNING id", phone, name).Scan(&id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return Customer{}, ErrCustomerExists
+	}
+	if err != nil {
+		return Customer{}, err
+	}
+	return p.FetchCustomer(id)
+}
+
+func (p *Provider) UpdateCustomer(id int, name string) (Customer, error) {
+	res, err := p.conn.Exec("UPDATE customers SET name = $1 WHERE id = $2", name, id)
+	if err != nil {
+		return Customer{}, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return Customer{}, ErrCustomerNotFound
+	}
+	return p.FetchCustomer(id)
+}
+
+func (p *Provider) FetchLoyaltyTransactions(customerID int) ([]LoyaltyTransaction, error) {
+	if _, err := p.FetchCustomer(customerID); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.conn.Query(
+		"SELECT id, customer_id, order_id, kind, points, created_at FROM loyalty_transactions WHERE customer_id = $1 ORDER BY id DESC",
+		customerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []LoyaltyTransaction{}
+	for rows.Next() {
+		var t LoyaltyTransaction
+		var createdAt time.Time
+		if err := rows.Scan(&t.ID, &t.CustomerID, &t.OrderID, &t.Kind, &t.Points, &createdAt); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+// Колонки программы штампов в порядке, ожидаемом scanStampProgram
+const stampProgramColumns = "id, name, stamps_required, menu_item_ids, categories, active"
+
+func scanStampProgram(row rowScanner, program *StampProgram) error {
+	return row.Scan(&program.ID, &program.Name, &program.StampsRequired,
+		pq.Array(&program.MenuItemIDs), pq.Array(&program.Categories), &program.Active)
+}
+
+func (p *Provider) FetchStampPrograms() ([]StampProgram, error) {
+	rows, err := p.conn.Query("SELECT " + stampProgramColumns + " FROM stamp_programs ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	programs := []StampProgram{}
+	for rows.Next() {
+		var program StampProgram
+		if err := scanStampProgram(rows, &program); err != nil {
+			return nil, err
+		}
+		programs = append(programs, program)
+	}
+	return programs, rows.Err()
+}
+
+func (p *Provider) AddStampProgram(program StampProgram) (StampProgram, error) {
+	var created StampProgram
+	err := scanStampProgram(p.conn.QueryRow(
+		"INSERT INTO stamp_programs (name, stamps_required, menu_item_ids, categories, active) VALUES ($1, $2, $3, $4, $5) RETURNING "+stampProgramColumns,
+		program.Name, program.StampsRequired, pq.Array(program.MenuItemIDs), pq.Array(program.Categories), program.Active,
+	), &created)
+	return created, err
+}
+
+func (p *Provider) UpdateStampProgram(program StampProgram) (StampProgram, error) {
+	var updated StampProgram
+	err := scanStampProgram(p.conn.QueryRow(
+		"UPDATE stamp_programs SET name = $1, stamps_required = $2, menu_item_ids = $3, categories = $4, active = $5 WHERE id = $6 RETURNING "+stampProgramColumns,
+		program.Name, program.StampsRequired, pq.Array(program.MenuItemIDs), pq.Array(program.Categories), program.Active, program.ID,
+	), &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StampProgram{}, ErrStampProgramNotFound
+	}
+	return updated, err
+}
+
+// Карты покупателя по всем программам, включая ещё не начатые активные
+func (p *Provider) FetchStampCards(customerID int) ([]StampCard, error) {
+	if _, err := p.FetchCustomer(customerID); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.conn.Query(`
+        SELECT sp.id, sp.name, sp.stamps_required, COALESCE(sc.stamps, 0)
+        FROM stamp_programs sp
+        LEFT JOIN stamp_cards sc ON sc.program_id = sp.id AND sc.customer_id = $1
+        WHERE sp.active OR sc.stamps > 0
+        ORDER BY sp.id ASC
+    `, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []StampCard{}
+	for rows.Next() {
+		var card StampCard
+		if err := rows.Scan(&card.ProgramID, &card.ProgramName, &card.StampsRequired, &card.Stamps); err != nil {
+			return nil, err
+		}
+		card.RewardReady = card.Stamps >= card.StampsRequired
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+// Изменение числа штампов на карте с записью в журнал; баланс не уходит ниже нуля
+func changeStamps(tx *sql.Tx, customerID, programID int, orderID *int, kind string, delta int) error {
+	_, err := tx.Exec(
+		"INSERT INTO stamp_events (customer_id, program_id, order_id, kind, stamps) VALUES ($1, $2, $3, $4, $5)",
+		customerID, programID, orderID, kind, delta,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert stamp event: %v", err)
+	}
+	_, err = tx.Exec(`
+        INSERT INTO stamp_cards (customer_id, program_id, stamps) VALUES ($1, $2, GREATEST($3, 0))
+        ON CONFLICT (customer_id, program_id) DO UPDATE SET stamps = GREATEST(stamp_cards.stamps + $3, 0)
+    `, customerID, programID, delta)
+	if err != nil {
+		return fmt.Errorf("failed to update stamp card: %v", err)
+	}
+	return nil
+}
+
+// Награды по заполненным картам: одна подходящая позиция (самая дешёвая)
+// становится бесплатной. Из строки с несколькими порциями бесплатная
+// выделяется отдельной строкой. Возвращает позиции заказа и сумму скидки.
+func applyStampRewards(tx *sql.Tx, orderID, customerID int, items []OrderItem) ([]OrderItem, float64, error) {
+	rows, err := tx.Query("SELECT " + stampProgramColumns + " FROM stamp_programs WHERE active ORDER BY id ASC")
+	if err != nil {
+		return nil, 0, err
+	}
+	var programs []StampProgram
+	for rows.Next() {
+		var program StampProgram
+		if err := scanStampProgram(rows, &program); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		programs = append(programs, program)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(programs) == 0 {
+		return items, 0, nil
+	}
+
+	menuIDs := make([]int64, len(items))
+	for i, item := range items {
+		menuIDs[i] = int64(item.MenuItemId)
+	}
+	categories := make(map[int]string)
+	catRows, err := tx.Query("SELECT id, category FROM menu WHERE id = ANY($1)", pq.Array(menuIDs))
+	if err != nil {
+		return nil, 0, err
+	}
+	for catRows.Next() {
+		var id int
+		var category string
+		if err := catRows.Scan(&id, &category); err != nil {
+			catRows.Close()
+			return nil, 0, err
+		}
+		categories[id] = category
+	}
+	catRows.Close()
+	if err := catRows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var discount float64
+	for _, program := range programs {
+		var stamps int
+		err := tx.QueryRow(
+			"SELECT stamps FROM stamp_cards WHERE customer_id = $1 AND program_id = $2 FOR UPDATE",
+			customerID, program.ID,
+		).Scan(&stamps)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if stamps < program.StampsRequired {
+			continue
+		}
+
+		best := -1
+		for i, item := range items {
+			if item.StampProgramID != nil || item.Price <= 0 || !program.Matches(item.MenuItemId, categories[item.MenuItemId]) {
+				continue
+			}
+			if best < 0 || item.Price < items[best].Price {
+				best = i
+			}
+		}
+		if best < 0 {
+			continue
+		}
+
+		programID := program.ID
+		line := items[best]
+		if line.Quantity == 1 {
+			_, err = tx.Exec("UPDATE order_items SET price = 0, stamp_program_id = $1 WHERE id = $2", programID, line.ID)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to apply stamp reward: %v", err)
+			}
+			items[best].Price = 0
+			items[best].StampProgramID = &programID
+		} else {
+			_, err = tx.Exec("UPDATE order_items SET quantity = quantity - 1 WHERE id = $1", line.ID)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to apply stamp reward: %v", err)
+			}
+			items[best].Quantity--
+			free := OrderItem{MenuItemId: line.MenuItemId, Quantity: 1, Comment: line.Comment, StampProgramID: &programID}
+			err = tx.QueryRow(
+				"INSERT INTO order_items (order_id, menu_item_id, quantity, price, comment, stamp_program_id) VALUES ($1, $2, 1, 0, $3, $4) RETURNING id",
+				orderID, free.MenuItemId, free.Comment, programID,
+			).Scan(&free.ID)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to insert stamp reward: %v", err)
+			}
+			items = append(items, free)
+		}
+		discount += line.Price
+
+		if err := changeStamps(tx, customerID, programID, &orderID, StampReward, -program.StampsRequired); err != nil {
+			return nil, 0, err
+		}
+	}
+	return items, discount, nil
+}
+
+// Приведение штампов заказа к его статусу. Выполненный заказ даёт штамп
+// за каждую подходящую невозвращённую порцию, прочие статусы — ничего;
+// отменённый заказ также возвращает штампы, потраченные на награду.
+// Сверка идёт по журналу, поэтому повторный вызов ничего не меняет.
+func syncOrderStamps(tx *sql.Tx, orderID int, status string) error {
+	var customerID sql.NullInt64
+	if err := tx.QueryRow("SELECT customer_id FROM orders WHERE id = $1", orderID).Scan(&customerID); err != nil {
+		return err
+	}
+	if !customerID.Valid {
+		return nil
+	}
+
+	target := make(map[int]int)
+	if status == "Выполнен" {
+		rows, err := tx.Query(`
+            SELECT sp.id, SUM(oi.quantity - COALESCE((SELECT SUM(ri.quantity) FROM refund_items ri WHERE ri.order_item_id = oi.id), 0))
+            FROM stamp_programs sp
+            JOIN order_items oi ON oi.order_id = $1 AND oi.stamp_program_id IS NULL
+            JOIN menu m ON m.id = oi.menu_item_id
+            WHERE sp.active AND (oi.menu_item_id = ANY(sp.menu_item_ids) OR m.category = ANY(sp.categories))
+            GROUP BY sp.id
+        `, orderID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var programID, stamps int
+			if err := rows.Scan(&programID, &stamps); err != nil {
+				rows.Close()
+				return err
+			}
+			target[programID] = stamps
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	earned := make(map[int]int)
+	rewards := make(map[int]int)
+	rows, err := tx.Query(`
+        SELECT program_id,
+               COALESCE(SUM(stamps) FILTER (WHERE kind IN ($2, $3)), 0),
+               COALESCE(SUM(stamps) FILTER (WHERE kind IN ($4, $5)), 0)
+        FROM stamp_events
+        WHERE order_id = $1
+        GROUP BY program_id
+    `, orderID, StampEarn, StampReverse, StampReward, StampRewardReturn)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var programID, stamps, reward int
+		if err := rows.Scan(&programID, &stamps, &reward); err != nil {
+			rows.Close()
+			return err
+		}
+		earned[programID] = stamps
+		rewards[programID] = reward
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	customer := int(customerID.Int64)
+	for programID := range earned {
+		if _, ok := target[programID]; !ok {
+			target[programID] = 0
+		}
+	}
+	for programID, stamps := range target {
+		delta := stamps - earned[programID]
+		kind := StampEarn
+		if delta < 0 {
+			kind = StampReverse
+		}
+		if delta != 0 {
+			if err := changeStamps(tx, customer, programID, &orderID, kind, delta); err != nil {
+				return err
+			}
+		}
+	}
+
+	if status == "Отменен" {
+		for programID, reward := range rewards {
+			if reward != 0 {
+				if err := changeStamps(tx, customer, programID, &orderID, StampRewardReturn, -reward); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Колонки подарочной карты в порядке, ожидаемом scanGiftCard
+const giftCardColumns = "id, code, status, initial_amount, balance, expires_at, created_by, created_at, activated_at"
+
+func scanGiftCard(row rowScanner, card *GiftCard) error {
+	var expiresAt, activatedAt sql.NullTime
+	var createdAt time.Time
+	err := row.Scan(&card.ID, &card.Code, &card.Status, &card.InitialAmount, &card.Balance,
+		&expiresAt, &card.CreatedBy, &createdAt, &activatedAt)
+	if err != nil {
+		return err
+	}
+	card.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	if expiresAt.Valid {
+		card.ExpiresAt = &expiresAt.Time
+		card.Expired = expiresAt.Time.Before(time.Now())
+	}
+	if activatedAt.Valid {
+		card.ActivatedAt = &activatedAt.Time
+	}
+	return nil
+}
+
+func (p *Provider) AddGiftCard(code string, amount float64, user string) (GiftCard, error) {
+	var card GiftCard
+	err := scanGiftCard(p.conn.QueryRow(
+		"INSERT INTO gift_cards (code, initial_amount, created_by) VALUES ($1, $2, $3) RETURNING "+giftCardColumns,
+		code, amount, user,
+	), &card)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return GiftCard{}, ErrGiftCardExists
+	}
+	return card, err
+}
+
+// Карта с историей операций
+func (p *Provider) FetchGiftCard(code string) (GiftCard, error) {
+	var card GiftCard
+	err := scanGiftCard(p.conn.QueryRow("SELECT "+giftCardColumns+" FROM gift_cards WHERE code = $1", code), &card)
+	if errors.Is(err, sql.ErrNoRows) {
+		return GiftCard{}, ErrGiftCardNotFound
+	}
+	if err != nil {
+		return GiftCard{}, err
+	}
+
+	rows, err := p.conn.Query(`
+        SELECT id, gift_card_id, kind, amount, order_id, payment_method, shift_id, created_by, created_at
+        FROM gift_card_transactions
+        WHERE gift_card_id = $1
+        ORDER BY id ASC
+    `, card.ID)
+	if err != nil {
+		return GiftCard{}, err
+	}
+	defer rows.Close()
+
+	card.Transactions = []GiftCardTransaction{}
+	for rows.Next() {
+		var t GiftCardTransaction
+		var createdAt time.Time
+		err := rows.Scan(&t.ID, &t.GiftCardID, &t.Kind, &t.Amount, &t.OrderID, &t.PaymentMethod, &t.ShiftID, &t.CreatedBy, &createdAt)
+		if err != nil {
+			return GiftCard{}, err
+		}
+		t.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		card.Transactions = append(card.Transactions, t)
+	}
+	return card, rows.Err()
+}
+
+// Блокировка карты до конца транзакции
+func lockGiftCard(tx *sql.Tx, code string) (GiftCard, error) {
+	var card GiftCard
+	err := scanGiftCard(tx.QueryRow("SELECT "+giftCardColumns+" FROM gift_cards WHERE code = $1 FOR UPDATE", code), &card)
+	if errors.Is(err, sql.ErrNoRows) {
+		return GiftCard{}, ErrGiftCardNotFound
+	}
+	return card, err
+}
+
+// Карта, по которой можно платить и которую можно пополнять
+func lockUsableGiftCard(tx *sql.Tx, code string) (GiftCard, error) {
+	card, err := lockGiftCard(tx, code)
+	if err != nil {
+		return GiftCard{}, err
+	}
+	if card.Status != GiftCardActive {
+		return GiftCard{}, ErrGiftCardNotActive
+	}
+	if card.Expired {
+		return GiftCard{}, ErrGiftCardExpired
+	}
+	return card, nil
+}
+
+func addGiftCardTransaction(tx *sql.Tx, t GiftCardTransaction) error {
+	_, err := tx.Exec(`
+        INSERT INTO gift_card_transactions (gift_card_id, kind, amount, order_id, payment_method, shift_id, created_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, t.GiftCardID, t.Kind, t.Amount, t.OrderID, t.PaymentMethod, t.ShiftID, t.CreatedBy)
+	if err != nil {
+		return fmt.Errorf("failed to insert gift card transaction: %v", err)
+	}
+	return nil
+}
+
+// Открытая смена сотрудника в любой точке, куда поступают деньги за карты
+func giftCardShift(tx *sql.Tx, userID int, requireShift bool) (*int, error) {
+	var shiftID int
+	err := tx.QueryRow("SELECT id FROM shifts WHERE user_id = $1 AND closed_at IS NULL", userID).Scan(&shiftID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if requireShift {
+			return nil, ErrNoOpenShift
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &shiftID, nil
+}
+
+func (p *Provider) ActivateGiftCard(code, paymentMethod string, validityDays, userID int, user string, requireShift bool) (GiftCard, error) {
+	err := p.inTx(func(tx *sql.Tx) error {
+		card, err := lockGiftCard(tx, code)
+		if err != nil {
+			return err
+		}
+		if card.Status != GiftCardIssued {
+			return fmt.Errorf("%w: card is %s", ErrInvalidGiftCard, card.Status)
+		}
+		shiftID, err := giftCardShift(tx, userID, requireShift)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+            UPDATE gift_cards
+            SET status = $1, balance = initial_amount, activated_at = NOW(),
+                expires_at = CASE WHEN $2 > 0 THEN NOW() + $2::integer * INTERVAL '1 day' END
+            WHERE id = $3
+        `, GiftCardActive, validityDays, card.ID)
+		if err != nil {
+			return fmt.Errorf("failed to activate gift card: %v", err)
+		}
+		return addGiftCardTransaction(tx, GiftCardTransaction{
+			GiftCardID:    card.ID,
+			Kind:          GiftCardActivate,
+			Amount:        card.InitialAmount,
+			PaymentMethod: paymentMethod,
+			ShiftID:       shiftID,
+			CreatedBy:     user,
+		})
+	})
+	if err != nil {
+		return GiftCard{}, err
+	}
+	return p.FetchGiftCard(code)
+}
+
+func (p *Provider) TopUpGiftCard(code string, amount float64, paymentMethod string, userID int, user string, requireShift bool) (GiftCard, error) {
+	err := p.inTx(func(tx *sql.Tx) error {
+		card, err := lockUsableGiftCard(tx, code)
+		if err != nil {
+			return err
+		}
+		shiftID, err := giftCardShift(tx, userID, requireShift)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("UPDATE gift_cards SET balance = balance + $1 WHERE id = $2", amount, card.ID); err != nil {
+			return fmt.Errorf("failed to top up gift card: %v", err)
+		}
+		return addGiftCardTransaction(tx, GiftCardTransaction{
+			GiftCardID:    card.ID,
+			Kind:          GiftCardTopUp,
+			Amount:        amount,
+			PaymentMethod: paymentMethod,
+			ShiftID:       shiftID,
+			CreatedBy:     user,
+		})
+	})
+	if err != nil {
+		return GiftCard{}, err
+	}
+	return p.FetchGiftCard(code)
+}
+
+// Оплата картой части заказа: не больше остатка на карте и неоплаченной
+// части заказа. amount = 0 списывает сколько возможно.
+func redeemGiftCard(tx *sql.Tx, order *Order, code string, amount float64, user string) error {
+	card, err := lockUsableGiftCard(tx, code)
+	if err != nil {
+		return err
+	}
+
+	due := roundMoney(order.Total - order.PointsAmount - order.GiftCardAmount)
+	if due <= 0 {
+		return fmt.Errorf("%w: order %d is already paid", ErrInvalidGiftCard, order.ID)
+	}
+	if amount == 0 {
+		amount = math.Min(card.Balance, due)
+	}
+	if amount <= 0 || amount > card.Balance {
+		return fmt.Errorf("%w: only %.2f left on the card", ErrInvalidGiftCard, card.Balance)
+	}
+	if amount > due {
+		return fmt.Errorf("%w: only %.2f left to pay", ErrInvalidGiftCard, due)
+	}
+
+	if _, err := tx.Exec("UPDATE gift_cards SET balance = balance - $1 WHERE id = $2", amount, card.ID); err != nil {
+		return fmt.Errorf("failed to redeem gift card: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE orders SET gift_card_amount = gift_card_amount + $1 WHERE id = $2", amount, order.ID); err != nil {
+		return fmt.Errorf("failed to update order payment: %v", err)
+	}
+	order.GiftCardAmount += amount
+
+	return addGiftCardTransaction(tx, GiftCardTransaction{
+		GiftCardID: card.ID,
+		Kind:       GiftCardRedeem,
+		Amount:     -amount,
+		OrderID:    &order.ID,
+		CreatedBy:  user,
+	})
+}
+
+func (p *Provider) RedeemGiftCard(code string, orderID int, amount float64, user string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		var order Order
+		err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM orders o WHERE o.id = $1 FOR UPDATE", orderID), &order)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if order.Status == "Отменен" {
+			return fmt.Errorf("%w: order %d is cancelled", ErrInvalidGiftCard, orderID)
+		}
+		return redeemGiftCard(tx, &order, code, amount, user)
+	})
+}
+
+// Возврат на карты суммы amount, ранее списанной с них за заказ
+func returnGiftCardPayment(tx *sql.Tx, orderID int, amount float64, user string) error {
+	rows, err := tx.Query(`
+        SELECT gift_card_id, -SUM(amount)
+        FROM gift_card_transactions
+        WHERE order_id = $1 AND kind IN ($2, $3)
+        GROUP BY gift_card_id
+        HAVING -SUM(amount) > 0
+        ORDER BY gift_card_id DESC
+    `, orderID, GiftCardRedeem, GiftCardRefund)
+	if err != nil {
+		return err
+	}
+	paid := make(map[int]float64)
+	var cardIDs []int
+	for rows.Next() {
+		var cardID int
+		var net float64
+		if err := rows.Scan(&cardID, &net); err != nil {
+			rows.Close()
+			return err
+		}
+		paid[cardID] = net
+		cardIDs = append(cardIDs, cardID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, cardID := range cardIDs {
+		if amount <= 0 {
+			break
+		}
+		back := math.Min(paid[cardID], amount)
+		if _, err := tx.Exec("UPDATE gift_cards SET balance = balance + $1 WHERE id = $2", back, cardID); err != nil {
+			return fmt.Errorf("failed to return gift card payment: %v", err)
+		}
+		err := addGiftCardTransaction(tx, GiftCardTransaction{
+			GiftCardID: cardID,
+			Kind:       GiftCardRefund,
+			Amount:     back,
+			OrderID:    &orderID,
+			CreatedBy:  user,
+		})
+		if err != nil {
+			return err
+		}
+		amount = roundMoney(amount - back)
+	}
+	return nil
+}
+
+func (p *Provider) VoidGiftCard(code, user string) (GiftCard, error) {
+	err := p.inTx(func(tx *sql.Tx) error {
+		card, err := lockGiftCard(tx, code)
+		if err != nil {
+			return err
+		}
+		if card.Status == GiftCardVoid {
+			return fmt.Errorf("%w: card is already void", ErrInvalidGiftCard)
+		}
+
+		if _, err = tx.Exec("UPDATE gift_cards SET status = $1, balance = 0 WHERE id = $2", GiftCardVoid, card.ID); err != nil {
+			return fmt.Errorf("failed to void gift card: %v", err)
+		}
+		return addGiftCardTransaction(tx, GiftCardTransaction{
+			GiftCardID: card.ID,
+			Kind:       GiftCardVoidOp,
+			Amount:     -card.Balance,
+			CreatedBy:  user,
+		})
+	})
+	if err != nil {
+		return GiftCard{}, err
+	}
+	return p.FetchGiftCard(code)
+}
+
+func (p *Provider) FetchGiftCardLiability() (GiftCardLiability, error) {
+	var l GiftCardLiability
+	err := p.conn.QueryRow(`
+        SELECT COUNT(*) FILTER (WHERE expires_at IS NULL OR expires_at > NOW()),
+               COALESCE(SUM(balance) FILTER (WHERE expires_at IS NULL OR expires_at > NOW()), 0),
+               COUNT(*) FILTER (WHERE expires_at <= NOW()),
+               COALESCE(SUM(balance) FILTER (WHERE expires_at <= NOW()), 0)
+        FROM gift_cards
+        WHERE status = $1 AND balance > 0
+    `, GiftCardActive).Scan(&l.ActiveCards, &l.Outstanding, &l.ExpiredCards, &l.ExpiredBalance)
+	return l, err
+}
+
+const tableColumns = "id, location_id, number, capacity, zone, active"
+
+func scanTable(row rowScanner, table *DiningTable) error {
+	return row.Scan(&table.ID, &table.LocationID, &table.Number, &table.Capacity, &table.Zone, &table.Active)
+}
+
+// Ошибки уникальности номера стола и несуществующей точки
+func tableError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505":
+			return ErrTableExists
+		case "23503":
+			return ErrLocationNotFound
+		}
+	}
+	return err
+}
+
+func (p *Provider) FetchTables(locationID int) ([]DiningTable, error) {
+	rows, err := p.conn.Query(
+		"SELECT "+tableColumns+" FROM dining_tables WHERE ($1 = 0 OR location_id = $1) ORDER BY location_id, number",
+		locationID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []DiningTable{}
+	for rows.Next() {
+		var table DiningTable
+		if err := scanTable(rows, &table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+func (p *Provider) FetchTable(id int) (DiningTable, error) {
+	var table DiningTable
+	err := scanTable(p.conn.QueryRow("SELECT "+tableColumns+" FROM dining_tables WHERE id = $1", id), &table)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DiningTable{}, ErrTableNotFound
+	}
+	return table, err
+}
+
+func (p *Provider) AddTable(table DiningTable) (DiningTable, error) {
+	var created DiningTable
+	err := scanTable(p.conn.QueryRow(
+		"INSERT INTO dining_tables (location_id, number, capacity, zone, active) VALUES ($1, $2, $3, $4, $5) RETURNING "+tableColumns,
+		table.LocationID, table.Number, table.Capacity, table.Zone, table.Active,
+	), &created)
+	return created, tableError(err)
+}
+
+func (p *Provider) UpdateTable(table DiningTable) (DiningTable, error) {
+	var updated DiningTable
+	err := scanTable(p.conn.QueryRow(
+		"UPDATE dining_tables SET number = $1, capacity = $2, zone = $3, active = $4 WHERE id = $5 RETURNING "+tableColumns,
+		table.Number, table.Capacity, table.Zone, table.Active, table.ID,
+	), &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DiningTable{}, ErrTableNotFound
+	}
+	return updated, tableError(err)
+}
+
+const reservationColumns = `r.id, r.location_id, r.table_id, t.number, r.starts_at, r.ends_at, r.party_size,
+    r.guest_name, r.phone, r.comment, r.status, r.order_id, r.created_by, r.created_at`
+
+const reservationFrom = " FROM reservations r JOIN dining_tables t ON t.id = r.table_id"
+
+func scanReservation(row rowScanner, r *Reservation) error {
+	var orderID sql.NullInt64
+	var createdAt time.Time
+	err := row.Scan(&r.ID, &r.LocationID, &r.TableID, &r.TableNumber, &r.StartsAt, &r.EndsAt, &r.PartySize,
+		&r.GuestName, &r.Phone, &r.Comment, &r.Status, &orderID, &r.CreatedBy, &createdAt)
+	if err != nil {
+		return err
+	}
+	if orderID.Valid {
+		id := int(orderID.Int64)
+		r.OrderID = &id
+	}
+	r.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	return nil
+}
+
+// Брони, пересекающиеся с промежутком [from, to), по времени начала;
+// пустой statuses не ограничивает выборку
+func (p *Provider) FetchReservations(locationID int, from, to time.Time, statuses []string) ([]Reservation, error) {
+	rows, err := p.conn.Query(
+		"SELECT "+reservationColumns+reservationFrom+`
+        WHERE ($1 = 0 OR r.location_id = $1) AND r.starts_at < $3 AND r.ends_at > $2
+          AND (cardinality($4::text[]) = 0 OR r.status = ANY($4))
+        ORDER BY r.starts_at, r.id`,
+		locationID, from, to, pq.Array(statuses),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []Reservation{}
+	for rows.Next() {
+		var r Reservation
+		if err := scanReservation(rows, &r); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
+
+func (p *Provider) FetchReservation(id int) (Reservation, error) {
+	var r Reservation
+	err := scanReservation(p.conn.QueryRow("SELECT "+reservationColumns+reservationFrom+" WHERE r.id = $1", id), &r)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Reservation{}, ErrReservationNotFound
+	}
+	return r, err
+}
+
+// Блокировка брони до конца транзакции
+func lockReservation(tx *sql.Tx, id int) (Reservation, error) {
+	var r Reservation
+	err := scanReservation(tx.QueryRow("SELECT "+reservationColumns+reservationFrom+" WHERE r.id = $1 FOR UPDATE OF r", id), &r)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Reservation{}, ErrReservationNotFound
+	}
+	return r, err
+}
+
+// Блокирует стол брони r и проверяет вместимость и пересечения с другими
+// действующими бронями. Блокировка стола упорядочивает одновременные брони.
+func checkTableSlot(tx *sql.Tx, r *Reservation) error {
+	var table DiningTable
+	err := scanTable(tx.QueryRow("SELECT "+tableColumns+" FROM dining_tables WHERE id = $1 FOR UPDATE", r.TableID), &table)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTableNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !table.Active {
+		return fmt.Errorf("%w: table is not in service", ErrInvalidReservation)
+	}
+	if r.PartySize > table.Capacity {
+		return fmt.Errorf("%w: table seats only %d guests", ErrInvalidReservation, table.Capacity)
+	}
+	r.LocationID = table.LocationID
+	r.TableNumber = table.Number
+
+	var busy bool
+	err = tx.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM reservations
+            WHERE table_id = $1 AND id <> $2 AND status IN ($3, $4)
+              AND starts_at < $6 AND ends_at > $5
+        )
+    `, r.TableID, r.ID, ReservationBooked, ReservationSeated, r.StartsAt, r.EndsAt).Scan(&busy)
+	if err != nil {
+		return err
+	}
+	if busy {
+		return ErrReservationConflict
+	}
+	return nil
+}
+
+func (p *Provider) AddReservation(r Reservation) (Reservation, error) {
+	var created Reservation
+	err := p.inTx(func(tx *sql.Tx) error {
+		if err := checkTableSlot(tx, &r); err != nil {
+			return err
+		}
+
+		var id int
+		err := tx.QueryRow(`
+            INSERT INTO reservations (location_id, table_id, starts_at, ends_at, party_size, guest_name, phone, comment, status, created_by)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id
+        `, r.LocationID, r.TableID, r.StartsAt, r.EndsAt, r.PartySize, r.GuestName, r.Phone, r.Comment, ReservationBooked, r.CreatedBy).Scan(&id)
+		if err != nil {
+			return err
+		}
+		created, err = lockReservation(tx, id)
+		return err
+	})
+	return created, err
+}
+
+func (p *Provider) UpdateReservation(r Reservation) (Reservation, error) {
+	var updated Reservation
+	err := p.inTx(func(tx *sql.Tx) error {
+		current, err := lockReservation(tx, r.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != ReservationBooked {
+			return fmt.Errorf("%w: only booked reservations can be changed", ErrInvalidReservation)
+		}
+		if err := checkTableSlot(tx, &r); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+            UPDATE reservations SET location_id = $1, table_id = $2, starts_at = $3, ends_at = $4,
+                party_size = $5, guest_name = $6, phone = $7, comment = $8
+            WHERE id = $9
+        `, r.LocationID, r.TableID, r.StartsAt, r.EndsAt, r.PartySize, r.GuestName, r.Phone, r.Comment, r.ID)
+		if err != nil {
+			return err
+		}
+		updated, err = lockReservation(tx, r.ID)
+		return err
+	})
+	return updated, err
+}
+
+func (p *Provider) SetReservationStatus(id int, status string) (Reservation, error) {
+	var updated Reservation
+	err := p.inTx(func(tx *sql.Tx) error {
+		current, err := lockReservation(tx, id)
+		if err != nil {
+			return err
+		}
+		if !reservationTransitions[current.Status][status] {
+			return fmt.Errorf("%w: cannot change status from %s to %s", ErrInvalidReservation, current.Status, status)
+		}
+
+		if _, err := tx.Exec("UPDATE reservations SET status = $1 WHERE id = $2", status, id); err != nil {
+			return err
+		}
+		updated, err = lockReservation(tx, id)
+		return err
+	})
+	return updated, err
+}
+
+// Привязка заказа, открытого по брони; другой заказ привязать нельзя
+func (p *Provider) SetReservationOrder(id, orderID int) error {
+	res, err := p.conn.Exec(
+		"UPDATE reservations SET order_id = $2 WHERE id = $1 AND (order_id IS NULL OR order_id = $2)",
+		id, orderID,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: reservation already has an order", ErrInvalidReservation)
+	}
+	return nil
+}
+
+func (p *Provider) AddFeedback(f Feedback) (Feedback, error) {
+	err := p.inTx(func(tx *sql.Tx) error {
+		var status string
+		err := tx.QueryRow("SELECT status FROM orders WHERE id = $1 FOR SHARE", f.OrderID).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if status == "Отменен" {
+			return fmt.Errorf("%w: order is cancelled", ErrInvalidFeedback)
+		}
+
+		var createdAt time.Time
+		err = tx.QueryRow(
+			"INSERT INTO feedback (order_id, rating, comment) VALUES ($1, $2, $3) RETURNING id, created_at",
+			f.OrderID, f.Rating, f.Comment,
+		).Scan(&f.ID, &createdAt)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrFeedbackExists
+		}
+		if err != nil {
+			return err
+		}
+		f.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+
+		// Оценивать можно только позиции этого заказа
+		for i, item := range f.Items {
+			err := tx.QueryRow(`
+                INSERT INTO feedback_items (feedback_id, order_item_id, menu_item_id, rating)
+                SELECT $1, id, menu_item_id, $2 FROM order_items WHERE id = $3 AND order_id = $4
+                RETURNING menu_item_id
+            `, f.ID, item.Rating, item.OrderItemID, f.OrderID).Scan(&f.Items[i].MenuItemID)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%w: item %d is not in the order", ErrInvalidFeedback, item.OrderItemID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Feedback{}, err
+	}
+	if f.Items == nil {
+		f.Items = []FeedbackItem{}
+	}
+	return f, nil
+}
+
+func (p *Provider) FetchOrderFeedback(orderID int) (Feedback, error) {
+	var f Feedback
+	var createdAt time.Time
+	err := p.conn.QueryRow(
+		"SELECT id, order_id, rating, comment, created_at FROM feedback WHERE order_id = $1", orderID,
+	).Scan(&f.ID, &f.OrderID, &f.Rating, &f.Comment, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Feedback{}, ErrFeedbackNotFound
+	}
+	if err != nil {
+		return Feedback{}, err
+	}
+	f.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+
+	feedback := []Feedback{f}
+	if err := p.fillFeedbackItems(feedback); err != nil {
+		return Feedback{}, err
+	}
+	return feedback[0], nil
+}
+
+func (p *Provider) fillFeedbackItems(feedback []Feedback) error {
+	if len(feedback) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(feedback))
+	index := make(map[int]int, len(feedback))
+	for i := range feedback {
+		ids[i] = int64(feedback[i].ID)
+		index[feedback[i].ID] = i
+		feedback[i].Items = []FeedbackItem{}
+	}
+
+	rows, err := p.conn.Query(
+		"SELECT feedback_id, order_item_id, menu_item_id, rating FROM feedback_items WHERE feedback_id = ANY($1) ORDER BY order_item_id",
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var feedbackID int
+		var item FeedbackItem
+		if err := rows.Scan(&feedbackID, &item.OrderItemID, &item.MenuItemID, &item.Rating); err != nil {
+			return err
+		}
+		i := index[feedbackID]
+		feedback[i].Items = append(feedback[i].Items, item)
+	}
+	return rows.Err()
+}
+
+func feedbackConditions(f FeedbackFilter) (string, []interface{}) {
+	where := []string{"TRUE"}
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.LocationID > 0 {
+		add("o.location_id = $%d", f.LocationID)
+	}
+	if f.From != nil {
+		add("f.created_at >= $%d::timestamptz", *f.From)
+	}
+	if f.To != nil {
+		add("f.created_at < $%d::timestamptz", *f.To)
+	}
+	if f.MaxRating > 0 {
+		add("f.rating <= $%d", f.MaxRating)
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// Последние 200 отзывов, сначала новые
+func (p *Provider) FetchFeedback(filter FeedbackFilter) ([]Feedback, error) {
+	where, args := feedbackConditions(filter)
+	rows, err := p.conn.Query(`
+        SELECT f.id, f.order_id, f.rating, f.comment, f.created_at
+        FROM feedback f JOIN orders o ON o.id = f.order_id
+        WHERE `+where+`
+        ORDER BY f.created_at DESC, f.id DESC LIMIT 200`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feedback := []Feedback{}
+	for rows.Next() {
+		var f Feedback
+		var createdAt time.Time
+		if err := rows.Scan(&f.ID, &f.OrderID, &f.Rating, &f.Comment, &createdAt); err != nil {
+			return nil, err
+		}
+		f.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		feedback = append(feedback, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return feedback, p.fillFeedbackItems(feedback)
+}
+
+func scanRatingStats(rows *sql.Rows) ([]RatingStat, error) {
+	defer rows.Close()
+
+	stats := []RatingStat{}
+	for rows.Next() {
+		var s RatingStat
+		if err := rows.Scan(&s.ID, &s.Name, &s.Average, &s.Count); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// Позиция без собственной оценки получает общую оценку заказа. Сотрудником
+// заказа считается владелец кассовой смены, в которой заказ принят.
+func (p *Provider) FetchFeedbackAnalytics(filter FeedbackFilter) (FeedbackAnalytics, error) {
+	where, args := feedbackConditions(filter)
+	var a FeedbackAnalytics
+
+	err := p.conn.QueryRow(`
+        SELECT COALESCE(ROUND(AVG(f.rating), 2), 0), COUNT(*)
+        FROM feedback f JOIN orders o ON o.id = f.order_id
+        WHERE `+where, args...).Scan(&a.Average, &a.Count)
+	if err != nil {
+		return FeedbackAnalytics{}, err
+	}
+
+	rows, err := p.conn.Query(`
+        SELECT m.id, m.name, ROUND(AVG(COALESCE(fi.rating, f.rating)), 2), COUNT(*)
+        FROM feedback f
+        JOIN orders o ON o.id = f.order_id
+        JOIN order_items oi ON oi.order_id = f.order_id
+        JOIN menu m ON m.id = oi.menu_item_id
+        LEFT JOIN feedback_items fi ON fi.feedback_id = f.id AND fi.order_item_id = oi.id
+        WHERE `+where+`
+        GROUP BY m.id, m.name
+        ORDER BY 3 ASC, 4 DESC`, args...)
+	if err != nil {
+		return FeedbackAnalytics{}, err
+	}
+	if a.Items, err = scanRatingStats(rows); err != nil {
+		return FeedbackAnalytics{}, err
+	}
+
+	rows, err = p.conn.Query(`
+        SELECT u.id, u.name, ROUND(AVG(f.rating), 2), COUNT(*)
+        FROM feedback f
+        JOIN orders o ON o.id = f.order_id
+        JOIN shifts s ON s.id = o.shift_id
+        JOIN users u ON u.id = s.user_id
+        WHERE `+where+`
+        GROUP BY u.id, u.name
+        ORDER BY 3 ASC, 4 DESC`, args...)
+	if err != nil {
+		return FeedbackAnalytics{}, err
+	}
+	if a.Staff, err = scanRatingStats(rows); err != nil {
+		return FeedbackAnalytics{}, err
+	}
+	return a, nil
+}
+
+const printJobColumns = "id, printer, order_id, kind, manual, status, attempts, last_error, next_attempt_at, created_at, printed_at"
+
+func scanPrintJob(row rowScanner, job *PrintJob, extra ...interface{}) error {
+	var orderID sql.NullInt64
+	var createdAt time.Time
+	var printedAt sql.NullTime
+	dest := []interface{}{&job.ID, &job.Printer, &orderID, &job.Kind, &job.Manual, &job.Status,
+		&job.Attempts, &job.LastError, &job.NextAttemptAt, &createdAt, &printedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	if orderID.Valid {
+		id := int(orderID.Int64)
+		job.OrderID = &id
+	}
+	job.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	if printedAt.Valid {
+		job.PrintedAt = &printedAt.Time
+	}
+	return nil
+}
+
+// Постановка задания в очередь. Автоматическое задание того же вида по заказу
+// для того же принтера не дублируется: added = false.
+func (p *Provider) AddPrintJob(job PrintJob) (bool, error) {
+	res, err := p.conn.Exec(`
+        INSERT INTO print_jobs (printer, order_id, kind, manual, payload)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (order_id, printer, kind) WHERE NOT manual DO NOTHING
+    `, job.Printer, job.OrderID, job.Kind, job.Manual, job.Payload)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (p *Provider) HasPrintJob(orderID int, printer, kind string) (bool, error) {
+	var exists bool
+	err := p.conn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM print_jobs WHERE order_id = $1 AND printer = $2 AND kind = $3)",
+		orderID, printer, kind,
+	).Scan(&exists)
+	return exists, err
+}
+
+// Выборка готовых к отправке заданий с резервированием на lease:
+// попытка засчитывается сразу, а задание не выдаётся повторно до истечения резерва
+func (p *Provider) ClaimPrintJobs(limit int, lease time.Duration) ([]PrintJob, error) {
+	rows, err := p.conn.Query(`
+        UPDATE print_jobs SET attempts = attempts + 1, next_attempt_at = NOW() + $2::float8 * INTERVAL '1 second'
+        WHERE id IN (
+            SELECT id FROM print_jobs
+            WHERE status = $3 AND next_attempt_at <= NOW()
+            ORDER BY id LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING `+printJobColumns+`, payload`,
+		limit, lease.Seconds(), PrintPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []PrintJob
+	for rows.Next() {
+		var job PrintJob
+		if err := scanPrintJob(rows, &job, &job.Payload); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (p *Provider) CompletePrintJob(id int) error {
+	_, err := p.conn.Exec(
+		"UPDATE print_jobs SET status = $1, last_error = '', printed_at = NOW() WHERE id = $2",
+		PrintDone, id,
+	)
+	return err
+}
+
+// Неудачная попытка: retryAt = nil означает окончательный отказ
+func (p *Provider) FailPrintJob(id int, lastError string, retryAt *time.Time) error {
+	if retryAt == nil {
+		_, err := p.conn.Exec("UPDATE print_jobs SET status = $1, last_error = $2 WHERE id = $3", PrintFailed, lastError, id)
+		return err
+	}
+	_, err := p.conn.Exec("UPDATE print_jobs SET last_error = $1, next_attempt_at = $2 WHERE id = $3", lastError, *retryAt, id)
+	return err
+}
+
+// Последние 200 заданий; пустой status не ограничивает выборку
+func (p *Provider) FetchPrintJobs(status string) ([]PrintJob, error) {
+	rows, err := p.conn.Query(
+		"SELECT "+printJobColumns+" FROM print_jobs WHERE ($1 = '' OR status = $1) ORDER BY id DESC LIMIT 200",
+		status,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []PrintJob{}
+	for rows.Next() {
+		var job PrintJob
+		if err := scanPrintJob(rows, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (p *Provider) RetryPrintJob(id int) (PrintJob, error) {
+	var job PrintJob
+	err := scanPrintJob(p.conn.QueryRow(`
+        UPDATE print_jobs SET status = $1, attempts = 0, next_attempt_at = NOW()
+        WHERE id = $2 AND status <> $3
+        RETURNING `+printJobColumns,
+		PrintPending, id, PrintDone,
+	), &job)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+		if err := p.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM print_jobs WHERE id = $1)", id).Scan(&exists); err != nil {
+			return PrintJob{}, err
+		}
+		if exists {
+			return PrintJob{}, fmt.Errorf("%w: job is already printed", ErrInvalidPrintJob)
+		}
+		return PrintJob{}, ErrPrintJobNotFound
+	}
+	return job, err
+}
+
+// Содержимое фискального документа, хранимое в JSONB
+type fiscalBody struct {
+	Taxation   string            `json:"taxation"`
+	INN        string            `json:"inn"`
+	Address    string            `json:"payment_address"`
+	Items      []FiscalItem      `json:"items"`
+	Payments   FiscalPayments    `json:"payments"`
+	Correction *FiscalCorrection `json:"correction,omitempty"`
+}
+
+const fiscalColumns = `id, order_id, refund_id, doc_type, document, total, status, attempts, last_error, next_attempt_at,
+    fiscal_sign, fiscal_number, fn_number, shift_number, registered_at, created_at`
+
+func scanFiscalDocument(row rowScanner, doc *FiscalDocument) error {
+	var refundID sql.NullInt64
+	var document []byte
+	var sign, number, fn sql.NullString
+	var shift sql.NullInt64
+	var registeredAt sql.NullTime
+	var createdAt time.Time
+	err := row.Scan(&doc.ID, &doc.OrderID, &refundID, &doc.Type, &document, &doc.Total, &doc.Status,
+		&doc.Attempts, &doc.LastError, &doc.NextAttemptAt, &sign, &number, &fn, &shift, &registeredAt, &createdAt)
+	if err != nil {
+		return err
+	}
+
+	var body fiscalBody
+	if err := json.Unmarshal(document, &body); err != nil {
+		return err
+	}
+	doc.Taxation, doc.INN, doc.Address = body.Taxation, body.INN, body.Address
+	doc.Items, doc.Payments, doc.Correction = body.Items, body.Payments, body.Correction
+
+	if refundID.Valid {
+		id := int(refundID.Int64)
+		doc.RefundID = &id
+	}
+	if sign.Valid {
+		doc.Result = &FiscalResult{
+			FiscalSign:   sign.String,
+			FiscalNumber: number.String,
+			FNNumber:     fn.String,
+			ShiftNumber:  int(shift.Int64),
+			RegisteredAt: registeredAt.Time,
+		}
+	}
+	doc.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	return nil
+}
+
+// Постановка документа в очередь. Приход по заказу и документ по возврату
+// создаются один раз: при повторе возвращается существующий документ.
+func (p *Provider) AddFiscalDocument(doc FiscalDocument) (FiscalDocument, error) {
+	document, err := json.Marshal(fiscalBody{
+		Taxation:   doc.Taxation,
+		INN:        doc.INN,
+		Address:    doc.Address,
+		Items:      doc.Items,
+		Payments:   doc.Payments,
+		Correction: doc.Correction,
+	})
+	if err != nil {
+		return FiscalDocument{}, err
+	}
+
+	var created FiscalDocument
+	err = scanFiscalDocument(p.conn.QueryRow(`
+        INSERT INTO fiscal_documents (order_id, refund_id, doc_type, document, total)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT DO NOTHING
+        RETURNING `+fiscalColumns,
+		doc.OrderID, doc.RefundID, doc.Type, document, doc.Total,
+	), &created)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return created, err
+	}
+
+	err = scanFiscalDocument(p.conn.QueryRow(`
+        SELECT `+fiscalColumns+` FROM fiscal_documents
+        WHERE order_id = $1 AND doc_type = $2 AND refund_id IS NOT DISTINCT FROM $3
+        ORDER BY id LIMIT 1`,
+		doc.OrderID, doc.Type, doc.RefundID,
+	), &created)
+	return created, err
+}
+
+// Есть ли по заказу приход или коррекция прихода, которые не отклонены и не сняты
+func (p *Provider) HasFiscalSale(orderID int) (bool, error) {
+	return hasFiscalSale(p.conn, orderID)
+}
+
+func hasFiscalSale(q queryer, orderID int) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM fiscal_documents
+            WHERE order_id = $1 AND doc_type IN ($2, $3) AND status NOT IN ($4, $5)
+        )
+    `, orderID, FiscalSell, FiscalSellCorrection, FiscalFailed, FiscalCancelled).Scan(&exists)
+	return exists, err
+}
+
+// Снимает с очереди приход по заказу, который ещё ни разу не отправлялся.
+// Взятый в отправку документ уже мог попасть в кассу, поэтому не трогается.
+// Вместе с приходом снимаются ждущие отправки чеки возврата по заказу:
+// без прихода возвращать в кассе нечего.
+func (p *Provider) CancelPendingFiscalSale(orderID int) (bool, error) {
+	var dropped bool
+	err := p.conn.QueryRow(`
+        WITH sale AS (
+            UPDATE fiscal_documents SET status = $1, last_error = 'order cancelled'
+            WHERE order_id = $2 AND doc_type = $3 AND status = $4 AND attempts = 0
+            RETURNING id
+        ), refunds AS (
+            UPDATE fiscal_documents SET status = $1, last_error = 'order cancelled'
+            WHERE order_id = $2 AND doc_type = $5 AND status = $4 AND EXISTS (SELECT 1 FROM sale)
+        )
+        SELECT EXISTS (SELECT 1 FROM sale)
+    `, FiscalCancelled, orderID, FiscalSell, FiscalPending, FiscalSellRefund).Scan(&dropped)
+	return dropped, err
+}
+
+// Документы заказа или последние 200 документов очереди; нулевой orderID
+// и пустой status не ограничивают выборку
+func (p *Provider) FetchFiscalDocuments(orderID int, status string) ([]FiscalDocument, error) {
+	rows, err := p.conn.Query(
+		"SELECT "+fiscalColumns+" FROM fiscal_documents WHERE ($1 = 0 OR order_id = $1) AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT 200",
+		orderID, status,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []FiscalDocument{}
+	for rows.Next() {
+		var doc FiscalDocument
+		if err := scanFiscalDocument(rows, &doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+// Выборка документов к отправке с резервированием на lease, как у очереди печати
+func (p *Provider) ClaimFiscalDocuments(limit int, lease time.Duration) ([]FiscalDocument, error) {
+	rows, err := p.conn.Query(`
+        UPDATE fiscal_documents SET attempts = attempts + 1, next_attempt_at = NOW() + $2::float8 * INTERVAL '1 second'
+        WHERE id IN (
+            SELECT id FROM fiscal_documents
+            WHERE status = $3 AND next_attempt_at <= NOW()
+            ORDER BY id LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING `+fiscalColumns,
+		limit, lease.Seconds(), FiscalPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var docs []FiscalDocument
+	for rows.Next() {
+		var doc FiscalDocument
+		if err := scanFiscalDocument(rows, &doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING не гарантирует порядок, а касса регистрирует документы последовательно
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+	return docs, nil
+}
+
+func (p *Provider) CompleteFiscalDocument(id int, result FiscalResult) error {
+	_, err := p.conn.Exec(`
+        UPDATE fiscal_documents SET status = $1, last_error = '', fiscal_sign = $2, fiscal_number = $3,
+            fn_number = $4, shift_number = $5, registered_at = $6
+        WHERE id = $7
+    `, FiscalDone, result.FiscalSign, result.FiscalNumber, result.FNNumber, result.ShiftNumber, result.RegisteredAt, id)
+	return err
+}
+
+// Неудачная отправка: retryAt = nil означает окончательный отказ
+func (p *Provider) FailFiscalDocument(id int, lastError string, retryAt *time.Time) error {
+	if retryAt == nil {
+		_, err := p.conn.Exec("UPDATE fiscal_documents SET status = $1, last_error = $2 WHERE id = $3", FiscalFailed, lastError, id)
+		return err
+	}
+	_, err := p.conn.Exec("UPDATE fiscal_documents SET last_error = $1, next_attempt_at = $2 WHERE id = $3", lastError, *retryAt, id)
+	return err
+}
+
+func (p *Provider) RetryFiscalDocument(id int) (FiscalDocument, error) {
+	var doc FiscalDocument
+	err := scanFiscalDocument(p.conn.QueryRow(`
+        UPDATE fiscal_documents SET status = $1, attempts = 0, next_attempt_at = NOW()
+        WHERE id = $2 AND status = $3
+        RETURNING `+fiscalColumns,
+		FiscalPending, id, FiscalFailed,
+	), &doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+		if err := p.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM fiscal_documents WHERE id = $1)", id).Scan(&exists); err != nil {
+			return FiscalDocument{}, err
+		}
+		if exists {
+			return FiscalDocument{}, fmt.Errorf("%w: only failed documents can be retried", ErrInvalidFiscalRequest)
+		}
+		return FiscalDocument{}, ErrFiscalNotFound
+	}
+	return doc, err
+}
+
+// Журнал действий только дополняется: обновление записей запрещено правилом в БД
+func (p *Provider) AddAuditEntry(e AuditEntry) error {
+	diff, err := json.Marshal(e.Diff)
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.Exec(`
+        INSERT INTO audit_log (actor_id, actor, role, action, entity, entity_id, diff, ip)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		e.ActorID, e.Actor, e.Role, e.Action, e.Entity, e.EntityID, diff, e.IP)
+	return err
+}
+
+func auditConditions(f AuditFilter) (string, []interface{}) {
+	where := []string{"TRUE"}
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.ActorID > 0 {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.Actor != "" {
+		add("actor ILIKE '%%' || $%d || '%%'", f.Actor)
+	}
+	if f.Action != "" {
+		add("action ILIKE '%%' || $%d || '%%'", f.Action)
+	}
+	if f.Entity != "" {
+		add("entity = $%d", f.Entity)
+	}
+	if f.EntityID != "" {
+		add("entity_id = $%d", f.EntityID)
+	}
+	if f.From != nil {
+		add("created_at >= $%d::timestamptz", *f.From)
+	}
+	if f.To != nil {
+		add("created_at < $%d::timestamptz", *f.To)
+	}
+	if f.BeforeID > 0 {
+		add("id < $%d", f.BeforeID)
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// Записи журнала от новых к старым; курсор — id последней записи страницы
+func (p *Provider) FetchAudit(filter AuditFilter) (AuditPage, error) {
+	where, args := auditConditions(filter)
+	args = append(args, filter.Limit+1)
+	rows, err := p.conn.Query(`
+        SELECT id, actor_id, actor, role, action, entity, entity_id, diff, ip, created_at
+        FROM audit_log
+        WHERE `+where+`
+        ORDER BY id DESC LIMIT $`+fmt.Sprint(len(args)), args...)
+	if err != nil {
+		return AuditPage{}, err
+	}
+	defer rows.Close()
+
+	page := AuditPage{Entries: []AuditEntry{}}
+	for rows.Next() {
+		var e AuditEntry
+		var diff []byte
+		var createdAt time.Time
+		err := rows.Scan(&e.ID, &e.ActorID, &e.Actor, &e.Role, &e.Action, &e.Entity, &e.EntityID, &diff, &e.IP, &createdAt)
+		if err != nil {
+			return AuditPage{}, err
+		}
+		if err := json.Unmarshal(diff, &e.Diff); err != nil {
+			return AuditPage{}, err
+		}
+		e.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		page.Entries = append(page.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return AuditPage{}, err
+	}
+
+	if len(page.Entries) > filter.Limit {
+		page.Entries = page.Entries[:filter.Limit]
+		page.NextCursor = page.Entries[len(page.Entries)-1].ID
+	}
+	return page, nil
+}
+
+// Удаление записей старше maxAge; возвращает число удалённых записей
+func (p *Provider) PurgeAudit(maxAge time.Duration) (int64, error) {
+	res, err := p.conn.Exec("DELETE FROM audit_log WHERE created_at < NOW() - $1::float8 * INTERVAL '1 second'", maxAge.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (p *Provider) CountUsers() (int, error) {
+	var n int
+	err := p.conn.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+const userSelect = `
+        SELECT u.id, u.name, u.email, u.role, u.active, u.created_at,
+               COALESCE(array_agg(ul.location_id ORDER BY ul.location_id) FILTER (WHERE ul.location_id IS NOT NULL), '{}')
+        FROM users u
+        LEFT JOIN user_locations ul ON ul.user_id = u.id`
+
+func scanUser(row rowScanner, user *User) error {
+	var createdAt time.Time
+	var locations pq.Int64Array
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.Active, &createdAt, &locations)
+	if err != nil {
+		return err
+	}
+	user.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	user.Locations = make([]int, len(locations))
+	for i, id := range locations {
+		user.Locations[i] = int(id)
+	}
+	return nil
+}
+
+func (p *Provider) FetchUser(id int) (User, error) {
+	var user User
+	err := scanUser(p.conn.QueryRow(userSelect+" WHERE u.id = $1 GROUP BY u.id", id), &user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (p *Provider) FetchUsers() ([]User, error) {
+	rows, err := p.conn.Query(userSelect + " GROUP BY u.id ORDER BY u.id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// Отключён ли пользователь и с какого момента действуют его токены
+func (p *Provider) FetchUserSession(id int) (bool, *time.Time, error) {
+	var active bool
+	var validAfter sql.NullTime
+	err := p.conn.QueryRow("SELECT active, sessions_valid_after FROM users WHERE id = $1", id).Scan(&active, &validAfter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil, ErrUserNotFound
+	}
+	if err != nil || !validAfter.Valid {
+		return active, nil, err
+	}
+	return active, &validAfter.Time, nil
+}
+
+func (p *Provider) FetchUserPassword(id int) (string, error) {
+	var password string
+	err := p.conn.QueryRow("SELECT password FROM users WHERE id = $1", id).Scan(&password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	return password, err
+}
+
+// Блокировка действующих владельцев; ошибка, если после изменения
+// пользователя userID не останется ни одного
+func lockOtherOwners(tx *sql.Tx, userID int) error {
+	var role string
+	var active bool
+	err := tx.QueryRow("SELECT role, active FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&role, &active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if role != vars.RoleOwner || !active {
+		return nil
+	}
+
+	rows, err := tx.Query("SELECT id FROM users WHERE role = $1 AND active AND id <> $2 FOR UPDATE", vars.RoleOwner, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	others := 0
+	for rows.Next() {
+		others++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if others == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// Смена роли завершает выданные сессии: роль записана в токене, и со старым
+// токеном пользователь сохранил бы прежние права
+func (p *Provider) SetUserRole(userID int, role string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if role != vars.RoleOwner {
+			if err := lockOtherOwners(tx, userID); err != nil {
+				return err
+			}
+		}
+		res, err := tx.Exec(`
+                UPDATE users
+                SET sessions_valid_after = CASE WHEN role <> $1 THEN date_trunc('second', NOW()) ELSE sessions_valid_after END,
+                    role = $1
+                WHERE id = $2`, role, userID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	})
+}
+
+// Отключение завершает выданные сессии, чтобы они не ожили после
+// повторного включения пользователя
+func (p *Provider) SetUserActive(userID int, active bool) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		if !active {
+			if err := lockOtherOwners(tx, userID); err != nil {
+				return err
+			}
+		}
+		res, err := tx.Exec(`
+                UPDATE users
+                SET sessions_valid_after = CASE WHEN active AND NOT $1 THEN date_trunc('second', NOW()) ELSE sessions_valid_after END,
+                    active = $1
+                WHERE id = $2`, active, userID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	})
+}
+
+// Новый пароль; токены, выданные до этого момента, перестают действовать.
+// Время округляется до секунды, как и время выдачи в JWT.
+func (p *Provider) SetUserPassword(userID int, hashedPassword string) error {
+	res, err := p.conn.Exec("UPDATE users SET password = $1, sessions_valid_after = date_trunc('second', NOW()) WHERE id = $2", hashedPassword, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+const inviteColumns = "id, email, role, locations, created_by, expires_at, accepted_at, created_at"
+
+func scanInvite(row rowScanner, invite *Invite) error {
+	var expiresAt, createdAt time.Time
+	var acceptedAt sql.NullTime
+	var locations pq.Int64Array
+	err := row.Scan(&invite.ID, &invite.Email, &invite.Role, &locations, &invite.CreatedBy, &expiresAt, &acceptedAt, &createdAt)
+	if err != nil {
+		return err
+	}
+	invite.Locations = []int64(locations)
+	if invite.Locations == nil {
+		invite.Locations = []int64{}
+	}
+	invite.ExpiresAt = expiresAt.Format("2006-01-02 15:04:05")
+	invite.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	if acceptedAt.Valid {
+		s := acceptedAt.Time.Format("2006-01-02 15:04:05")
+		invite.AcceptedAt = &s
+	}
+	return nil
+}
+
+func (p *Provider) AddInvite(tokenHash, email, role string, locations []int64, createdBy string, ttl time.Duration) (Invite, error) {
+	var invite Invite
+	err := scanInvite(p.conn.QueryRow(`
+        INSERT INTO user_invites (token_hash, email, role, locations, created_by, expires_at)
+        VALUES ($1, $2, $3, $4, $5, NOW() + $6::float8 * INTERVAL '1 second')
+        RETURNING `+inviteColumns,
+		tokenHash, email, role, pq.Array(locations), createdBy, ttl.Seconds()), &invite)
+	return invite, err
+}
+
+func (p *Provider) FetchInvites() ([]Invite, error) {
+	rows, err := p.conn.Query(`
+        SELECT ` + inviteColumns + ` FROM user_invites
+        WHERE accepted_at IS NULL AND expires_at > NOW()
+        ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var invite Invite
+		if err := scanInvite(rows, &invite); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// Отзыв ещё не принятого приглашения
+func (p *Provider) DeleteInvite(id int) error {
+	res, err := p.conn.Exec("DELETE FROM user_invites WHERE id = $1 AND accepted_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// Создание пользователя по приглашению; приглашение используется один раз
+func (p *Provider) AcceptInvite(tokenHash, name, hashedPassword string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		var inviteID int
+		var email, role string
+		var locations pq.Int64Array
+		var usable bool
+		err := tx.QueryRow(`
+            SELECT id, email, role, locations, accepted_at IS NULL AND expires_at > NOW()
+            FROM user_invites WHERE token_hash = $1 FOR UPDATE`, tokenHash).
+			Scan(&inviteID, &email, &role, &locations, &usable)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInviteNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !usable {
+			return ErrInviteExpired
+		}
+
+		var userID int
+		err = tx.QueryRow(
+			"INSERT INTO users (name, email, password, role) VALUES ($1, $2, $3, $4) RETURNING id",
+			name, email, hashedPassword, role,
+		).Scan(&userID)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrUserExists
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+            INSERT INTO user_locations (user_id, location_id)
+            SELECT $1, l.id FROM locations l WHERE l.id = ANY($2)`, userID, locations)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE user_invites SET accepted_at = NOW() WHERE id = $1", inviteID)
+		return err
+	})
+}
+
+// Ссылка для сброса пароля; прежние неиспользованные ссылки пользователя отменяются
+func (p *Provider) AddPasswordReset(userID int, tokenHash string, ttl time.Duration) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL", userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+            INSERT INTO password_resets (user_id, token_hash, expires_at)
+            VALUES ($1, $2, NOW() + $3::float8 * INTERVAL '1 second')`,
+			userID, tokenHash, ttl.Seconds())
+		return err
+	})
+}
+
+// Смена пароля по ссылке; ссылка используется один раз
+func (p *Provider) ResetPassword(tokenHash, hashedPassword string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		var resetID, userID int
+		err := tx.QueryRow(`
+            SELECT r.id, r.user_id FROM password_resets r
+            JOIN users u ON u.id = r.user_id
+            WHERE r.token_hash = $1 AND r.used_at IS NULL AND r.expires_at > NOW() AND u.active
+            FOR UPDATE OF r`, tokenHash).Scan(&resetID, &userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrResetTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE users SET password = $1, sessions_valid_after = date_trunc('second', NOW()) WHERE id = $2", hashedPassword, userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE id = $1", resetID)
+		return err
+	})
+}
+
+func (p *Provider) AddLoginLockout(l LoginLockout) error {
+	_, err := p.conn.Exec(`
+        INSERT INTO login_lockouts (scope, key, ip, attempts, locked_until)
+        VALUES ($1, $2, $3, $4, $5)`,
+		l.Scope, l.Key, l.IP, l.Attempts, l.until)
+	return err
+}
+
+// Последние 200 блокировок входа, сначала новые
+func (p *Provider) FetchLoginLockouts(from, to *time.Time) ([]LoginLockout, error) {
+	where := []string{"TRUE"}
+	var args []interface{}
+	if from != nil {
+		args = append(args, *from)
+		where = append(where, fmt.Sprintf("created_at >= $%d::timestamptz", len(args)))
+	}
+	if to != nil {
+		args = append(args, *to)
+		where = append(where, fmt.Sprintf("created_at < $%d::timestamptz", len(args)))
+	}
+
+	rows, err := p.conn.Query(`
+        SELECT id, scope, key, ip, attempts, locked_until, created_at
+        FROM login_lockouts
+        WHERE `+strings.Join(where, " AND ")+`
+        ORDER BY id DESC LIMIT 200`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []LoginLockout{}
+	for rows.Next() {
+		var l LoginLockout
+		var lockedUntil, createdAt time.Time
+		if err := rows.Scan(&l.ID, &l.Scope, &l.Key, &l.IP, &l.Attempts, &lockedUntil, &createdAt); err != nil {
+			return nil, err
+		}
+		l.LockedUntil = lockedUntil.Format("2006-01-02 15:04:05")
+		l.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventOrderCreated       = "order.created"
+	EventOrderStatusChanged = "order.status_changed"
+
+	// Сколько последних событий хранится для переподключения по Last-Event-ID
+	eventHistorySize = 1000
+	// Буфер канала подписчика; переполненный подписчик отключается
+	subscriberBuffer = 64
+)
+
+var ErrInvalidEventID = errors.New("invalid event id")
+
+type OrderEvent struct {
+	ID         int64     `json:"id"`
+	Epoch      string    `json:"epoch"`
+	Type       string    `json:"type"`
+	OrderID    int       `json:"order_id"`
+	LocationID int       `json:"location_id"`
+	Status     string    `json:"status"`
+	Order      *Order    `json:"order,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Рассылка событий заказов подписчикам с кольцевой историей для догонки.
+// Нумерация событий начинается заново при каждом запуске, поэтому к номеру
+// добавляется эпоха — метка запуска брокера.
+type EventBroker struct {
+	mu          sync.Mutex
+	epoch       string
+	lastID      int64
+	history     []OrderEvent
+	size        int
+	subscribers map[chan OrderEvent]struct{}
+}
+
+func NewEventBroker(size int) *EventBroker {
+	return &EventBroker{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:        size,
+		subscribers: make(map[chan OrderEvent]struct{}),
+	}
+}
+
+func (b *EventBroker) Publish(eventType string, orderID, locationID int, status string, order *Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event := OrderEvent{
+		ID:         b.lastID,
+		Epoch:      b.epoch,
+		Type:       eventType,
+		OrderID:    orderID,
+		LocationID: locationID,
+		Status:     status,
+		Order:      order,
+		CreatedAt:  time.Now(),
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Клиент не успевает читать: закрываем канал, он переподключится с Last-Event-ID
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Подписка на события после lastID эпохи epoch. Возвращает пропущенные события из истории;
+// complete = false, если часть событий уже вытеснена или идентификатор выдан
+// предыдущим запуском сервера и клиенту нужно перечитать заказы.
+func (b *EventBroker) Subscribe(epoch string, lastID int64) (<-chan OrderEvent, []OrderEvent, bool, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []OrderEvent
+	complete := true
+	if lastID > 0 {
+		if epoch != b.epoch || lastID > b.lastID {
+			complete = false
+			lastID = b.lastID
+		} else if len(b.history) > 0 && b.history[0].ID > lastID+1 {
+			complete = false
+		}
+		for _, event := range b.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan OrderEvent, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, missed, complete, cancel
+}
+
+// Идентификатор события для SSE в виде "<эпоха>-<номер>"
+func (e OrderEvent) StreamID() string {
+	return e.Epoch + "-" + strconv.FormatInt(e.ID, 10)
+}
+
+// Разбор Last-Event-ID, выданного StreamID
+func ParseEventID(s string) (string, int64, error) {
+	epoch, seq, ok := strings.Cut(s, "-")
+	if !ok || epoch == "" {
+		return "", 0, ErrInvalidEventID
+	}
+	id, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil || id < 0 {
+		return "", 0, ErrInvalidEventID
+	}
+	return epoch, id, nil
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Типы фискальных документов (признак расчёта по 54-ФЗ)
+const (
+	FiscalSell           = "sell"            // приход
+	FiscalSellRefund     = "sell_refund"     // возврат прихода
+	FiscalSellCorrection = "sell_correction" // коррекция прихода
+)
+
+// Статусы фискальных документов в очереди
+const (
+	FiscalPending   = "pending"
+	FiscalDone      = "done"
+	FiscalFailed    = "failed"
+	FiscalCancelled = "cancelled" // приход, снятый с очереди до отправки из-за отмены заказа
+)
+
+// Ставки НДС
+var FiscalVATRates = map[string]bool{
+	"none": true, "vat0": true, "vat5": true, "vat7": true, "vat10": true, "vat20": true,
+	"vat105": true, "vat107": true, "vat110": true, "vat120": true,
+}
+
+// Признак способа расчёта: полный расчёт
+const FiscalFullPayment = "full_payment"
+
+// Позиция фискального документа: цена и сумма с учётом скидок, ставка НДС,
+// предмет расчёта (commodity, service, …) и способ расчёта
+type FiscalItem struct {
+	Name          string  `json:"name"`
+	Price         float64 `json:"price"`
+	Quantity      float64 `json:"quantity"`
+	Sum           float64 `json:"sum"`
+	VAT           string  `json:"vat"`
+	PaymentObject string  `json:"payment_object"`
+	PaymentMethod string  `json:"payment_method"`
+}
+
+// Суммы по видам оплаты: наличные, безналичные, зачёт аванса (подарочные
+// карты) и встречное предоставление (баллы лояльности)
+type FiscalPayments struct {
+	Cash          float64 `json:"cash"`
+	Electronic    float64 `json:"electronic"`
+	Prepaid       float64 `json:"prepaid"`
+	Consideration float64 `json:"consideration"`
+}
+
+// Основание коррекции: самостоятельно (self) или по предписанию (instruction)
+type FiscalCorrection struct {
+	Type       string `json:"type"`
+	BaseDate   string `json:"base_date"`
+	BaseNumber string `json:"base_number"`
+	Reason     string `json:"reason"`
+}
+
+// Фискальные реквизиты, возвращённые кассой
+type FiscalResult struct {
+	FiscalSign   string    `json:"fiscal_sign"`
+	FiscalNumber string    `json:"fiscal_number"`
+	FNNumber     string    `json:"fn_number"`
+	ShiftNumber  int       `json:"shift_number"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// Фискальный документ по заказу или возврату и его состояние в очереди
+type FiscalDocument struct {
+	ID         int               `json:"id"`
+	OrderID    int               `json:"order_id"`
+	RefundID   *int              `json:"refund_id"`
+	Type       string            `json:"type"`
+	Taxation   string            `json:"taxation"`
+	INN        string            `json:"inn"`
+	Address    string            `json:"payment_address"`
+	Items      []FiscalItem      `json:"items"`
+	Payments   FiscalPayments    `json:"payments"`
+	Total      float64           `json:"total"`
+	Correction *FiscalCorrection `json:"correction,omitempty"`
+
+	Status        string        `json:"status"`
+	Attempts      int           `json:"attempts"`
+	LastError     string        `json:"last_error"`
+	NextAttemptAt time.Time     `json:"next_attempt_at"`
+	Result        *FiscalResult `json:"result"`
+	CreatedAt     string        `json:"created_at"`
+}
+
+var (
+	ErrFiscalDisabled       = errors.New("fiscal registration is disabled")
+	ErrFiscalRejected       = errors.New("fiscal document rejected")
+	ErrFiscalNotFound       = errors.New("fiscal document not found")
+	ErrInvalidFiscalRequest = errors.New("invalid fiscal request")
+)
+
+// Драйвер онлайн-кассы. Ошибка с ErrFiscalRejected означает, что касса
+// отклонила документ и повторять отправку бессмысленно; прочие ошибки
+// считаются временными.
+type FiscalDriver interface {
+	Register(doc FiscalDocument) (FiscalResult, error)
+}
+
+// Проверка настроек фискализации; заполняет значения по умолчанию
+func (cfg *FiscalConfig) Validate() error {
+	if cfg.Driver == "" {
+		return nil
+	}
+	if cfg.Taxation == "" {
+		cfg.Taxation = "osn"
+	}
+	if cfg.VAT == "" {
+		cfg.VAT = "none"
+	}
+	if !FiscalVATRates[cfg.VAT] {
+		return fmt.Errorf("fiscal: unknown vat rate %q", cfg.VAT)
+	}
+	for category, vat := range cfg.VATByCategory {
+		if !FiscalVATRates[vat] {
+			return fmt.Errorf("fiscal: unknown vat rate %q for category %q", vat, category)
+		}
+	}
+	if cfg.PaymentObject == "" {
+		cfg.PaymentObject = "commodity"
+	}
+	switch cfg.IssueOn {
+	case "":
+		cfg.IssueOn = FiscalOnCreated
+	case FiscalOnCreated, FiscalOnCompleted:
+	default:
+		return fmt.Errorf("fiscal: issue_on must be %s or %s", FiscalOnCreated, FiscalOnCompleted)
+	}
+	if cfg.RetrySeconds <= 0 {
+		cfg.RetrySeconds = 30
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 20
+	}
+	return nil
+}
+
+// Момент пробития чека прихода: при оформлении или при выдаче заказа
+const (
+	FiscalOnCreated   = "created"
+	FiscalOnCompleted = "completed"
+)
+
+// Драйвер по настройкам; nil, если фискализация выключена
+func NewFiscalDriver(cfg FiscalConfig) (FiscalDriver, error) {
+	switch cfg.Driver {
+	case "":
+		return nil, nil
+	case "stub":
+		return &stubFiscalDriver{}, nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, errors.New("fiscal: url is required for http driver")
+		}
+		timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		return &httpFiscalDriver{url: strings.TrimRight(cfg.URL, "/"), token: cfg.Token, client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, fmt.Errorf("fiscal: unknown driver %q", cfg.Driver)
+}
+
+// Драйвер HTTP-шлюза кассы: POST {url}/documents с документом в JSON,
+// в ответ ожидаются фискальные реквизиты. Подходит для тестового сервера-заглушки.
+type httpFiscalDriver struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (d *httpFiscalDriver) Register(doc FiscalDocument) (FiscalResult, error) {
+	body, err := json.Marshal(struct {
+		ExternalID string `json:"external_id"`
+		FiscalDocument
+	}{fmt.Sprintf("doc-%d", doc.ID), doc})
+	if err != nil {
+		return FiscalResult{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.url+"/documents", bytes.NewReader(body))
+	if err != nil {
+		return FiscalResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return FiscalResult{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		var msg struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&msg)
+		return FiscalResult{}, fmt.Errorf("%w: %s %s", ErrFiscalRejected, resp.Status, msg.Error)
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated:
+		return FiscalResult{}, fmt.Errorf("fiscal gateway: %s", resp.Status)
+	}
+
+	var result FiscalResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return FiscalResult{}, err
+	}
+	if result.FiscalSign == "" || result.FiscalNumber == "" {
+		return FiscalResult{}, errors.New("fiscal gateway: empty fiscal sign or number")
+	}
+	return result, nil
+}
+
+// Заглушка для разработки: выдаёт правдоподобные реквизиты без кассы
+type stubFiscalDriver struct {
+	mu     sync.Mutex
+	number int
+}
+
+func (d *stubFiscalDriver) Register(doc FiscalDocument) (FiscalResult, error) {
+	d.mu.Lock()
+	d.number++
+	number := d.number
+	d.mu.Unlock()
+
+	sign, err := rand.Int(rand.Reader, big.NewInt(1e10))
+	if err != nil {
+		return FiscalResult{}, err
+	}
+	return FiscalResult{
+		FiscalSign:   fmt.Sprintf("%010d", sign.Int64()),
+		FiscalNumber: fmt.Sprint(number),
+		FNNumber:     "9999078900000000",
+		ShiftNumber:  1,
+		RegisteredAt: time.Now(),
+	}, nil
+}
+
+func (u *Usecase) fiscalEnabled() bool {
+	return u.fiscalDriver != nil
+}
+
+func (u *Usecase) fiscalVAT(category string) string {
+	if vat, ok := u.fiscal.VATByCategory[category]; ok {
+		return vat
+	}
+	return u.fiscal.VAT
+}
+
+func (u *Usecase) newFiscalDocument(docType string, orderID int) FiscalDocument {
+	return FiscalDocument{
+		OrderID:  orderID,
+		Type:     docType,
+		Taxation: u.fiscal.Taxation,
+		INN:      u.receipt.TaxID,
+		Address:  u.receipt.Address,
+		Items:    []FiscalItem{},
+	}
+}
+
+// Раскладка суммы по видам оплаты: баллы и подарочные карты выделяются,
+// остаток относится к основному способу оплаты
+func fiscalPayments(total, points, giftCards float64, method string) FiscalPayments {
+	payments := FiscalPayments{Prepaid: giftCards, Consideration: points}
+	rest := roundMoney(total - points - giftCards)
+	if method == PaymentCard {
+		payments.Electronic = rest
+	} else {
+		payments.Cash = rest
+	}
+	return payments
+}
+
+// Заказ за вычетом возвратов: невозвращённые количества позиций
+// и оставшиеся суммы заказа, оплаты баллами и подарочными картами
+func (u *Usecase) netOrder(order Order) (Order, error) {
+	refunds, err := u.p.FetchRefunds(order.ID)
+	if err != nil {
+		return Order{}, err
+	}
+	refunded := make(map[int]int)
+	for _, refund := range refunds {
+		order.Total -= refund.Amount
+		order.PointsAmount -= refund.PointsAmount
+		order.GiftCardAmount -= refund.GiftCardAmount
+		for _, item := range refund.Items {
+			refunded[item.OrderItemId] += item.Quantity
+		}
+	}
+	order.Total = roundMoney(order.Total)
+	order.PointsAmount = roundMoney(order.PointsAmount)
+	order.GiftCardAmount = roundMoney(order.GiftCardAmount)
+
+	items := make([]OrderItem, 0, len(order.Items))
+	for _, item := range order.Items {
+		item.Quantity -= refunded[item.ID]
+		if item.Quantity > 0 {
+			items = append(items, item)
+		}
+	}
+	order.Items = items
+	return order, nil
+}
+
+// Документ прихода (или коррекции прихода) по позициям заказа за вычетом
+// возвратов. Тот же документ с типом sell_refund возвращает остаток заказа при отмене.
+func (u *Usecase) buildSaleDocument(docType string, order Order) (FiscalDocument, error) {
+	order, err := u.netOrder(order)
+	if err != nil {
+		return FiscalDocument{}, err
+	}
+	menu, err := u.p.FetchMenuItems(0)
+	if err != nil {
+		return FiscalDocument{}, err
+	}
+	byID := make(map[int]MenuItem, len(menu))
+	for _, item := range menu {
+		byID[item.ID] = item
+	}
+
+	doc := u.newFiscalDocument(docType, order.ID)
+	for _, item := range order.Items {
+		m, ok := byID[item.MenuItemId]
+		if !ok {
+			m.Name = fmt.Sprintf("Позиция #%d", item.MenuItemId)
+		}
+		doc.Items = append(doc.Items, FiscalItem{
+			Name:          m.Name,
+			Price:         item.Price,
+			Quantity:      float64(item.Quantity),
+			Sum:           roundMoney(item.Price * float64(item.Quantity)),
+			VAT:           u.fiscalVAT(m.Category),
+			PaymentObject: u.fiscal.PaymentObject,
+			PaymentMethod: FiscalFullPayment,
+		})
+	}
+	doc.Total = order.Total
+	doc.Payments = fiscalPayments(order.Total, order.PointsAmount, order.GiftCardAmount, order.PaymentMethod)
+	return doc, nil
+}
+
+// Документ возврата прихода по возвращённым позициям
+func (u *Usecase) buildRefundDocument(order Order, refund Refund) (FiscalDocument, error) {
+	menu, err := u.p.FetchMenuItems(0)
+	if err != nil {
+		return FiscalDocument{}, err
+	}
+	byID := make(map[int]MenuItem, len(menu))
+	for _, item := range menu {
+		byID[item.ID] = item
+	}
+	lines := make(map[int]OrderItem, len(order.Items))
+	for _, item := range order.Items {
+		lines[item.ID] = item
+	}
+
+	doc := u.newFiscalDocument(FiscalSellRefund, order.ID)
+	refundID := refund.ID
+	doc.RefundID = &refundID
+	for _, item := range refund.Items {
+		line := lines[item.OrderItemId]
+		m, ok := byID[line.MenuItemId]
+		if !ok {
+			m.Name = fmt.Sprintf("Позиция #%d", line.MenuItemId)
+		}
+		price := item.Amount
+		if item.Quantity > 0 {
+			price = roundMoney(item.Amount / float64(item.Quantity))
+		}
+		doc.Items = append(doc.Items, FiscalItem{
+			Name:          m.Name,
+			Price:         price,
+			Quantity:      float64(item.Quantity),
+			Sum:           item.Amount,
+			VAT:           u.fiscalVAT(m.Category),
+			PaymentObject: u.fiscal.PaymentObject,
+			PaymentMethod: FiscalFullPayment,
+		})
+	}
+	doc.Total = refund.Amount
+	doc.Payments = fiscalPayments(refund.Amount, refund.PointsAmount, refund.GiftCardAmount, order.PaymentMethod)
+	return doc, nil
+}
+
+// Постановка чека прихода по заказу в очередь; повторный вызов
+// возвращает уже созданный документ
+func (u *Usecase) FiscalizeOrder(orderID int) (FiscalDocument, error) {
+	if !u.fiscalEnabled() {
+		return FiscalDocument{}, ErrFiscalDisabled
+	}
+	order, err := u.p.FetchOrder(orderID)
+	if err != nil {
+		return FiscalDocument{}, err
+	}
+	if order.Status == "Отменен" {
+		return FiscalDocument{}, fmt.Errorf("%w: order is cancelled", ErrInvalidFiscalRequest)
+	}
+	doc, err := u.buildSaleDocument(FiscalSell, order)
+	if err != nil {
+		return FiscalDocument{}, err
+	}
+	return u.p.AddFiscalDocument(doc)
+}
+
+// Чек коррекции прихода по заказу, например если продажа не была пробита
+func (u *Usecase) CorrectOrderFiscal(orderID int, correction FiscalCorrection) (FiscalDocument, error) {
+	if !u.fiscalEnabled() {
+		return FiscalDocument{}, ErrFiscalDisabled
+	}
+	if correction.Type != "self" && correction.Type != "instruction" {
+		return FiscalDocument{}, fmt.Errorf("%w: correction type must be self or instruction", ErrInvalidFiscalRequest)
+	}
+	if _, err := time.Parse("2006-01-02", correction.BaseDate); err != nil {
+		return FiscalDocument{}, fmt.Errorf("%w: invalid base date", ErrInvalidFiscalRequest)
+	}
+	if correction.Type == "instruction" && correction.BaseNumber == "" {
+		return FiscalDocument{}, fmt.Errorf("%w: instruction number is required", ErrInvalidFiscalRequest)
+	}
+
+	order, err := u.p.FetchOrder(orderID)
+	if err != nil {
+		return FiscalDocument{}, err
+	}
+	doc, err := u.buildSaleDocument(FiscalSellCorrection, order)
+	if err != nil {
+		return FiscalDocument{}, err
+	}
+	doc.Correction = &correction
+	return u.p.AddFiscalDocument(doc)
+}
+
+// Автоматическая фискализация после оформления или выдачи заказа
+// в зависимости от настройки issue_on; ошибки только логируются
+func (u *Usecase) fiscalizeOnStatus(orderID int, event string) {
+	if !u.fiscalEnabled() || u.fiscal.IssueOn != event {
+		return
+	}
+	if _, err := u.FiscalizeOrder(orderID); err != nil {
+		log.Printf("Error queueing fiscal receipt for order %d: %v", orderID, err)
+	}
+}
+
+// Отмена заказа: ещё не отправленный приход снимается с очереди, а если
+// приход уже мог попасть в кассу — ставится возврат прихода на остаток заказа
+func (u *Usecase) fiscalizeCancel(orderID int) {
+	if !u.fiscalEnabled() {
+		return
+	}
+	if err := u.queueFiscalCancel(orderID); err != nil {
+		log.Printf("Error queueing fiscal cancel for order %d: %v", orderID, err)
+	}
+}
+
+func (u *Usecase) queueFiscalCancel(orderID int) error {
+	dropped, err := u.p.CancelPendingFiscalSale(orderID)
+	if err != nil || dropped {
+		return err
+	}
+	sold, err := u.p.HasFiscalSale(orderID)
+	if err != nil || !sold {
+		return err
+	}
+	order, err := u.p.FetchOrder(orderID)
+	if err != nil {
+		return err
+	}
+	doc, err := u.buildSaleDocument(FiscalSellRefund, order)
+	if err != nil {
+		return err
+	}
+	// Всё уже возвращено отдельными чеками
+	if len(doc.Items) == 0 || doc.Total <= 0 {
+		return nil
+	}
+	_, err = u.p.AddFiscalDocument(doc)
+	return err
+}
+
+// Чек возврата прихода; по заказу без пробитого прихода чек возврата не нужен
+func (u *Usecase) fiscalizeRefund(refund Refund) {
+	if !u.fiscalEnabled() {
+		return
+	}
+	if err := u.queueFiscalRefund(refund); err != nil {
+		log.Printf("Error queueing fiscal refund for refund %d: %v", refund.ID, err)
+	}
+}
+
+func (u *Usecase) queueFiscalRefund(refund Refund) error {
+	sold, err := u.p.HasFiscalSale(refund.OrderID)
+	if err != nil || !sold {
+		return err
+	}
+	order, err := u.p.FetchOrder(refund.OrderID)
+	if err != nil {
+		return err
+	}
+	doc, err := u.buildRefundDocument(order, refund)
+	if err != nil {
+		return err
+	}
+	_, err = u.p.AddFiscalDocument(doc)
+	return err
+}
+
+func (u *Usecase) GetOrderFiscal(orderID int) ([]FiscalDocument, error) {
+	return u.p.FetchFiscalDocuments(orderID, "")
+}
+
+// Очередь фискальных документов по статусу; пустой status — все последние
+func (u *Usecase) GetFiscalQueue(status string) ([]FiscalDocument, error) {
+	return u.p.FetchFiscalDocuments(0, status)
+}
+
+func (u *Usecase) RetryFiscalDocument(id int) (FiscalDocument, error) {
+	return u.p.RetryFiscalDocument(id)
+}
+
+// Отправка документов в кассу с повторами: пауза удваивается с каждой
+// попыткой, после MaxAttempts или отказа кассы документ помечается failed
+func (u *Usecase) RunFiscalQueue(interval time.Duration) {
+	if !u.fiscalEnabled() {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Документы уходят по одному в порядке создания: касса последовательна
+		docs, err := u.p.ClaimFiscalDocuments(10, 2*time.Minute)
+		if err != nil {
+			log.Printf("Error claiming fiscal documents: %v", err)
+			continue
+		}
+
+		for _, doc := range docs {
+			result, err := u.fiscalDriver.Register(doc)
+			if err == nil {
+				err = u.p.CompleteFiscalDocument(doc.ID, result)
+			} else {
+				log.Printf("Error registering fiscal document %d: %v", doc.ID, err)
+				var retryAt *time.Time
+				if !errors.Is(err, ErrFiscalRejected) && doc.Attempts < u.fiscal.MaxAttempts {
+					delay := time.Duration(u.fiscal.RetrySeconds) * time.Second << min(doc.Attempts-1, 8)
+					next := time.Now().Add(delay)
+					retryAt = &next
+				}
+				err = u.p.FailFiscalDocument(doc.ID, err.Error(), retryAt)
+			}
+			if err != nil {
+				log.Printf("Error updating fiscal document %d: %v", doc.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Часовой пояс по умолчанию, если в конфигурации он не задан
+const DefaultTimezone = "Europe/Moscow"
+
+// Часы работы на один день; Closed означает выходной
+type DayHours struct {
+	Open   time.Duration
+	Close  time.Duration
+	Closed bool
+}
+
+// Расписание работы кафе и граница рабочего дня. Всё, что происходит до
+// Cutoff, относится к предыдущему рабочему дню: заказ в 01:00 попадает
+// в выручку вчерашнего вечера. Часы и даты считаются в часовом поясе Location.
+type BusinessHours struct {
+	Location *time.Location
+	Cutoff   time.Duration
+	Weekly   map[time.Weekday]DayHours
+	Holidays map[string]DayHours
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+	"sun": time.Sunday,
+}
+
+func NewBusinessHours(cfg BusinessConfig) (*BusinessHours, error) {
+	h := &BusinessHours{
+		Weekly:   make(map[time.Weekday]DayHours),
+		Holidays: make(map[string]DayHours),
+	}
+
+	timezone := cfg.Timezone
+	if timezone == "" {
+		timezone = DefaultTimezone
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("timezone: %v", err)
+	}
+	h.Location = loc
+
+	if cfg.DayCutoff != "" {
+		cutoff, err := parseClock(cfg.DayCutoff)
+		if err != nil {
+			return nil, fmt.Errorf("day_cutoff: %v", err)
+		}
+		h.Cutoff = cutoff
+	}
+
+	for name, hours := range cfg.OpeningHours {
+		day, ok := weekdayNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("opening_hours: unknown weekday %q", name)
+		}
+		dh, err := parseDayHours(hours)
+		if err != nil {
+			return nil, fmt.Errorf("opening_hours.%s: %v", name, err)
+		}
+		h.Weekly[day] = dh
+	}
+
+	for _, holiday := range cfg.Holidays {
+		if _, err := time.Parse("2006-01-02", holiday.Date); err != nil {
+			return nil, fmt.Errorf("holidays: invalid date %q", holiday.Date)
+		}
+		dh, err := parseDayHours(holiday.HoursConfig)
+		if err != nil {
+			return nil, fmt.Errorf("holidays.%s: %v", holiday.Date, err)
+		}
+		h.Holidays[holiday.Date] = dh
+	}
+
+	return h, nil
+}
+
+func parseDayHours(cfg HoursConfig) (DayHours, error) {
+	if cfg.Closed {
+		return DayHours{Closed: true}, nil
+	}
+	open, err := parseClock(cfg.Open)
+	if err != nil {
+		return DayHours{}, fmt.Errorf("open: %v", err)
+	}
+	closeAt, err := parseClock(cfg.Close)
+	if err != nil {
+		return DayHours{}, fmt.Errorf("close: %v", err)
+	}
+	return DayHours{Open: open, Close: closeAt}, nil
+}
+
+// Время суток в формате HH:MM
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// То же расписание в другом часовом поясе: часы работы и граница дня
+// отсчитываются по местному времени точки
+func (h *BusinessHours) In(loc *time.Location) *BusinessHours {
+	c := *h
+	c.Location = loc
+	return &c
+}
+
+// Текущий момент в часовом поясе кафе
+func (h *BusinessHours) Now() time.Time {
+	return time.Now().In(h.Location)
+}
+
+// Начало рабочего дня, к которому относится момент t, в часовом поясе t
+func (h *BusinessHours) DayStart(t time.Time) time.Time {
+	shifted := t.Add(-h.Cutoff)
+	midnight := time.Date(shifted.Year(), shifted.Month(), shifted.Day(), 0, 0, 0, 0, t.Location())
+	return midnight.Add(h.Cutoff)
+}
+
+// Дата рабочего дня в формате YYYY-MM-DD
+func (h *BusinessHours) BusinessDate(t time.Time) string {
+	return t.In(h.Location).Add(-h.Cutoff).Format("2006-01-02")
+}
+
+// Часы работы для рабочего дня; ok = false, если расписание не задано
+func (h *BusinessHours) hoursFor(t time.Time) (DayHours, bool) {
+	t = t.In(h.Location)
+	if dh, ok := h.Holidays[h.BusinessDate(t)]; ok {
+		return dh, true
+	}
+	if len(h.Weekly) == 0 {
+		return DayHours{}, false
+	}
+	dh, ok := h.Weekly[t.Add(-h.Cutoff).Weekday()]
+	if !ok {
+		return DayHours{Closed: true}, true
+	}
+	return dh, true
+}
+
+// Открыто ли кафе в момент t. Без расписания кафе считается открытым всегда.
+// Время раньше границы дня относится к следующим суткам, поэтому работа
+// до 02:00 задаётся как close: "02:00".
+func (h *BusinessHours) IsOpen(t time.Time) bool {
+	t = t.In(h.Location)
+	dh, ok := h.hoursFor(t)
+	if !ok {
+		return true
+	}
+	if dh.Closed {
+		return false
+	}
+
+	midnight := h.DayStart(t).Add(-h.Cutoff)
+	open := midnight.Add(h.afterCutoff(dh.Open))
+	closeAt := midnight.Add(h.afterCutoff(dh.Close))
+	if !closeAt.After(open) {
+		closeAt = closeAt.Add(24 * time.Hour)
+	}
+
+	return !t.Before(open) && t.Before(closeAt)
+}
+
+func (h *BusinessHours) afterCutoff(clock time.Duration) time.Duration {
+	if clock < h.Cutoff {
+		return clock + 24*time.Hour
+	}
+	return clock
+}
+
+// Время открытия и закрытия в рабочий день date (YYYY-MM-DD) в часовом поясе
+// кафе; closed = true в выходной. Без расписания рабочим считается весь день.
+func (h *BusinessHours) OpeningWindow(date string) (open, closeAt time.Time, closed bool, err error) {
+	midnight, err := time.ParseInLocation("2006-01-02", date, h.Location)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	dayStart := midnight.Add(h.Cutoff)
+
+	dh, ok := h.hoursFor(dayStart)
+	if !ok {
+		return dayStart, dayStart.Add(24 * time.Hour), false, nil
+	}
+	if dh.Closed {
+		return time.Time{}, time.Time{}, true, nil
+	}
+
+	open = midnight.Add(h.afterCutoff(dh.Open))
+	closeAt = midnight.Add(h.afterCutoff(dh.Close))
+	if !closeAt.After(open) {
+		closeAt = closeAt.Add(24 * time.Hour)
+	}
+	return open, closeAt, false, nil
+}
@@ -2,16 +2,24 @@ package main
 
 import (
 	"backend/pkg/vars"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func (j *JWTProvider) GenerateToken(username string) (string, error) {
+func (j *JWTProvider) GenerateToken(user UserAccess) (string, error) {
 	claims := vars.JWTClaims{
-		Username: username,
+		UserID:    user.ID,
+		Username:  user.Name,
+		Role:      user.Role,
+		Locations: user.Locations,
 		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(1 * time.Hour)),
 		},
 	}
@@ -33,6 +41,36 @@ func (j *JWTProvider) ValidateToken(tokenString string) (*vars.JWTClaims, error)
 	return claims, nil
 }
 
+// Время жизни билета на ленту событий: только чтобы успеть открыть соединение
+const streamTicketTTL = 30 * time.Second
+
+// Отдельный ключ для билетов, чтобы билет нельзя было использовать как обычный токен
+func (j *JWTProvider) streamKey() []byte {
+	mac := hmac.New(sha256.New, []byte(j.secretKey))
+	mac.Write([]byte("stream"))
+	return mac.Sum(nil)
+}
+
+// Билет на ленту событий с правами пользователя из токена. Время выдачи
+// сохраняется, чтобы отзыв сессий распространялся и на билеты.
+func (j *JWTProvider) StreamTicket(user *vars.JWTClaims) (string, error) {
+	claims := *user
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(streamTicketTTL))
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(j.streamKey())
+}
+
+// Подпись заказа для отзыва без входа в систему; печатается на чеке
+func (j *JWTProvider) FeedbackToken(orderID int) string {
+	mac := hmac.New(sha256.New, []byte(j.secretKey))
+	mac.Write([]byte("feedback:" + strconv.Itoa(orderID)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (j *JWTProvider) ValidFeedbackToken(orderID int, token string) bool {
+	return hmac.Equal([]byte(j.FeedbackToken(orderID)), []byte(token))
+}
+
 type JWTProvider struct {
 	secretKey string
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Области счётчиков неудачных входов
+const (
+	LockoutAccount = "account"
+	LockoutIP      = "ip"
+)
+
+// Блокировка входа, сохраняемая для просмотра владельцем
+type LoginLockout struct {
+	ID          int    `json:"id"`
+	Scope       string `json:"scope"`
+	Key         string `json:"key"`
+	IP          string `json:"ip"`
+	Attempts    int    `json:"attempts"`
+	LockedUntil string `json:"locked_until"`
+	CreatedAt   string `json:"created_at"`
+
+	until time.Time
+}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// Вход временно запрещён; время до следующей попытки — в LoginThrottledError
+	ErrLoginThrottled = errors.New("too many login attempts")
+)
+
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return ErrLoginThrottled.Error()
+}
+
+func (e *LoginThrottledError) Unwrap() error {
+	return ErrLoginThrottled
+}
+
+// Неудачные попытки по одному ключу: учётной записи или IP. inflight —
+// попытки, пропущенные Allow, но ещё не завершённые.
+type loginCounter struct {
+	failures     int
+	inflight     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool
+}
+
+// Ограничитель попыток входа. После Free неудач подряд каждая следующая
+// попытка откладывается на экспоненциально растущую паузу, после Lockout
+// неудач ключ блокируется на LockoutTime. Счётчик сбрасывается успешным
+// входом (только для учётной записи) или после ResetAfter без неудач.
+// Allow занимает место попытки, и оно считается вместе с неудачами: сверх
+// Free одновременно проверяется не больше одной попытки на ключ, поэтому
+// параллельные запросы не обходят паузы. Место освобождают Failure,
+// Success или Release. Счётчики хранятся в памяти процесса.
+type LoginLimiter struct {
+	mu       sync.Mutex
+	cfg      LoginLimitConfig
+	now      func() time.Time
+	counters map[string]*loginCounter
+}
+
+// Сверх этого числа ключей устаревшие счётчики удаляются при записи
+const loginLimiterSweepSize = 10000
+
+// Проверка настроек ограничителя и значения по умолчанию
+func (cfg *LoginLimitConfig) Validate() error {
+	if cfg.AccountFree <= 0 {
+		cfg.AccountFree = 3
+	}
+	if cfg.AccountLockout == 0 {
+		cfg.AccountLockout = 10
+	}
+	if cfg.IPFree <= 0 {
+		cfg.IPFree = 10
+	}
+	if cfg.IPLockout == 0 {
+		cfg.IPLockout = 50
+	}
+	if cfg.AccountLockout > 0 && cfg.AccountLockout <= cfg.AccountFree ||
+		cfg.IPLockout > 0 && cfg.IPLockout <= cfg.IPFree {
+		return errors.New("login limit: lockout threshold must be greater than free attempts")
+	}
+	if cfg.BaseDelaySeconds <= 0 {
+		cfg.BaseDelaySeconds = 1
+	}
+	if cfg.MaxDelaySeconds <= 0 {
+		cfg.MaxDelaySeconds = 60
+	}
+	if cfg.LockoutMinutes <= 0 {
+		cfg.LockoutMinutes = 15
+	}
+	if cfg.ResetAfterMinutes <= 0 {
+		cfg.ResetAfterMinutes = 60
+	}
+	return nil
+}
+
+func NewLoginLimiter(cfg LoginLimitConfig) *LoginLimiter {
+	return &LoginLimiter{cfg: cfg, now: time.Now, counters: make(map[string]*loginCounter)}
+}
+
+func normalizeLogin(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (l *LoginLimiter) keys(email, ip string) [2]string {
+	return [2]string{LockoutAccount + ":" + normalizeLogin(email), LockoutIP + ":" + ip}
+}
+
+// Счётчик ключа; просроченный счётчик забывается
+func (l *LoginLimiter) counter(key string, now time.Time) *loginCounter {
+	c, ok := l.counters[key]
+	if !ok {
+		return nil
+	}
+	if c.inflight == 0 && now.After(c.blockedUntil) && now.Sub(c.lastFailure) >= l.cfg.resetAfter() {
+		delete(l.counters, key)
+		return nil
+	}
+	return c
+}
+
+func (l *LoginLimiter) free(i int) int {
+	if i == 1 {
+		return l.cfg.IPFree
+	}
+	return l.cfg.AccountFree
+}
+
+// Можно ли сейчас проверять пароль; иначе *LoginThrottledError. Разрешённая
+// попытка занимает место до вызова Failure, Success или Release.
+func (l *LoginLimiter) Allow(email, ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	keys := l.keys(email, ip)
+	var wait time.Duration
+	for i, key := range keys {
+		c := l.counter(key, now)
+		if c == nil {
+			continue
+		}
+		d := c.blockedUntil.Sub(now)
+		if d <= 0 && c.inflight > 0 && c.failures+c.inflight >= l.free(i) {
+			// Бесплатные попытки заняты: следующая ждёт результата текущей
+			d = l.cfg.backoff(1)
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return &LoginThrottledError{RetryAfter: wait}
+	}
+
+	for _, key := range keys {
+		c, ok := l.counters[key]
+		if !ok {
+			c = &loginCounter{}
+			l.counters[key] = c
+		}
+		c.inflight++
+	}
+	return nil
+}
+
+// Освобождение места попытки без учёта неудачи, например при ошибке базы
+func (l *LoginLimiter) Release(email, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range l.keys(email, ip) {
+		l.release(key)
+	}
+}
+
+func (l *LoginLimiter) release(key string) *loginCounter {
+	c, ok := l.counters[key]
+	if !ok {
+		return nil
+	}
+	if c.inflight > 0 {
+		c.inflight--
+	}
+	if c.inflight == 0 && c.failures == 0 {
+		delete(l.counters, key)
+		return nil
+	}
+	return c
+}
+
+// Учёт неудачной попытки. Возвращает блокировки, начавшиеся этой попыткой.
+func (l *LoginLimiter) Failure(email, ip string) []LoginLockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.counters) > loginLimiterSweepSize {
+		for key := range l.counters {
+			l.counter(key, now)
+		}
+	}
+
+	var lockouts []LoginLockout
+	for i, key := range l.keys(email, ip) {
+		free, lockout := l.free(i), l.cfg.AccountLockout
+		if i == 1 {
+			lockout = l.cfg.IPLockout
+		}
+
+		if c, ok := l.counters[key]; ok && c.inflight > 0 {
+			c.inflight--
+		}
+		c := l.counter(key, now)
+		if c == nil {
+			c = &loginCounter{}
+			l.counters[key] = c
+		}
+		if c.locked && !now.Before(c.blockedUntil) {
+			// Блокировка истекла, следующая будет записана заново
+			c.locked = false
+		}
+		c.failures++
+		c.lastFailure = now
+
+		switch {
+		case lockout > 0 && c.failures >= lockout:
+			c.blockedUntil = now.Add(l.cfg.lockoutTime())
+			if !c.locked {
+				c.locked = true
+				scope, value, _ := strings.Cut(key, ":")
+				lockouts = append(lockouts, LoginLockout{
+					Scope:    scope,
+					Key:      value,
+					IP:       ip,
+					Attempts: c.failures,
+					until:    c.blockedUntil,
+				})
+			}
+		case c.failures > free:
+			c.blockedUntil = now.Add(l.cfg.backoff(c.failures - free))
+		}
+	}
+	return lockouts
+}
+
+// Успешный вход сбрасывает счётчик учётной записи; счётчик IP остаётся,
+// чтобы вход в свою учётную запись не обнулял перебор чужих
+func (l *LoginLimiter) Success(email, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := l.keys(email, ip)
+	if c := l.counters[keys[0]]; c != nil {
+		// Места других попыток к этой учётной записи остаются занятыми
+		c.failures, c.blockedUntil, c.locked = 0, time.Time{}, false
+	}
+	for _, key := range keys {
+		l.release(key)
+	}
+}
+
+// Пауза после n-й неудачи сверх бесплатных: base, 2·base, 4·base… не больше max
+func (cfg LoginLimitConfig) backoff(n int) time.Duration {
+	base := time.Duration(cfg.BaseDelaySeconds) * time.Second
+	max := time.Duration(cfg.MaxDelaySeconds) * time.Second
+	if n > 30 {
+		n = 30
+	}
+	d := base << (n - 1)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d
+}
+
+func (cfg LoginLimitConfig) lockoutTime() time.Duration {
+	return time.Duration(cfg.LockoutMinutes) * time.Minute
+}
+
+func (cfg LoginLimitConfig) resetAfter() time.Duration {
+	return time.Duration(cfg.ResetAfterMinutes) * time.Minute
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Часы, которые двигает сам тест
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(t *testing.T, cfg LoginLimitConfig) (*LoginLimiter, *fakeClock) {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	clock := &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewLoginLimiter(cfg)
+	l.now = clock.now
+	return l, clock
+}
+
+func retryAfter(t *testing.T, err error) time.Duration {
+	t.Helper()
+	var throttled *LoginThrottledError
+	if !errors.As(err, &throttled) {
+		t.Fatalf("expected LoginThrottledError, got %v", err)
+	}
+	if !errors.Is(err, ErrLoginThrottled) {
+		t.Fatalf("error does not wrap ErrLoginThrottled: %v", err)
+	}
+	return throttled.RetryAfter
+}
+
+func TestLoginLimiterFreeAttempts(t *testing.T) {
+	l, _ := newTestLimiter(t, LoginLimitConfig{AccountFree: 3})
+
+	for i := 0; i < 3; i++ {
+		if err := l.Allow("user@example.com", "10.0.0.1"); err != nil {
+			t.Fatalf("attempt %d: unexpected throttle: %v", i+1, err)
+		}
+		l.Failure("user@example.com", "10.0.0.1")
+	}
+	if err := l.Allow("user@example.com", "10.0.0.1"); err != nil {
+		t.Fatalf("free attempts must not be delayed: %v", err)
+	}
+}
+
+func TestLoginLimiterExponentialBackoff(t *testing.T) {
+	l, clock := newTestLimiter(t, LoginLimitConfig{
+		AccountFree:      2,
+		AccountLockout:   -1,
+		IPLockout:        -1,
+		BaseDelaySeconds: 1,
+		MaxDelaySeconds:  8,
+	})
+
+	for i := 0; i < 2; i++ {
+		l.Failure("user@example.com", "10.0.0.1")
+	}
+
+	want := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for i, delay := range want {
+		l.Failure("user@example.com", "10.0.0.1")
+		if got := retryAfter(t, l.Allow("user@example.com", "10.0.0.1")); got != delay {
+			t.Fatalf("failure %d: retry after %v, want %v", i+3, got, delay)
+		}
+		clock.advance(delay)
+		if err := l.Allow("user@example.com", "10.0.0.1"); err != nil {
+			t.Fatalf("failure %d: still throttled after the delay: %v", i+3, err)
+		}
+	}
+}
+
+func TestLoginLimiterAccountLockout(t *testing.T) {
+	l, clock := newTestLimiter(t, LoginLimitConfig{
+		AccountFree:    2,
+		AccountLockout: 5,
+		LockoutMinutes: 15,
+	})
+
+	var lockouts []LoginLockout
+	for i := 0; i < 5; i++ {
+		clock.advance(time.Minute)
+		lockouts = append(lockouts, l.Failure("User@Example.com ", "10.0.0.1")...)
+	}
+	if len(lockouts) != 1 {
+		t.Fatalf("got %d lockouts, want 1: %+v", len(lockouts), lockouts)
+	}
+	got := lockouts[0]
+	if got.Scope != LockoutAccount || got.Key != "user@example.com" || got.IP != "10.0.0.1" || got.Attempts != 5 {
+		t.Fatalf("unexpected lockout: %+v", got)
+	}
+	if !got.until.Equal(clock.t.Add(15 * time.Minute)) {
+		t.Fatalf("locked until %v, want %v", got.until, clock.t.Add(15*time.Minute))
+	}
+
+	// Блокировка действует для учётной записи с любого адреса
+	if d := retryAfter(t, l.Allow("user@example.com", "10.0.0.2")); d != 15*time.Minute {
+		t.Fatalf("retry after %v, want 15m", d)
+	}
+	// Другие учётные записи с других адресов не затронуты
+	if err := l.Allow("other@example.com", "10.0.0.2"); err != nil {
+		t.Fatalf("other account throttled: %v", err)
+	}
+
+	clock.advance(15 * time.Minute)
+	if err := l.Allow("user@example.com", "10.0.0.1"); err != nil {
+		t.Fatalf("lockout did not expire: %v", err)
+	}
+
+	// Неудача сразу после блокировки снова блокирует и записывается заново
+	lockouts = l.Failure("user@example.com", "10.0.0.1")
+	if len(lockouts) != 1 || lockouts[0].Attempts != 6 {
+		t.Fatalf("expected a new lockout after expiry, got %+v", lockouts)
+	}
+}
+
+func TestLoginLimiterIPCounterSpansAccounts(t *testing.T) {
+	l, _ := newTestLimiter(t, LoginLimitConfig{
+		AccountFree: 3,
+		IPFree:      3,
+		IPLockout:   6,
+	})
+
+	var lockouts []LoginLockout
+	emails := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com", "f@example.com"}
+	for _, email := range emails {
+		lockouts = append(lockouts, l.Failure(email, "10.0.0.1")...)
+	}
+	if len(lockouts) != 1 || lockouts[0].Scope != LockoutIP || lockouts[0].Key != "10.0.0.1" {
+		t.Fatalf("expected one IP lockout, got %+v", lockouts)
+	}
+
+	// Перебор разных учётных записей с одного адреса блокирует адрес
+	retryAfter(t, l.Allow("new@example.com", "10.0.0.1"))
+	// Те же учётные записи с другого адреса доступны: каждая ошиблась один раз
+	if err := l.Allow("a@example.com", "10.0.0.2"); err != nil {
+		t.Fatalf("account throttled from another address: %v", err)
+	}
+}
+
+func TestLoginLimiterSuccessResetsAccountOnly(t *testing.T) {
+	l, _ := newTestLimiter(t, LoginLimitConfig{
+		AccountFree: 1,
+		IPFree:      2,
+		IPLockout:   -1,
+	})
+
+	l.Failure("user@example.com", "10.0.0.1")
+	l.Failure("user@example.com", "10.0.0.1")
+	retryAfter(t, l.Allow("user@example.com", "10.0.0.2"))
+
+	l.Success("user@example.com", "10.0.0.2")
+	if err := l.Allow("user@example.com", "10.0.0.2"); err != nil {
+		t.Fatalf("account counter not reset by success: %v", err)
+	}
+
+	// Счётчик адреса сохраняется: следующая неудача с него уже с задержкой
+	l.Failure("other@example.com", "10.0.0.1")
+	retryAfter(t, l.Allow("third@example.com", "10.0.0.1"))
+}
+
+// Одновременные попытки, пропущенные до учёта неудач
+func allowConcurrently(l *LoginLimiter, email, ip string, n int) int {
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if l.Allow(email, ip) == nil {
+				allowed.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return int(allowed.Load())
+}
+
+func TestLoginLimiterConcurrentAttempts(t *testing.T) {
+	l, _ := newTestLimiter(t, LoginLimitConfig{
+		AccountFree:    3,
+		AccountLockout: 5,
+		IPFree:         10,
+	})
+
+	// Параллельно проходят только бесплатные попытки
+	if got := allowConcurrently(l, "user@example.com", "10.0.0.1", 50); got != 3 {
+		t.Fatalf("%d concurrent attempts allowed, want 3", got)
+	}
+	for i := 0; i < 3; i++ {
+		l.Failure("user@example.com", "10.0.0.1")
+	}
+
+	// Сверх бесплатных попытки идут по одной, и каждая неудача учитывается
+	if got := allowConcurrently(l, "user@example.com", "10.0.0.2", 50); got != 1 {
+		t.Fatalf("%d concurrent attempts allowed after free ones, want 1", got)
+	}
+	l.Failure("user@example.com", "10.0.0.2")
+	retryAfter(t, l.Allow("user@example.com", "10.0.0.3"))
+
+	// Освобождённое место без неудачи не считается
+	l2, _ := newTestLimiter(t, LoginLimitConfig{AccountFree: 1})
+	if err := l2.Allow("user@example.com", "10.0.0.1"); err != nil {
+		t.Fatalf("first attempt throttled: %v", err)
+	}
+	retryAfter(t, l2.Allow("user@example.com", "10.0.0.1"))
+	l2.Release("user@example.com", "10.0.0.1")
+	if err := l2.Allow("user@example.com", "10.0.0.1"); err != nil {
+		t.Fatalf("released slot is still taken: %v", err)
+	}
+}
+
+func TestLoginLimiterCountersExpire(t *testing.T) {
+	l, clock := newTestLimiter(t, LoginLimitConfig{
+		AccountFree:       1,
+		ResetAfterMinutes: 30,
+	})
+
+	l.Failure("user@example.com", "10.0.0.1")
+	clock.advance(31 * time.Minute)
+	l.Failure("user@example.com", "10.0.0.1")
+	if err := l.Allow("user@example.com", "10.0.0.1"); err != nil {
+		t.Fatalf("old failure was not forgotten: %v", err)
+	}
+
+	l.Failure("user@example.com", "10.0.0.1")
+	retryAfter(t, l.Allow("user@example.com", "10.0.0.1"))
+}
+
+func TestLoginLimitConfigValidate(t *testing.T) {
+	cfg := LoginLimitConfig{AccountFree: 5, AccountLockout: 5}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected an error when lockout threshold does not exceed free attempts")
+	}
+
+	cfg = LoginLimitConfig{}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+	if cfg.AccountLockout <= cfg.AccountFree || cfg.IPLockout <= cfg.IPFree || cfg.LockoutMinutes == 0 {
+		t.Fatalf("unexpected defaults: %+v", cfg)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
+	_ "time/tzdata"
 
 	_ "github.com/lib/pq"
 )
@@ -18,8 +20,43 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Часы работы, часовой пояс и граница рабочего дня
+	hours, err := NewBusinessHours(cfg.Business)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Сетевые принтеры чеков и кухонных тикетов
+	if err := cfg.Printing.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Онлайн-касса
+	if err := cfg.Fiscal.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	fiscalDriver, err := NewFiscalDriver(cfg.Fiscal)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Доставка писем пользователям
+	notifier, err := NewNotifier(cfg.Notifier)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Защита входа от перебора паролей
+	if err := cfg.LoginLimit.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	// Ограничение запросов сброса пароля
+	if err := cfg.Users.ResetLimit.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Инициализация базы данных
-	dbProvider := NewProvider(cfg.DB.Host, cfg.DB.Port, cfg.DB.User, cfg.DB.Password, cfg.DB.DBname)
+	dbProvider := NewProvider(cfg.DB.Host, cfg.DB.Port, cfg.DB.User, cfg.DB.Password, cfg.DB.DBname, hours.Location.String())
 	if dbProvider == nil {
 		log.Fatal("Failed to initialize database provider")
 	}
@@ -28,10 +65,34 @@ func main() {
 	jwtProvider := NewJWTProvider(cfg.JWT.Secret)
 
 	// Инициализация бизнес-логики
-	usecase := NewUsecase(cfg.Usecase.DefaultMessage, *dbProvider, *jwtProvider)
+	idempotencyTTL := time.Duration(cfg.Usecase.IdempotencyTTLMinutes) * time.Minute
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = 24 * time.Hour
+	}
+	usecase := NewUsecase(cfg.Usecase.DefaultMessage, idempotencyTTL, cfg.Preorders, hours, cfg.Business.AcceptWhenClosed, cfg.Locations.DefaultID, cfg.Shifts.RequireOpen, cfg.Loyalty, cfg.GiftCards, cfg.Reservations, cfg.Receipt, cfg.Printing, cfg.Fiscal, fiscalDriver, cfg.Audit, cfg.Users, notifier, cfg.LoginLimit, *dbProvider, *jwtProvider)
+
+	// Очистка просроченных ключей идемпотентности
+	go usecase.RunIdempotencyPurge(10 * time.Minute)
 
-	// Инициализация сервера
-	server := NewServer(cfg.IP, cfg.Port, cfg.API.MinPasswordSize, cfg.API.MaxPasswordSize, cfg.API.MinUsernameSize, cfg.API.MaxUsernameSize, cfg.JWT.Secret, *usecase)
+	// Перевод предзаказов в работу к сроку выдачи
+	go usecase.RunPreorderRelease(time.Minute)
+
+	// Печать по событиям заказов и отправка очереди на принтеры
+	go usecase.RunPrintTriggers()
+	go usecase.RunPrintQueue(2 * time.Second)
+
+	// Отправка фискальных документов в кассу
+	go usecase.RunFiscalQueue(5 * time.Second)
+
+	// Очистка журнала действий по сроку хранения
+	go usecase.RunAuditRetention(time.Hour)
+
+	// Инициализация сервера; адрес клиента из заголовков принимается только от доверенных прокси
+	ipExtractor, err := NewIPExtractor(cfg.API.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := NewServer(cfg.IP, cfg.Port, cfg.API.MinPasswordSize, cfg.API.MaxPasswordSize, cfg.API.MinUsernameSize, cfg.API.MaxUsernameSize, cfg.JWT.Secret, ipExtractor, *usecase)
 
 	// Запуск сервера
 	server.Run()
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Письмо пользователю: ссылка для сброса пароля, приглашение
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Способ доставки писем пользователям
+type Notifier interface {
+	Send(msg Message) error
+}
+
+// Доставщик по настройкам: smtp для боевой работы, file и log для разработки
+func NewNotifier(cfg NotifierConfig) (Notifier, error) {
+	switch cfg.Driver {
+	case "", "log":
+		return logNotifier{}, nil
+	case "file":
+		if cfg.File == "" {
+			return nil, errors.New("notifier: file is required for file driver")
+		}
+		return &fileNotifier{path: cfg.File}, nil
+	case "smtp":
+		if cfg.SMTPHost == "" || cfg.From == "" {
+			return nil, errors.New("notifier: smtp_host and from are required for smtp driver")
+		}
+		port := cfg.SMTPPort
+		if port == 0 {
+			port = 587
+		}
+		return &smtpNotifier{
+			addr:     net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(port)),
+			host:     cfg.SMTPHost,
+			username: cfg.Username,
+			password: cfg.Password,
+			from:     cfg.From,
+		}, nil
+	}
+	return nil, fmt.Errorf("notifier: unknown driver %q", cfg.Driver)
+}
+
+// Письмо в формате RFC 5322 с заголовками в UTF-8
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + mime.BEncoding.Encode("UTF-8", msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Отправка через SMTP-сервер; STARTTLS используется, если сервер его поддерживает
+type smtpNotifier struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (n *smtpNotifier) Send(msg Message) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	return smtp.SendMail(n.addr, auth, n.from, []string{msg.To}, formatMessage(n.from, msg))
+}
+
+// Письма дописываются в файл; удобно для разработки и тестов
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (n *fileNotifier) Send(msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(formatMessage("noreply@localhost", msg), "\r\n.\r\n"...)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Письма выводятся в лог сервера
+type logNotifier struct{}
+
+func (logNotifier) Send(msg Message) error {
+	log.Printf("Message to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
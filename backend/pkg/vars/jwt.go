@@ -2,7 +2,29 @@ package vars
 
 import "github.com/golang-jwt/jwt/v5"
 
+// Роли пользователей: владелец видит все точки, сотрудник — только выданные ему
+const (
+	RoleOwner = "owner"
+	RoleStaff = "staff"
+)
+
 type JWTClaims struct {
-	Username string `json:"username"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	Locations []int  `json:"locations"`
 	jwt.RegisteredClaims
 }
+
+// Есть ли у пользователя доступ к точке
+func (c *JWTClaims) CanAccessLocation(locationID int) bool {
+	if c.Role == RoleOwner {
+		return true
+	}
+	for _, id := range c.Locations {
+		if id == locationID {
+			return true
+		}
+	}
+	return false
+}
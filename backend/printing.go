@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Виды заданий печати
+const (
+	PrintReceipt = "receipt"
+	PrintKitchen = "kitchen"
+	PrintCancel  = "cancel"
+)
+
+// Статусы заданий печати
+const (
+	PrintPending = "pending"
+	PrintDone    = "done"
+	PrintFailed  = "failed"
+)
+
+// Задание печати: готовый поток ESC/POS для одного принтера.
+// Manual — повторная печать по запросу сотрудника.
+type PrintJob struct {
+	ID            int        `json:"id"`
+	Printer       string     `json:"printer"`
+	OrderID       *int       `json:"order_id"`
+	Kind          string     `json:"kind"`
+	Manual        bool       `json:"manual"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	CreatedAt     string     `json:"created_at"`
+	PrintedAt     *time.Time `json:"printed_at"`
+	Payload       []byte     `json:"-"`
+}
+
+var (
+	ErrNoPrinter        = errors.New("no printer configured")
+	ErrPrintJobNotFound = errors.New("print job not found")
+	ErrInvalidPrintJob  = errors.New("invalid print job")
+)
+
+// Кодовые страницы кириллицы и их номера для команды ESC t
+var escposCodePages = map[string]struct {
+	charmap *charmap.Charmap
+	n       byte
+}{
+	"cp866":  {charmap.CodePage866, 17},
+	"cp1251": {charmap.Windows1251, 46},
+}
+
+// Проверка принтеров из настроек; заполняет значения по умолчанию
+func (cfg *PrintingConfig) Validate() error {
+	names := make(map[string]bool)
+	for i := range cfg.Printers {
+		p := &cfg.Printers[i]
+		if p.Name == "" || p.Address == "" {
+			return fmt.Errorf("printer %d: name and address are required", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("printer %q is configured twice", p.Name)
+		}
+		names[p.Name] = true
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			return fmt.Errorf("printer %q: %v", p.Name, err)
+		}
+		if p.Width == 0 {
+			p.Width = ReceiptWidth80
+		}
+		if p.CodePage == "" {
+			p.CodePage = "cp866"
+		}
+		if _, ok := escposCodePages[p.CodePage]; !ok {
+			return fmt.Errorf("printer %q: unknown code page %q", p.Name, p.CodePage)
+		}
+	}
+	if cfg.RetrySeconds <= 0 {
+		cfg.RetrySeconds = 10
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 5
+	}
+	return nil
+}
+
+// Построитель потока команд ESC/POS
+type escposWriter struct {
+	buf bytes.Buffer
+	cm  *charmap.Charmap
+}
+
+// Сброс принтера и выбор кодовой страницы
+func newEscposWriter(codePage string) *escposWriter {
+	cp := escposCodePages[codePage]
+	w := &escposWriter{cm: cp.charmap}
+	w.buf.Write([]byte{0x1B, 0x40, 0x1B, 0x74, cp.n})
+	return w
+}
+
+func (w *escposWriter) bold(on bool) {
+	w.buf.Write([]byte{0x1B, 0x45, boolByte(on)})
+}
+
+// Выравнивание: 0 — влево, 1 — по центру, 2 — вправо
+func (w *escposWriter) align(n byte) {
+	w.buf.Write([]byte{0x1B, 0x61, n})
+}
+
+// Двойная ширина и высота символов
+func (w *escposWriter) large(on bool) {
+	size := byte(0x00)
+	if on {
+		size = 0x11
+	}
+	w.buf.Write([]byte{0x1D, 0x21, size})
+}
+
+func (w *escposWriter) line(s string) {
+	w.buf.Write(encodeCharmap(w.cm, s))
+	w.buf.WriteByte('\n')
+}
+
+func (w *escposWriter) lines(lines []string) {
+	for _, s := range lines {
+		w.line(s)
+	}
+}
+
+// Штрихкод CODE128 с подписью под ним
+func (w *escposWriter) barcode(data string) {
+	payload := append([]byte("{B"), data...)
+	w.buf.Write([]byte{0x1D, 0x48, 0x02, 0x1D, 0x68, 60, 0x1D, 0x77, 0x02})
+	w.buf.Write([]byte{0x1D, 0x6B, 0x49, byte(len(payload))})
+	w.buf.Write(payload)
+	w.buf.WriteByte('\n')
+}
+
+// QR-код: модель 2, размер модуля 6, коррекция ошибок M
+func (w *escposWriter) qr(data string) {
+	n := len(data) + 3
+	w.buf.Write([]byte{0x1D, 0x28, 0x6B, 0x04, 0x00, 0x31, 0x41, 0x32, 0x00})
+	w.buf.Write([]byte{0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x43, 0x06})
+	w.buf.Write([]byte{0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x45, 0x31})
+	w.buf.Write([]byte{0x1D, 0x28, 0x6B, byte(n % 256), byte(n / 256), 0x31, 0x50, 0x30})
+	w.buf.WriteString(data)
+	w.buf.Write([]byte{0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x51, 0x30})
+}
+
+// Прогон ленты и частичная отрезка
+func (w *escposWriter) cut() {
+	w.buf.Write([]byte{0x1D, 0x56, 0x41, 0x03})
+}
+
+func (w *escposWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Чек в ESC/POS: шапка и итог жирным, штрихкод с номером заказа
+// и QR-код ссылки на отзыв вместо её текста
+func RenderReceiptEscpos(r Receipt, printer PrinterConfig) []byte {
+	w := newEscposWriter(printer.CodePage)
+	width := printer.Width
+
+	w.bold(true)
+	w.lines(receiptHeaderLines(r, width))
+	w.bold(false)
+	w.lines(receiptOrderLines(r, width))
+	w.bold(true)
+	w.lines(receiptTotalLines(r, width))
+	w.bold(false)
+	w.lines(receiptFooterLines(r, width))
+
+	w.align(1)
+	w.line("")
+	w.barcode(strconv.Itoa(r.Order.ID))
+	if r.FeedbackURL != "" {
+		w.line("")
+		w.line("Оцените заказ:")
+		w.qr(r.FeedbackURL)
+	}
+	w.align(0)
+	w.cut()
+	return w.bytes()
+}
+
+// Кухонный тикет для станции принтера; nil, если позиций станции в заказе нет.
+// cancel печатает тикет отмены с теми же позициями.
+func RenderKitchenTicket(order Order, menu []MenuItem, printer PrinterConfig, cancel bool) []byte {
+	names := make(map[int]string, len(menu))
+	stations := make(map[int]int, len(menu))
+	for _, item := range menu {
+		names[item.ID] = item.Name
+		if item.StationID != nil {
+			stations[item.ID] = *item.StationID
+		}
+	}
+
+	var items []OrderItem
+	for _, item := range order.Items {
+		if printer.StationID == 0 || stations[item.MenuItemId] == printer.StationID {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	width := printer.Width
+	separator := strings.Repeat("-", width)
+	w := newEscposWriter(printer.CodePage)
+
+	number := order.ID
+	if order.QueueNumber > 0 {
+		number = order.QueueNumber
+	}
+	w.align(1)
+	w.bold(true)
+	w.large(true)
+	if cancel {
+		w.line("ОТМЕНА")
+	}
+	w.line("№" + strconv.Itoa(number))
+	w.large(false)
+	w.bold(false)
+	w.align(0)
+
+	w.line(receiptColumns("Заказ №"+strconv.Itoa(order.ID), order.CreatedAt, width))
+	if label, ok := orderTypeLabels[order.Type]; ok {
+		w.line("Тип: " + label)
+	}
+	if order.TableNumber != nil {
+		w.line("Стол: " + strconv.Itoa(*order.TableNumber))
+	}
+	if order.CustomerName != "" {
+		w.lines(receiptWrap("Гость: "+order.CustomerName, width))
+	}
+	if order.PickupAt != nil {
+		w.line("Выдача: " + order.PickupAt.Format("2006-01-02 15:04"))
+	}
+	w.line(separator)
+
+	for _, item := range items {
+		name, ok := names[item.MenuItemId]
+		if !ok {
+			name = fmt.Sprintf("Позиция #%d", item.MenuItemId)
+		}
+		w.bold(true)
+		w.lines(receiptWrap(fmt.Sprintf("%d x %s", item.Quantity, name), width))
+		w.bold(false)
+		if item.Comment != "" {
+			for _, c := range receiptWrap(item.Comment, width-4) {
+				w.line("  * " + c)
+			}
+		}
+	}
+	if order.Note != "" {
+		w.line(separator)
+		w.lines(receiptWrap("Примечание: "+order.Note, width))
+	}
+	w.cut()
+	return w.bytes()
+}
+
+// Отправка потока на сетевой принтер (обычно порт 9100)
+func sendToPrinter(address string, payload []byte, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	_, err = conn.Write(payload)
+	return err
+}
+
+func (u *Usecase) printerByName(name string) (PrinterConfig, bool) {
+	for _, p := range u.printing.Printers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return PrinterConfig{}, false
+}
+
+// Принтеры точки заказа, печатающие задания вида kind
+func (u *Usecase) printersFor(locationID int, kind string) []PrinterConfig {
+	var printers []PrinterConfig
+	for _, p := range u.printing.Printers {
+		if p.LocationID != 0 && p.LocationID != locationID {
+			continue
+		}
+		if (kind == PrintReceipt && p.Receipts) || (kind != PrintReceipt && p.Kitchen) {
+			printers = append(printers, p)
+		}
+	}
+	return printers
+}
+
+// Постановка заданий вида kind по заказу на все подходящие принтеры.
+// Автоматические задания не дублируются; manual печатает повторно.
+func (u *Usecase) enqueueOrderPrints(order Order, kind string, manual bool) (int, error) {
+	printers := u.printersFor(order.LocationID, kind)
+	if len(printers) == 0 {
+		return 0, nil
+	}
+
+	var receipt Receipt
+	var menu []MenuItem
+	var err error
+	if kind == PrintReceipt {
+		receipt, err = u.GetReceipt(order.ID)
+	} else {
+		menu, err = u.p.FetchMenuItems(0)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for _, printer := range printers {
+		var payload []byte
+		switch kind {
+		case PrintReceipt:
+			payload = RenderReceiptEscpos(receipt, printer)
+		case PrintCancel:
+			// Отмена печатается только там, где заказ уже готовили
+			printed, err := u.p.HasPrintJob(order.ID, printer.Name, PrintKitchen)
+			if err != nil {
+				return queued, err
+			}
+			if !printed {
+				continue
+			}
+			payload = RenderKitchenTicket(order, menu, printer, true)
+		default:
+			payload = RenderKitchenTicket(order, menu, printer, false)
+		}
+		if payload == nil {
+			continue
+		}
+
+		orderID := order.ID
+		added, err := u.p.AddPrintJob(PrintJob{
+			Printer: printer.Name,
+			OrderID: &orderID,
+			Kind:    kind,
+			Manual:  manual,
+			Payload: payload,
+		})
+		if err != nil {
+			return queued, err
+		}
+		if added {
+			queued++
+		}
+	}
+	return queued, nil
+}
+
+// Печать по событиям заказов: при создании — чек и, если заказ сразу
+// в работе, кухонные тикеты; при переходе в работу — тикеты; при отмене —
+// тикеты отмены на станции, где заказ готовили.
+func (u *Usecase) handlePrintEvent(event OrderEvent) {
+	var kinds []string
+	switch {
+	case event.Type == EventOrderCreated:
+		kinds = append(kinds, PrintReceipt)
+		if event.Status == "В работе" {
+			kinds = append(kinds, PrintKitchen)
+		}
+	case event.Type == EventOrderStatusChanged && event.Status == "В работе":
+		kinds = append(kinds, PrintKitchen)
+	case event.Type == EventOrderStatusChanged && event.Status == "Отменен":
+		kinds = append(kinds, PrintCancel)
+	default:
+		return
+	}
+
+	order, err := u.p.FetchOrder(event.OrderID)
+	if err != nil {
+		log.Printf("Error loading order %d for printing: %v", event.OrderID, err)
+		return
+	}
+	for _, kind := range kinds {
+		if _, err := u.enqueueOrderPrints(order, kind, false); err != nil {
+			log.Printf("Error queueing %s print for order %d: %v", kind, order.ID, err)
+		}
+	}
+}
+
+// Подписка на события заказов для печати. Если подписчик отстал и был
+// отключён брокером, он переподключается и дочитывает события из истории.
+func (u *Usecase) RunPrintTriggers() {
+	if len(u.printing.Printers) == 0 {
+		return
+	}
+
+	var (
+		epoch  string
+		lastID int64
+	)
+	for {
+		ch, missed, _, cancel := u.events.Subscribe(epoch, lastID)
+		for _, event := range missed {
+			u.handlePrintEvent(event)
+			epoch, lastID = event.Epoch, event.ID
+		}
+		for event := range ch {
+			u.handlePrintEvent(event)
+			epoch, lastID = event.Epoch, event.ID
+		}
+		cancel()
+	}
+}
+
+// Отправка заданий из очереди с повторами: пауза между попытками
+// удваивается, после MaxAttempts задание помечается failed.
+func (u *Usecase) RunPrintQueue(interval time.Duration) {
+	if len(u.printing.Printers) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	timeout := time.Duration(u.printing.TimeoutSeconds) * time.Second
+	for range ticker.C {
+		// Задание резервируется на время отправки, чтобы его не взял другой экземпляр
+		jobs, err := u.p.ClaimPrintJobs(20, 2*timeout)
+		if err != nil {
+			log.Printf("Error claiming print jobs: %v", err)
+			continue
+		}
+
+		for _, job := range jobs {
+			printer, ok := u.printerByName(job.Printer)
+			if !ok {
+				err = fmt.Errorf("printer %q is not configured", job.Printer)
+			} else {
+				err = sendToPrinter(printer.Address, job.Payload, timeout)
+			}
+			if err == nil {
+				err = u.p.CompletePrintJob(job.ID)
+			} else {
+				log.Printf("Error printing job %d on %s: %v", job.ID, job.Printer, err)
+				var retryAt *time.Time
+				if ok && job.Attempts < u.printing.MaxAttempts {
+					delay := time.Duration(u.printing.RetrySeconds) * time.Second << min(job.Attempts-1, 6)
+					next := time.Now().Add(delay)
+					retryAt = &next
+				}
+				err = u.p.FailPrintJob(job.ID, err.Error(), retryAt)
+			}
+			if err != nil {
+				log.Printf("Error updating print job %d: %v", job.ID, err)
+			}
+		}
+	}
+}
+
+// Повторная печать чека или кухонного тикета по заказу
+func (u *Usecase) PrintOrder(orderID int, kind string) (int, error) {
+	if kind != PrintReceipt && kind != PrintKitchen {
+		return 0, fmt.Errorf("%w: unknown kind %q", ErrInvalidPrintJob, kind)
+	}
+	order, err := u.p.FetchOrder(orderID)
+	if err != nil {
+		return 0, err
+	}
+	if len(u.printersFor(order.LocationID, kind)) == 0 {
+		return 0, ErrNoPrinter
+	}
+	return u.enqueueOrderPrints(order, kind, true)
+}
+
+func (u *Usecase) GetPrintJobs(status string) ([]PrintJob, error) {
+	return u.p.FetchPrintJobs(status)
+}
+
+// Возврат задания в очередь со сбросом счётчика попыток
+func (u *Usecase) RetryPrintJob(id int) (PrintJob, error) {
+	return u.p.RetryPrintJob(id)
+}
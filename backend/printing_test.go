@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Принтер на локальном порту: принимает одно соединение и отдаёт всё прочитанное
+func listenPrinter(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+	return ln.Addr().String(), received
+}
+
+func printOverTCP(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	addr, received := listenPrinter(t)
+	if err := sendToPrinter(addr, payload, time.Second); err != nil {
+		t.Fatalf("sendToPrinter: %v", err)
+	}
+	select {
+	case got := <-received:
+		return got
+	case <-time.After(2 * time.Second):
+		t.Fatal("printer received nothing")
+		return nil
+	}
+}
+
+func mustContain(t *testing.T, data, part []byte, what string) {
+	t.Helper()
+	if !bytes.Contains(data, part) {
+		t.Errorf("%s not found in ESC/POS stream: % X", what, part)
+	}
+}
+
+func TestReceiptEscposOverTCP(t *testing.T) {
+	r := testReceipt()
+	printer := PrinterConfig{Name: "bar", Width: ReceiptWidth58, CodePage: "cp866"}
+	got := printOverTCP(t, RenderReceiptEscpos(r, printer))
+
+	// Сброс и кодовая страница 866 (ESC t 17)
+	if !bytes.HasPrefix(got, []byte{0x1B, 0x40, 0x1B, 0x74, 17}) {
+		t.Errorf("stream does not start with init and code page: % X", got[:5])
+	}
+	total := append(encodeCharmap(charmap.CodePage866, "ИТОГО"), ' ')
+	mustContain(t, got, total, "total in cp866")
+	mustContain(t, got, []byte{0x1B, 0x45, 0x01}, "bold on")
+
+	// CODE128 с номером заказа
+	mustContain(t, got, []byte{0x1D, 0x6B, 0x49, 4, '{', 'B', '4', '2'}, "barcode")
+
+	// QR: запись данных ссылки и печать
+	n := len(r.FeedbackURL) + 3
+	store := append([]byte{0x1D, 0x28, 0x6B, byte(n % 256), byte(n / 256), 0x31, 0x50, 0x30}, r.FeedbackURL...)
+	mustContain(t, got, store, "QR data")
+	mustContain(t, got, []byte{0x1D, 0x28, 0x6B, 0x03, 0x00, 0x31, 0x51, 0x30}, "QR print")
+	// Ссылка не печатается текстом
+	mustContain(t, got, encodeCharmap(charmap.CodePage866, "Оцените заказ:\n"), "feedback caption")
+	if bytes.Count(got, []byte(r.FeedbackURL)) != 1 {
+		t.Error("feedback URL should appear only inside the QR code")
+	}
+
+	if !bytes.HasSuffix(got, []byte{0x1D, 0x56, 0x41, 0x03}) {
+		t.Errorf("stream does not end with a cut: % X", got[len(got)-4:])
+	}
+}
+
+func TestKitchenTicketEscpos(t *testing.T) {
+	station := 2
+	other := 3
+	menu := []MenuItem{
+		{ID: 1, Name: "Капучино", StationID: &station},
+		{ID: 2, Name: "Сырники", StationID: &other},
+	}
+	order := Order{
+		ID:          42,
+		QueueNumber: 12,
+		CreatedAt:   "2024-03-01 18:05:00",
+		Type:        OrderTypeTakeaway,
+		Note:        "Побыстрее",
+		Items: []OrderItem{
+			{MenuItemId: 1, Quantity: 2, Comment: "на овсяном"},
+			{MenuItemId: 2, Quantity: 1},
+		},
+	}
+	printer := PrinterConfig{Name: "bar", Width: ReceiptWidth80, CodePage: "cp1251", StationID: station}
+
+	got := printOverTCP(t, RenderKitchenTicket(order, menu, printer, true))
+	enc := func(s string) []byte { return encodeCharmap(charmap.Windows1251, s) }
+
+	if !bytes.HasPrefix(got, []byte{0x1B, 0x40, 0x1B, 0x74, 46}) {
+		t.Errorf("stream does not start with init and code page 1251: % X", got[:5])
+	}
+	// Номер в очереди крупно и жирно, над ним пометка отмены
+	mustContain(t, got, append([]byte{0x1B, 0x45, 0x01, 0x1D, 0x21, 0x11}, enc("ОТМЕНА\n№12\n")...), "large cancel header")
+	mustContain(t, got, enc("2 x Капучино\n"), "station item")
+	mustContain(t, got, enc("  * на овсяном\n"), "item comment")
+	mustContain(t, got, enc("Примечание: Побыстрее\n"), "order note")
+	if bytes.Contains(got, enc("Сырники")) {
+		t.Error("ticket contains an item of another station")
+	}
+	if !bytes.HasSuffix(got, []byte{0x1D, 0x56, 0x41, 0x03}) {
+		t.Error("ticket does not end with a cut")
+	}
+
+	// Для станции без позиций в заказе тикет не печатается
+	printer.StationID = 99
+	if ticket := RenderKitchenTicket(order, menu, printer, false); ticket != nil {
+		t.Errorf("expected no ticket, got % X", ticket)
+	}
+}
+
+func TestSendToPrinterUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	if err := sendToPrinter(addr, []byte{0x1B, 0x40}, 500*time.Millisecond); err == nil {
+		t.Fatal("expected an error for a printer that is not listening")
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Ширина строки чека в символах для ленты 58 и 80 мм (шрифт 12×24)
+const (
+	ReceiptWidth58 = 32
+	ReceiptWidth80 = 48
+)
+
+var orderTypeLabels = map[string]string{
+	OrderTypeDineIn:   "В зале",
+	OrderTypeTakeaway: "С собой",
+	OrderTypeDelivery: "Доставка",
+	OrderTypePreOrder: "Предзаказ",
+}
+
+var paymentLabels = map[string]string{
+	PaymentCash:     "Наличные",
+	PaymentCard:     "Карта",
+	PaymentPoints:   "Баллы",
+	PaymentGiftCard: "Подарочная карта",
+}
+
+func formatMoney(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func receiptCenter(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return s
+	}
+	return strings.Repeat(" ", (width-n)/2) + s
+}
+
+// Левая и правая части строки, разнесённые по краям
+func receiptColumns(left, right string, width int) string {
+	gap := width - utf8.RuneCountInString(left) - utf8.RuneCountInString(right)
+	if gap < 1 {
+		gap = 1
+	}
+	return left + strings.Repeat(" ", gap) + right
+}
+
+// Перенос текста по словам; слишком длинные слова режутся
+func receiptWrap(s string, width int) []string {
+	var lines []string
+	var line []rune
+	for _, word := range strings.Fields(s) {
+		w := []rune(word)
+		for len(w) > width {
+			if len(line) > 0 {
+				lines = append(lines, string(line))
+				line = nil
+			}
+			lines = append(lines, string(w[:width]))
+			w = w[width:]
+		}
+		switch {
+		case len(line) == 0:
+			line = w
+		case len(line)+1+len(w) <= width:
+			line = append(append(line, ' '), w...)
+		default:
+			lines = append(lines, string(line))
+			line = w
+		}
+	}
+	if len(line) > 0 {
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+// Шапка чека: реквизиты кафе
+func receiptHeaderLines(r Receipt, width int) []string {
+	var out []string
+	for _, s := range []string{r.Cafe.Name, r.Cafe.Address, r.Cafe.Phone} {
+		for _, line := range receiptWrap(s, width) {
+			out = append(out, receiptCenter(line, width))
+		}
+	}
+	if r.Cafe.TaxID != "" {
+		out = append(out, receiptCenter("ИНН "+r.Cafe.TaxID, width))
+	}
+	return out
+}
+
+// Данные заказа и позиции между разделителями
+func receiptOrderLines(r Receipt, width int) []string {
+	var out []string
+	add := func(lines ...string) { out = append(out, lines...) }
+	separator := strings.Repeat("-", width)
+
+	o := r.Order
+	add(separator)
+	add(receiptColumns("Заказ №"+strconv.Itoa(o.ID), o.CreatedAt, width))
+	if o.QueueNumber > 0 {
+		add("Номер в очереди: " + strconv.Itoa(o.QueueNumber))
+	}
+	if label, ok := orderTypeLabels[o.Type]; ok {
+		add("Тип: " + label)
+	}
+	if o.TableNumber != nil {
+		add("Стол: " + strconv.Itoa(*o.TableNumber))
+	}
+	if o.CustomerName != "" {
+		add(receiptWrap("Гость: "+o.CustomerName, width)...)
+	}
+	if o.PickupAt != nil {
+		add("Выдача: " + o.PickupAt.Format("2006-01-02 15:04"))
+	}
+	add("Статус: " + o.Status)
+	add(separator)
+
+	for _, line := range r.Lines {
+		add(receiptWrap(line.Name, width)...)
+		add(receiptColumns(fmt.Sprintf("  %d x %s", line.Quantity, formatMoney(line.Price)), formatMoney(line.Amount), width))
+		if line.Comment != "" {
+			for _, c := range receiptWrap(line.Comment, width-4) {
+				add("  * " + c)
+			}
+		}
+	}
+	add(separator)
+	return out
+}
+
+// Итог и разбивка оплаты
+func receiptTotalLines(r Receipt, width int) []string {
+	out := []string{receiptColumns("ИТОГО", formatMoney(r.Order.Total), width)}
+	for _, p := range r.Payments {
+		label, ok := paymentLabels[p.Method]
+		if !ok {
+			label = p.Method
+		}
+		out = append(out, receiptColumns(label, formatMoney(p.Amount), width))
+	}
+	if r.Order.PointsEarned > 0 {
+		out = append(out, receiptColumns("Начислено баллов", strconv.Itoa(r.Order.PointsEarned), width))
+	}
+	return out
+}
+
+func receiptFooterLines(r Receipt, width int) []string {
+	var out []string
+	if r.Cafe.Footer != "" {
+		out = append(out, "")
+		for _, line := range receiptWrap(r.Cafe.Footer, width) {
+			out = append(out, receiptCenter(line, width))
+		}
+	}
+	return out
+}
+
+// Строки чека фиксированной ширины для текста и PDF
+func receiptLines(r Receipt, width int) []string {
+	out := receiptHeaderLines(r, width)
+	out = append(out, receiptOrderLines(r, width)...)
+	out = append(out, receiptTotalLines(r, width)...)
+	out = append(out, receiptFooterLines(r, width)...)
+	if r.FeedbackURL != "" {
+		out = append(out, "", "Оцените заказ:")
+		// Ссылка переносится посимвольно, чтобы её можно было набрать
+		url := []rune(r.FeedbackURL)
+		for len(url) > width {
+			out = append(out, string(url[:width]))
+			url = url[width:]
+		}
+		out = append(out, string(url))
+	}
+	return out
+}
+
+// Текстовый чек для ленты шириной width символов
+func RenderReceiptText(r Receipt, width int) string {
+	return strings.Join(receiptLines(r, width), "\n") + "\n"
+}
+
+var receiptTemplate = template.Must(template.New("receipt").Funcs(template.FuncMap{
+	"money": formatMoney,
+	"payment": func(method string) string {
+		if label, ok := paymentLabels[method]; ok {
+			return label
+		}
+		return method
+	},
+	"orderType": func(t string) string { return orderTypeLabels[t] },
+}).Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<title>Заказ №{{.Order.ID}}</title>
+<style>
+body { font-family: monospace; max-width: 360px; margin: 16px auto; }
+.center { text-align: center; }
+table { width: 100%; border-collapse: collapse; }
+td { padding: 2px 0; vertical-align: top; }
+td.amount { text-align: right; white-space: nowrap; }
+.comment { color: #666; font-size: 90%; }
+hr { border: none; border-top: 1px dashed #000; }
+</style>
+</head>
+<body>
+<div class="center">
+{{with .Cafe.Name}}<strong>{{.}}</strong><br>{{end}}
+{{with .Cafe.Address}}{{.}}<br>{{end}}
+{{with .Cafe.Phone}}{{.}}<br>{{end}}
+{{with .Cafe.TaxID}}ИНН {{.}}<br>{{end}}
+</div>
+<hr>
+<div>
+Заказ №{{.Order.ID}} от {{.Order.CreatedAt}}<br>
+{{if .Order.QueueNumber}}Номер в очереди: {{.Order.QueueNumber}}<br>{{end}}
+{{with orderType .Order.Type}}Тип: {{.}}<br>{{end}}
+{{with .Order.TableNumber}}Стол: {{.}}<br>{{end}}
+{{with .Order.CustomerName}}Гость: {{.}}<br>{{end}}
+{{with .Order.PickupAt}}Выдача: {{.Format "2006-01-02 15:04"}}<br>{{end}}
+Статус: {{.Order.Status}}
+</div>
+<hr>
+<table>
+{{range .Lines}}<tr><td>{{.Name}}<br>{{.Quantity}} x {{money .Price}}{{with .Comment}}<div class="comment">{{.}}</div>{{end}}</td><td class="amount">{{money .Amount}}</td></tr>
+{{end}}</table>
+<hr>
+<table>
+<tr><td><strong>ИТОГО</strong></td><td class="amount"><strong>{{money .Order.Total}}</strong></td></tr>
+{{range .Payments}}<tr><td>{{payment .Method}}</td><td class="amount">{{money .Amount}}</td></tr>
+{{end}}{{if .Order.PointsEarned}}<tr><td>Начислено баллов</td><td class="amount">{{.Order.PointsEarned}}</td></tr>
+{{end}}</table>
+{{with .Cafe.Footer}}<p class="center">{{.}}</p>{{end}}
+{{with .FeedbackURL}}<p class="center"><a href="{{.}}">Оцените заказ</a></p>{{end}}
+</body>
+</html>
+`))
+
+func RenderReceiptHTML(r Receipt) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := receiptTemplate.Execute(&buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Моноширинный шрифт с кириллицей для PDF-чека. Стандартный Courier не во всех
+// программах просмотра содержит кириллические глифы, поэтому шрифт встраивается.
+//
+//go:embed fonts/DejaVuSansMono.ttf
+var receiptFont []byte
+
+// Метрики DejaVu Sans Mono в тысячных долях кегля
+const (
+	receiptFontName    = "DejaVuSansMono"
+	receiptGlyphWidth  = 602
+	receiptFontMetrics = "/FontBBox [-559 -375 718 1028] /ItalicAngle 0 /Ascent 928 /Descent -236 /CapHeight 729 /StemV 80"
+)
+
+var (
+	receiptFontOnce   sync.Once
+	receiptFontStream []byte
+)
+
+// Сжатый шрифт для потока FontFile2; сжимается один раз при первом чеке
+func compressedReceiptFont() []byte {
+	receiptFontOnce.Do(func() {
+		var buf bytes.Buffer
+		w, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+		w.Write(receiptFont)
+		w.Close()
+		receiptFontStream = buf.Bytes()
+	})
+	return receiptFontStream
+}
+
+// Имена глифов кириллицы для кодировки Windows-1251 шрифта PDF
+func cp1251Differences() string {
+	var b strings.Builder
+	b.WriteString("168 /afii10023 184 /afii10071 185 /afii61352 192")
+	// А–Е, Ж–Я (afii10023 — это Ё)
+	for g := 10017; g <= 10049; g++ {
+		if g != 10023 {
+			fmt.Fprintf(&b, " /afii%d", g)
+		}
+	}
+	// а–е, ж–я (afii10071 — это ё)
+	for g := 10065; g <= 10097; g++ {
+		if g != 10071 {
+			fmt.Fprintf(&b, " /afii%d", g)
+		}
+	}
+	return b.String()
+}
+
+// Перекодировка строки в однобайтовую кодировку; символы вне её заменяются на «?»
+func encodeCharmap(cm *charmap.Charmap, s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		b, ok := cm.EncodeRune(r)
+		if !ok {
+			b = '?'
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func pdfEscape(s []byte) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// PDF-чек на ленту 80 мм: те же строки, что у текстового чека, встроенным
+// моноширинным шрифтом. Высота страницы подстраивается под длину чека.
+func RenderReceiptPDF(r Receipt) ([]byte, error) {
+	const (
+		pageWidth = 226.77 // 80 мм в пунктах
+		margin    = 8.0
+		fontSize  = 7.0
+		leading   = 8.5
+	)
+	lines := receiptLines(r, ReceiptWidth80)
+	pageHeight := 2*margin + leading*float64(len(lines))
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "BT\n/F1 %.1f Tf\n%.1f TL\n%.2f %.2f Td\n", fontSize, leading, margin, pageHeight-margin-fontSize)
+	for _, line := range lines {
+		fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(encodeCharmap(charmap.Windows1251, line)))
+	}
+	content.WriteString("ET\n")
+
+	// Все символы Windows-1251 с 32 по 255 одной ширины
+	widths := strings.TrimSpace(strings.Repeat(strconv.Itoa(receiptGlyphWidth)+" ", 256-32))
+	font := compressedReceiptFont()
+
+	// Шрифт идёт последним объектом, чтобы смещения остальных не зависели от его размера
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>", pageWidth, pageHeight),
+		"<< /Type /Font /Subtype /TrueType /BaseFont /" + receiptFontName + " /FirstChar 32 /LastChar 255 /Widths [" + widths + "] /FontDescriptor 6 0 R" +
+			" /Encoding << /Type /Encoding /BaseEncoding /WinAnsiEncoding /Differences [" + cp1251Differences() + "] >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		// Flags: моноширинный (1) и несимвольный, с буквенным набором знаков (32)
+		"<< /Type /FontDescriptor /FontName /" + receiptFontName + " /Flags 33 " + receiptFontMetrics + " /FontFile2 7 0 R >>",
+		fmt.Sprintf("<< /Length %d /Length1 %d /Filter /FlateDecode >>\nstream\n%s\nendstream", len(font), len(receiptFont), font),
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes(), nil
+}
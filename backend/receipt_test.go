@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// go test -run Receipt -update перезаписывает эталоны в testdata
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func testReceipt() Receipt {
+	table := 7
+	pickupAt := time.Date(2024, 3, 1, 18, 30, 0, 0, time.UTC)
+	return Receipt{
+		Cafe: ReceiptConfig{
+			Name:    "Кафе «Ромашка»",
+			Address: "г. Москва, ул. Пушкина, д. 10",
+			Phone:   "+7 495 123-45-67",
+			TaxID:   "7701234567",
+			Footer:  "Спасибо за заказ! Ждём вас снова.",
+		},
+		Order: Order{
+			ID:           42,
+			CreatedAt:    "2024-03-01 18:05:00",
+			QueueNumber:  12,
+			Type:         OrderTypePreOrder,
+			TableNumber:  &table,
+			CustomerName: "Анна",
+			PickupAt:     &pickupAt,
+			Status:       "В работе",
+			Total:        730,
+			PointsEarned: 18,
+		},
+		Lines: []ReceiptLine{
+			{Name: "Капучино", Quantity: 2, Price: 220, Amount: 440},
+			{Name: "Сырники со сметаной и ягодным соусом (большая порция)", Quantity: 1, Price: 290, Amount: 290, Comment: "без сахара <быстрее>"},
+		},
+		Payments: []ReceiptPayment{
+			{Method: PaymentCard, Amount: 630},
+			{Method: PaymentPoints, Amount: 100},
+		},
+		FeedbackURL: "https://cafe.example/feedback?order=42&token=0123456789abcdef",
+	}
+}
+
+// Сравнение с эталоном из testdata; с флагом -update эталон перезаписывается
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden file: %v (run go test -update)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from golden file:\n--- got ---\n%s\n--- want ---\n%s", name, got, want)
+	}
+}
+
+func TestRenderReceiptText(t *testing.T) {
+	r := testReceipt()
+	checkGolden(t, "receipt_58.txt", []byte(RenderReceiptText(r, ReceiptWidth58)))
+	checkGolden(t, "receipt_80.txt", []byte(RenderReceiptText(r, ReceiptWidth80)))
+}
+
+func TestRenderReceiptHTML(t *testing.T) {
+	html, err := RenderReceiptHTML(testReceipt())
+	if err != nil {
+		t.Fatalf("RenderReceiptHTML: %v", err)
+	}
+	checkGolden(t, "receipt.html", html)
+}
+
+var pdfFontStream = regexp.MustCompile(`(?s)(/Length )(\d+)( /Length1 \d+ /Filter /FlateDecode >>\nstream\n)(.*?)(\nendstream)`)
+
+func TestRenderReceiptPDF(t *testing.T) {
+	pdf, err := RenderReceiptPDF(testReceipt())
+	if err != nil {
+		t.Fatalf("RenderReceiptPDF: %v", err)
+	}
+
+	// Встроенный шрифт распаковывается в исходный файл
+	m := pdfFontStream.FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("embedded font stream not found")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(m[4]))
+	if err != nil {
+		t.Fatalf("font stream: %v", err)
+	}
+	font, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("font stream: %v", err)
+	}
+	if !bytes.Equal(font, receiptFont) {
+		t.Error("embedded font does not match fonts/DejaVuSansMono.ttf")
+	}
+
+	// Размер сжатого шрифта зависит от версии zlib, поэтому в эталоне он заменён
+	normalized := pdfFontStream.ReplaceAll(pdf, []byte("${1}0${3}<font>${5}"))
+	normalized = regexp.MustCompile(`startxref\n\d+`).ReplaceAll(normalized, []byte("startxref\n0"))
+	checkGolden(t, "receipt.pdf", normalized)
+}
@@ -2,67 +2,191 @@ package main
 
 import (
 	"backend/pkg/vars"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (u *Usecase) Authenticate(email, password string) (string, error) {
-	exist, err := u.p.CheckUserByEmail(email)
-	if !exist {
-		return "", errors.New("user not found")
+// Хеш для сравнения, когда пользователя нет: ответ занимает столько же
+// времени, сколько и при неверном пароле
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Вход по email и паролю. Неизвестный email, неверный пароль и отключённая
+// учётная запись дают одну и ту же ошибку ErrInvalidCredentials; частые
+// неудачи по учётной записи или IP приводят к ErrLoginThrottled. ip берётся
+// из соединения или от доверенного прокси (api.trusted_proxies), подделать
+// его заголовком клиент не может.
+func (u *Usecase) Authenticate(email, password, ip string) (string, error) {
+	if err := u.limiter.Allow(email, ip); err != nil {
+		return "", err
+	}
+
+	token, err := u.authenticate(email, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		for _, lockout := range u.limiter.Failure(email, ip) {
+			log.Printf("Login lockout: %s %s after %d failed attempts from %s", lockout.Scope, lockout.Key, lockout.Attempts, ip)
+			if err := u.p.AddLoginLockout(lockout); err != nil {
+				log.Printf("Error saving login lockout: %v", err)
+			}
+		}
+		return "", err
 	}
 	if err != nil {
+		u.limiter.Release(email, ip)
 		return "", err
 	}
 
-	name, hashedPassword, err := u.p.GetUsernameAndHashedPassword(email)
+	u.limiter.Success(email, ip)
+	return token, nil
+}
+
+func (u *Usecase) authenticate(email, password string) (string, error) {
+	_, hashedPassword, err := u.p.GetUsernameAndHashedPassword(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", ErrInvalidCredentials
+	}
 	if err != nil {
 		return "", err
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
-		return "", errors.New("invalid credentials")
+		return "", ErrInvalidCredentials
+	}
+
+	access, err := u.p.FetchUserAccess(email)
+	if err != nil {
+		return "", err
+	}
+	if !access.Active {
+		return "", ErrInvalidCredentials
 	}
 
-	return u.jp.GenerateToken(name)
+	return u.jp.GenerateToken(access)
+}
+
+// Блокировки входа, сначала новые
+func (u *Usecase) GetLoginLockouts(from, to *time.Time) ([]LoginLockout, error) {
+	return u.p.FetchLoginLockouts(from, to)
+}
+
+// Данные пользователя для токена: роль и доступные точки
+type UserAccess struct {
+	ID        int
+	Name      string
+	Role      string
+	Active    bool
+	Locations []int
 }
 
 func (u *Usecase) ValidateJWT(token string) (*vars.JWTClaims, error) {
 	return u.jp.ValidateToken(token)
 }
 
+// Самостоятельная регистрация закрыта, если она не разрешена в настройках.
+// Пока в базе нет ни одного пользователя, первый регистрируется владельцем.
 func (u *Usecase) Register(name, email, password string) error {
+	role := vars.RoleStaff
+	create := u.p.CreateUser
+	if !u.users.OpenRegistration {
+		n, err := u.p.CountUsers()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrRegistrationClose
+		}
+		// Количество перепроверяется при вставке под блокировкой таблицы
+		role = vars.RoleOwner
+		create = u.p.CreateFirstUser
+	}
+
 	exist, err := u.p.CheckUserByEmail(email)
 	if err != nil {
 		return err
 	}
 	if exist {
-		return errors.New("user already exists")
+		return ErrUserExists
 	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return errors.New("failed to hash password")
 	}
-	return u.p.CreateUser(name, email, string(hashedPassword))
+	return create(name, email, string(hashedPassword), role, u.defaultLocationID)
 }
 
 type Usecase struct {
-	defaultMsg string
+	defaultMsg     string
+	idempotencyTTL time.Duration
+	preorders      PreorderConfig
+
+	hours            *BusinessHours
+	acceptWhenClosed bool
+
+	// Точка, к которой относятся заказы без явного указания точки
+	defaultLocationID int
+
+	// Не принимать заказы без открытой кассовой смены
+	requireShift bool
+
+	loyalty      LoyaltyConfig
+	giftCards    GiftCardsConfig
+	reservations ReservationsConfig
+	receipt      ReceiptConfig
+	printing     PrintingConfig
+	fiscal       FiscalConfig
+	fiscalDriver FiscalDriver
+	audit        AuditConfig
+	users        UsersConfig
+	notifier     Notifier
+	limiter      *LoginLimiter
+	resetLimiter *LoginLimiter
 
-	p  Provider
-	jp JWTProvider
+	p      Provider
+	jp     JWTProvider
+	events *EventBroker
 }
 
-func NewUsecase(defaultMsg string, p Provider, jp JWTProvider) *Usecase {
+func NewUsecase(defaultMsg string, idempotencyTTL time.Duration, preorders PreorderConfig, hours *BusinessHours, acceptWhenClosed bool, defaultLocationID int, requireShift bool, loyalty LoyaltyConfig, giftCards GiftCardsConfig, reservations ReservationsConfig, receipt ReceiptConfig, printing PrintingConfig, fiscal FiscalConfig, fiscalDriver FiscalDriver, audit AuditConfig, users UsersConfig, notifier Notifier, loginLimit LoginLimitConfig, p Provider, jp JWTProvider) *Usecase {
 	return &Usecase{
-		defaultMsg: defaultMsg,
-		p:          p,
-		jp:         jp,
+		defaultLocationID: defaultLocationID,
+		defaultMsg:        defaultMsg,
+		idempotencyTTL:    idempotencyTTL,
+		preorders:         preorders,
+		hours:             hours,
+		acceptWhenClosed:  acceptWhenClosed,
+		requireShift:      requireShift,
+		loyalty:           loyalty,
+		giftCards:         giftCards,
+		reservations:      reservations,
+		receipt:           receipt,
+		printing:          printing,
+		fiscal:            fiscal,
+		fiscalDriver:      fiscalDriver,
+		audit:             audit,
+		users:             users,
+		notifier:          notifier,
+		limiter:           NewLoginLimiter(loginLimit),
+		resetLimiter:      NewLoginLimiter(users.ResetLimit),
+		p:                 p,
+		jp:                jp,
+		events:            NewEventBroker(eventHistorySize),
 	}
 }
-func (u *Usecase) GetMenuItems() ([]MenuItem, error) {
-	return u.p.FetchMenuItems()
+
+// Меню точки; locationID = 0 возвращает базовое меню без переопределений
+func (u *Usecase) GetMenuItems(locationID int) ([]MenuItem, error) {
+	return u.p.FetchMenuItems(locationID)
 }
 
 type MenuItem struct {
@@ -70,9 +194,13 @@ type MenuItem struct {
 	Name        string  `json:"name"`
 	Description string  `json:"description"`
 	Price       float64 `json:"price"`
+	StationID   *int    `json:"station_id"`
+	Category    string  `json:"category"`
 	CreatedAt   string  `json:"created_at"`
 }
 
+var ErrMenuItemNotFound = errors.New("menu item not found")
+
 func (u *Usecase) DeleteMenuItem(id int) error {
 	return u.p.DeleteMenuItem(id)
 }
@@ -85,26 +213,306 @@ func (u *Usecase) AddMenuItem(item MenuItem) (MenuItem, error) {
 }
 
 type OrderItem struct {
-	MenuItemId int `json:"menuItemId"`
-	Quantity   int `json:"quantity"`
+	ID         int     `json:"id,omitempty"`
+	MenuItemId int     `json:"menuItemId"`
+	Quantity   int     `json:"quantity"`
+	Price      float64 `json:"price"`
+	Comment    string  `json:"comment"`
+	// Программа штампов, по которой позиция выдана бесплатно
+	StampProgramID *int `json:"stamp_program_id,omitempty"`
 }
 
 type Order struct {
-	ID        int         `json:"id"`
-	Total     float64     `json:"total"`
-	Status    string      `json:"status"`
-	CreatedAt string      `json:"created_at"`
-	Items     []OrderItem `json:"items"`
+	ID            int        `json:"id"`
+	Total         float64    `json:"total"`
+	Status        string     `json:"status"`
+	CreatedAt     string     `json:"created_at"`
+	Type          string     `json:"order_type"`
+	TableNumber   *int       `json:"table_number"`
+	CustomerName  string     `json:"customer_name"`
+	QueueNumber   int        `json:"queue_number"`
+	Note          string     `json:"note"`
+	PickupAt      *time.Time `json:"pickup_at"`
+	LocationID    int        `json:"location_id"`
+	PaymentMethod string     `json:"payment_method"`
+	ShiftID       *int       `json:"shift_id"`
+	// Покупатель и баллы: списано (и сколько это в рублях) и начислено за заказ
+	CustomerID     *int    `json:"customer_id"`
+	PointsRedeemed int     `json:"points_redeemed"`
+	PointsAmount   float64 `json:"points_amount"`
+	PointsEarned   int     `json:"points_earned"`
+	// Часть заказа, оплаченная подарочными картами
+	GiftCardAmount float64     `json:"gift_card_amount"`
+	Items          []OrderItem `json:"items"`
+}
+
+// Типы заказов (каналы)
+const (
+	OrderTypeDineIn   = "dine_in"
+	OrderTypeTakeaway = "takeaway"
+	OrderTypeDelivery = "delivery"
+	OrderTypePreOrder = "pre_order"
+)
+
+var OrderTypes = map[string]bool{
+	OrderTypeDineIn:   true,
+	OrderTypeTakeaway: true,
+	OrderTypeDelivery: true,
+	OrderTypePreOrder: true,
+}
+
+// Способы оплаты
+const (
+	PaymentCash = "cash"
+	PaymentCard = "card"
+)
+
+// Часть заказа, оплаченная баллами; в отчётах смены выделяется отдельно
+const PaymentPoints = "points"
+
+// Часть заказа, оплаченная подарочными картами
+const PaymentGiftCard = "gift_card"
+
+var PaymentMethods = map[string]bool{
+	PaymentCash: true,
+	PaymentCard: true,
+}
+
+const (
+	MaxCustomerNameSize = 64
+	MaxOrderNoteSize    = 500
+	MaxItemCommentSize  = 200
+)
+
+// Очистка свободного текста: удаляются управляющие символы, пробелы по краям
+// и повторяющиеся пробелы. Переводы строк сохраняются только при keepNewlines.
+func sanitizeText(s string, keepNewlines bool) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.TrimSpace(s) {
+		switch {
+		case r == '\n' && keepNewlines:
+			b.WriteRune(r)
+			space = false
+			continue
+		case unicode.IsSpace(r):
+			if !space {
+				b.WriteRune(' ')
+			}
+			space = true
+			continue
+		case unicode.IsControl(r) || r == utf8.RuneError:
+			continue
+		}
+		b.WriteRune(r)
+		space = false
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Параметры создания заказа
+type OrderRequest struct {
+	Items        []OrderItem
+	Type         string
+	TableNumber  *int
+	CustomerName string
+	Note         string
+	Status       string
+	LocationID   int
+
+	// Способ оплаты и кассир, к открытой смене которого относится заказ.
+	// При RequireShift заказ без открытой смены отклоняется
+	PaymentMethod string
+	UserID        int
+	UserName      string
+	RequireShift  bool
+
+	// Телефон покупателя (нормализованный) и баллы к списанию; Loyalty
+	// заполняется в Usecase.AddOrder
+	CustomerPhone string
+	RedeemPoints  int
+	Loyalty       LoyaltyConfig
+
+	// Подарочная карта и сумма к списанию с неё; 0 — сколько возможно
+	GiftCardCode   string
+	GiftCardAmount float64
+
+	// Принять заказ в нерабочее время
+	OverrideClosed bool
+	// Рабочий день, по которому выдаётся номер очереди; заполняется в Usecase.AddOrder
+	BusinessDate string
+
+	// Время выдачи предзаказа и его слот; Slot заполняется в Usecase.AddOrder
+	PickupAt *time.Time
+	Slot     *PickupSlot
+
+	// Ключ идемпотентности и хеш тела запроса, пустой ключ отключает дедупликацию.
+	// Ключи действуют в пределах пользователя IdempotencyUserID; 0 — общий ключ,
+	// например для заказа по брони, который может открыть любой сотрудник.
+	IdempotencyKey    string
+	IdempotencyUserID int
+	RequestHash       string
+}
+
+var (
+	ErrIdempotencyKeyExists   = errors.New("idempotency key already used")
+	ErrIdempotencyKeyConflict = errors.New("idempotency key reused with a different request")
+)
+
+// Создание заказа. Повтор с тем же ключом и телом возвращает сохранённый
+// результат первого запроса (replayed = true).
+func (u *Usecase) AddOrder(req OrderRequest) (order Order, replayed bool, err error) {
+	if req.Type == "" {
+		req.Type = OrderTypeDineIn
+	}
+	if req.LocationID == 0 {
+		req.LocationID = u.defaultLocationID
+	}
+	if req.PaymentMethod == "" {
+		req.PaymentMethod = PaymentCash
+	}
+	req.RequireShift = u.requireShift
+	req.Loyalty = u.loyalty
+	if req.CustomerPhone != "" {
+		phone, err := normalizePhone(req.CustomerPhone)
+		if err != nil {
+			return Order{}, false, err
+		}
+		req.CustomerPhone = phone
+	} else if req.RedeemPoints > 0 {
+		return Order{}, false, fmt.Errorf("%w: points require a customer", ErrInvalidRedemption)
+	}
+	if req.GiftCardCode != "" {
+		code, err := normalizeGiftCardCode(req.GiftCardCode)
+		if err != nil {
+			return Order{}, false, err
+		}
+		req.GiftCardCode = code
+	}
+	hours, err := u.locationHours(req.LocationID)
+	if err != nil {
+		return Order{}, false, err
+	}
+	now := hours.Now()
+	req.Status = "В работе"
+	req.BusinessDate = hours.BusinessDate(now)
+	if req.PickupAt != nil {
+		slot, err := u.pickupSlot(hours, *req.PickupAt, now)
+		if err != nil {
+			return Order{}, false, err
+		}
+		req.Type = OrderTypePreOrder
+		req.Slot = &slot
+		if !u.preorderDue(*req.PickupAt, now) {
+			req.Status = "Запланирован"
+		}
+	} else if !u.acceptWhenClosed && !req.OverrideClosed && !hours.IsOpen(now) {
+		return Order{}, false, ErrClosed
+	}
+	order, err = u.p.AddOrder(req)
+	if err == nil {
+		created := order
+		u.events.Publish(EventOrderCreated, order.ID, order.LocationID, order.Status, &created)
+		u.fiscalizeOnStatus(order.ID, FiscalOnCreated)
+		return order, false, nil
+	}
+	if !errors.Is(err, ErrIdempotencyKeyExists) {
+		return Order{}, false, err
+	}
+
+	hash, response, err := u.p.FetchIdempotencyKey(req.IdempotencyUserID, req.IdempotencyKey)
+	if err != nil {
+		return Order{}, false, err
+	}
+	if hash != req.RequestHash {
+		return Order{}, false, ErrIdempotencyKeyConflict
+	}
+	if err := json.Unmarshal(response, &order); err != nil {
+		return Order{}, false, err
+	}
+	return order, true, nil
+}
+
+// Фильтры, сортировка и курсор для списка заказов
+type OrderFilter struct {
+	LocationID  int // 0 — все точки
+	Status      string
+	Type        string
+	TableNumber int
+	Upcoming    bool // только предзаказы с будущим временем выдачи
+	From        *time.Time
+	To          *time.Time
+	MinTotal    *float64
+	MaxTotal    *float64
+	MenuItemID  int
+	CustomerID  int
+
+	Sort   string // id, created_at или total
+	Desc   bool
+	Limit  int
+	Cursor string
+}
+
+type OrderPage struct {
+	Orders     []Order
+	TotalCount int
+	NextCursor string
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	DefaultOrdersLimit = 50
+	MaxOrdersLimit     = 200
+)
+
+func (u *Usecase) GetOrders(filter OrderFilter) (OrderPage, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultOrdersLimit
+	}
+	if filter.Limit > MaxOrdersLimit {
+		filter.Limit = MaxOrdersLimit
+	}
+	if filter.Sort == "" {
+		filter.Sort = "id"
+	}
+	return u.p.FetchOrders(filter)
+}
+func (u *Usecase) UpdateOrderStatus(orderID int, status, user string) error {
+	locationID, err := u.p.UpdateOrderStatus(orderID, status, user)
+	if err != nil {
+		return err
+	}
+	u.events.Publish(EventOrderStatusChanged, orderID, locationID, status, nil)
+	switch status {
+	case "Выполнен":
+		u.fiscalizeOnStatus(orderID, FiscalOnCompleted)
+	case "Отменен":
+		u.fiscalizeCancel(orderID)
+	}
+	return nil
 }
 
-func (u *Usecase) AddOrder(items []OrderItem) (Order, error) {
-	return u.p.AddOrder(items)
+// Удаление просроченных ключей идемпотентности
+func (u *Usecase) RunIdempotencyPurge(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		if err := u.p.PurgeIdempotencyKeys(u.idempotencyTTL); err != nil {
+			log.Printf("Error purging idempotency keys: %v", err)
+		}
+	}
 }
-func (u *Usecase) GetOrders() ([]Order, error) {
-	return u.p.FetchOrders()
+
+// Подписка на ленту событий заказов
+func (u *Usecase) SubscribeOrderEvents(epoch string, lastID int64) (<-chan OrderEvent, []OrderEvent, bool, func()) {
+	return u.events.Subscribe(epoch, lastID)
 }
-func (u *Usecase) UpdateOrderStatus(orderID int, status string) error {
-	return u.p.UpdateOrderStatus(orderID, status)
+
+// Короткоживущий билет на подключение к ленте событий от имени текущего пользователя
+func (u *Usecase) IssueStreamTicket(claims *vars.JWTClaims) (string, error) {
+	return u.jp.StreamTicket(claims)
 }
 
 type RevenueData struct {
@@ -112,8 +520,52 @@ type RevenueData struct {
 	Total    float64 `json:"total"`
 }
 
-func (u *Usecase) GetRevenue(period string) ([]RevenueData, error) {
-	return u.p.FetchRevenue(period)
+// Диапазон аналитики: с какого момента выбирать данные, формат группировки
+// для to_char, часовой пояс группировки и сдвиг на границу рабочего дня
+type AnalyticsRange struct {
+	LocationID int // 0 — сводно по всем точкам
+	Since      time.Time
+	Format     string
+	Location   *time.Location
+	Shift      time.Duration
+}
+
+// Периоды отсчитываются от начала текущего рабочего дня, а не от NOW(),
+// чтобы "сегодня" в 01:00 означало вчерашнюю смену. Пустой loc означает
+// часовой пояс точки, а в сводном отчёте — часовой пояс кафе.
+func (u *Usecase) analyticsRange(period string, loc *time.Location, locationID int) (AnalyticsRange, error) {
+	if loc == nil {
+		hours, err := u.locationHours(locationID)
+		if err != nil {
+			return AnalyticsRange{}, err
+		}
+		loc = hours.Location
+	}
+	dayStart := u.hours.DayStart(time.Now().In(loc))
+	r := AnalyticsRange{LocationID: locationID, Location: loc, Shift: u.hours.Cutoff}
+
+	switch period {
+	case "day":
+		r.Since, r.Format, r.Shift = dayStart, "HH24:00", 0
+	case "week":
+		r.Since, r.Format = dayStart.AddDate(0, 0, -6), "YYYY-MM-DD"
+	case "month":
+		r.Since, r.Format = dayStart.AddDate(0, -1, 0), "YYYY-MM-DD"
+	case "year":
+		r.Since, r.Format = dayStart.AddDate(-1, 0, 0), "YYYY-MM"
+	default:
+		return AnalyticsRange{}, errors.New("invalid period")
+	}
+	return r, nil
+}
+
+// Выручка за период; непустой orderType ограничивает выборку одним типом заказов
+func (u *Usecase) GetRevenue(period, orderType string, loc *time.Location, locationID int) ([]RevenueData, error) {
+	r, err := u.analyticsRange(period, loc, locationID)
+	if err != nil {
+		return nil, err
+	}
+	return u.p.FetchRevenue(r, orderType)
 }
 
 type OrderCountData struct {
@@ -122,6 +574,1346 @@ type OrderCountData struct {
 }
 
 // Метод для получения количества заказов
-func (u *Usecase) GetOrderCounts(period string) ([]OrderCountData, error) {
-	return u.p.FetchOrderCounts(period)
+func (u *Usecase) GetOrderCounts(period, orderType string, loc *time.Location, locationID int) ([]OrderCountData, error) {
+	r, err := u.analyticsRange(period, loc, locationID)
+	if err != nil {
+		return nil, err
+	}
+	return u.p.FetchOrderCounts(r, orderType)
+}
+
+type OrderTypeData struct {
+	OrderType string  `json:"order_type"`
+	Count     int     `json:"count"`
+	Total     float64 `json:"total"`
+}
+
+// Разбивка количества заказов и выручки по типам заказов за период
+func (u *Usecase) GetOrderTypeBreakdown(period string, loc *time.Location, locationID int) ([]OrderTypeData, error) {
+	r, err := u.analyticsRange(period, loc, locationID)
+	if err != nil {
+		return nil, err
+	}
+	return u.p.FetchOrderTypeBreakdown(r)
+}
+
+type BusinessStatus struct {
+	Open         bool   `json:"open"`
+	BusinessDate string `json:"business_date"`
+	DayStart     string `json:"day_start"`
+}
+
+// Часовой пояс точки; locationID = 0 — часовой пояс кафе
+func (u *Usecase) Location(locationID int) (*time.Location, error) {
+	hours, err := u.locationHours(locationID)
+	if err != nil {
+		return nil, err
+	}
+	return hours.Location, nil
+}
+
+// Расписание точки в её часовом поясе. Часы работы общие для всех точек,
+// 0 означает сводный режим и часовой пояс кафе.
+func (u *Usecase) locationHours(locationID int) (*BusinessHours, error) {
+	if locationID == 0 {
+		return u.hours, nil
+	}
+	location, err := u.p.FetchLocation(locationID)
+	if err != nil {
+		return nil, err
+	}
+	if location.Timezone == "" || location.Timezone == u.hours.Location.String() {
+		return u.hours, nil
+	}
+	tz, err := time.LoadLocation(location.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("location %d: %v", locationID, err)
+	}
+	return u.hours.In(tz), nil
+}
+
+// Открыто ли кафе сейчас и какой идёт рабочий день; locationID = 0 — по часовому поясу кафе
+func (u *Usecase) GetBusinessStatus(locationID int) (BusinessStatus, error) {
+	hours, err := u.locationHours(locationID)
+	if err != nil {
+		return BusinessStatus{}, err
+	}
+	now := hours.Now()
+	return BusinessStatus{
+		Open:         hours.IsOpen(now),
+		BusinessDate: hours.BusinessDate(now),
+		DayStart:     hours.DayStart(now).Format(time.RFC3339),
+	}, nil
+}
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrInvalidRefund = errors.New("invalid refund")
+)
+
+// Допустимые коды причин возврата
+var RefundReasons = map[string]bool{
+	"customer_request": true,
+	"wrong_item":       true,
+	"quality":          true,
+	"duplicate":        true,
+	"other":            true,
+}
+
+type RefundItem struct {
+	OrderItemId int     `json:"orderItemId"`
+	Quantity    int     `json:"quantity"`
+	Amount      float64 `json:"amount"`
+}
+
+type Refund struct {
+	ID      int     `json:"id"`
+	OrderID int     `json:"order_id"`
+	Amount  float64 `json:"amount"`
+	// Часть суммы, возвращённая баллами, а не деньгами
+	PointsAmount float64 `json:"points_amount"`
+	// Часть суммы, возвращённая на подарочные карты
+	GiftCardAmount float64      `json:"gift_card_amount"`
+	Reason         string       `json:"reason"`
+	Comment        string       `json:"comment"`
+	CreatedBy      string       `json:"created_by"`
+	CreatedAt      string       `json:"created_at"`
+	Items          []RefundItem `json:"items"`
+	// Возврат оказался полным, и заказ переведён в «Отменен»
+	OrderCancelled bool `json:"order_cancelled"`
+}
+
+// Возврат по заказу. Пустой список позиций означает полный возврат
+// всех ещё не возвращённых позиций.
+// Возврат относится к открытой смене сотрудника (userID), если она есть.
+func (u *Usecase) RefundOrder(orderID int, reason, comment, user string, userID int, items []RefundItem) (Refund, error) {
+	if !RefundReasons[reason] {
+		return Refund{}, fmt.Errorf("%w: unknown reason %q", ErrInvalidRefund, reason)
+	}
+	refund, err := u.p.AddRefund(orderID, reason, comment, user, userID, items)
+	if err != nil {
+		return Refund{}, err
+	}
+	if refund.OrderCancelled {
+		// Отмена полным возвратом видна ленте заказов и печати так же, как ручная
+		locationID, err := u.p.FetchOrderLocation(orderID)
+		if err != nil {
+			log.Printf("Error loading location of refunded order %d: %v", orderID, err)
+		}
+		u.events.Publish(EventOrderStatusChanged, orderID, locationID, "Отменен", nil)
+		// Неотправленный приход снимается, и тогда чек возврата не нужен
+		u.fiscalizeCancel(orderID)
+	}
+	u.fiscalizeRefund(refund)
+	return refund, nil
+}
+
+func (u *Usecase) GetRefunds(orderID int) ([]Refund, error) {
+	return u.p.FetchRefunds(orderID)
+}
+
+// Станция приготовления (бар, кухня), на которую направляются позиции меню
+type Station struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Открытая позиция заказа на экране станции
+type KDSLine struct {
+	OrderItemID    int    `json:"orderItemId"`
+	OrderID        int    `json:"order_id"`
+	MenuItemID     int    `json:"menuItemId"`
+	Name           string `json:"name"`
+	Quantity       int    `json:"quantity"`
+	Comment        string `json:"comment"`
+	OrderNote      string `json:"order_note"`
+	CreatedAt      string `json:"created_at"`
+	ElapsedSeconds int    `json:"elapsed_seconds"`
+}
+
+var (
+	ErrStationNotFound   = errors.New("station not found")
+	ErrOrderItemNotFound = errors.New("order item not found")
+)
+
+func (u *Usecase) GetStations() ([]Station, error) {
+	return u.p.FetchStations()
+}
+
+func (u *Usecase) AddStation(name string) (Station, error) {
+	return u.p.AddStation(name)
+}
+
+func (u *Usecase) DeleteStation(id int) error {
+	return u.p.DeleteStation(id)
+}
+
+// Привязка позиции меню к станции, nil снимает привязку
+func (u *Usecase) SetMenuItemStation(menuItemID int, stationID *int) error {
+	return u.p.SetMenuItemStation(menuItemID, stationID)
+}
+
+func (u *Usecase) GetStationLines(stationID, locationID int) ([]KDSLine, error) {
+	return u.p.FetchStationLines(stationID, locationID)
+}
+
+// Отметка позиции как готовой. Когда готовы все позиции заказа,
+// направленные на станции, заказ переводится в статус "Готов".
+func (u *Usecase) BumpOrderItem(orderItemID int) (orderID int, orderReady bool, err error) {
+	order, orderReady, err := u.p.BumpOrderItem(orderItemID)
+	if err != nil {
+		return 0, false, err
+	}
+	if orderReady {
+		u.events.Publish(EventOrderStatusChanged, order.ID, order.LocationID, order.Status, nil)
+	}
+	return order.ID, orderReady, nil
+}
+
+var (
+	ErrOrderNotEditable = errors.New("order is not editable")
+	ErrOrderFiscalized  = errors.New("order has a fiscal receipt")
+	ErrInvalidOrderEdit = errors.New("invalid order edit")
+)
+
+const (
+	OrderAuditItemAdded   = "item_added"
+	OrderAuditItemChanged = "item_changed"
+	OrderAuditItemRemoved = "item_removed"
+	EventOrderUpdated     = "order.updated"
+)
+
+// Запись журнала изменений заказа
+type OrderAuditEntry struct {
+	ID          int    `json:"id"`
+	OrderID     int    `json:"order_id"`
+	Action      string `json:"action"`
+	OrderItemID int    `json:"orderItemId"`
+	MenuItemID  int    `json:"menuItemId"`
+	OldQuantity int    `json:"old_quantity"`
+	NewQuantity int    `json:"new_quantity"`
+	CreatedBy   string `json:"created_by"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func (u *Usecase) GetOrder(orderID int) (Order, error) {
+	return u.p.FetchOrder(orderID)
+}
+
+func (u *Usecase) AddOrderLine(orderID int, item OrderItem, user string) (Order, error) {
+	if err := u.p.AddOrderLine(orderID, item, user, u.loyalty); err != nil {
+		return Order{}, err
+	}
+	return u.orderUpdated(orderID)
+}
+
+func (u *Usecase) ChangeOrderLine(orderID, orderItemID, quantity int, user string) (Order, error) {
+	if err := u.p.ChangeOrderLine(orderID, orderItemID, quantity, user, u.loyalty); err != nil {
+		return Order{}, err
+	}
+	return u.orderUpdated(orderID)
+}
+
+func (u *Usecase) RemoveOrderLine(orderID, orderItemID int, user string) (Order, error) {
+	if err := u.p.RemoveOrderLine(orderID, orderItemID, user, u.loyalty); err != nil {
+		return Order{}, err
+	}
+	return u.orderUpdated(orderID)
+}
+
+// Перечитывает заказ после изменения и оповещает подписчиков
+func (u *Usecase) orderUpdated(orderID int) (Order, error) {
+	order, err := u.p.FetchOrder(orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	updated := order
+	u.events.Publish(EventOrderUpdated, order.ID, order.LocationID, order.Status, &updated)
+	return order, nil
+}
+
+func (u *Usecase) GetOrderAudit(orderID int) ([]OrderAuditEntry, error) {
+	return u.p.FetchOrderAudit(orderID)
+}
+
+var (
+	ErrClosed            = errors.New("cafe is closed")
+	ErrPickupUnavailable = errors.New("pickup time unavailable")
+	ErrSlotFull          = errors.New("pickup slot is full")
+)
+
+// Слот выдачи предзаказа и его вместимость
+type PickupSlot struct {
+	Start    time.Time
+	End      time.Time
+	Capacity int
+}
+
+// Проверка времени выдачи по расписанию точки и вычисление его слота
+func (u *Usecase) pickupSlot(hours *BusinessHours, pickupAt, now time.Time) (PickupSlot, error) {
+	cfg := u.preorders
+
+	if pickupAt.Before(now.Add(time.Duration(cfg.MinLeadMinutes) * time.Minute)) {
+		return PickupSlot{}, fmt.Errorf("%w: at least %d minutes ahead required", ErrPickupUnavailable, cfg.MinLeadMinutes)
+	}
+	if cfg.MaxDaysAhead > 0 && pickupAt.After(now.AddDate(0, 0, cfg.MaxDaysAhead)) {
+		return PickupSlot{}, fmt.Errorf("%w: at most %d days ahead allowed", ErrPickupUnavailable, cfg.MaxDaysAhead)
+	}
+
+	local := pickupAt.In(hours.Location)
+	if !hours.IsOpen(local) {
+		return PickupSlot{}, fmt.Errorf("%w: cafe is closed at that time", ErrPickupUnavailable)
+	}
+
+	size := time.Duration(cfg.SlotMinutes) * time.Minute
+	if size <= 0 {
+		size = 15 * time.Minute
+	}
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	start := midnight.Add(local.Sub(midnight) / size * size)
+
+	return PickupSlot{Start: start, End: start.Add(size), Capacity: cfg.SlotCapacity}, nil
+}
+
+// Пора ли передавать предзаказ на кухню
+func (u *Usecase) preorderDue(pickupAt, now time.Time) bool {
+	return !pickupAt.After(now.Add(time.Duration(u.preorders.ReleaseMinutes) * time.Minute))
+}
+
+// Периодически переводит запланированные предзаказы в работу
+func (u *Usecase) RunPreorderRelease(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		orders, err := u.p.ReleasePreorders(u.preorders.ReleaseMinutes)
+		if err != nil {
+			log.Printf("Error releasing pre-orders: %v", err)
+			continue
+		}
+		for _, order := range orders {
+			u.events.Publish(EventOrderStatusChanged, order.ID, order.LocationID, order.Status, nil)
+		}
+	}
+}
+
+// Точка продаж (кафе)
+type Location struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Timezone string `json:"timezone"`
+}
+
+var ErrLocationNotFound = errors.New("location not found")
+
+// Точки, доступные пользователю: владельцу все, сотруднику выданные
+func (u *Usecase) GetLocations(claims *vars.JWTClaims) ([]Location, error) {
+	if claims.Role == vars.RoleOwner {
+		return u.p.FetchLocations(nil)
+	}
+	return u.p.FetchLocations(claims.Locations)
+}
+
+func (u *Usecase) AddLocation(loc Location) (Location, error) {
+	if loc.Timezone == "" {
+		loc.Timezone = u.hours.Location.String()
+	}
+	if _, err := time.LoadLocation(loc.Timezone); err != nil {
+		return Location{}, fmt.Errorf("invalid timezone %q: %v", loc.Timezone, err)
+	}
+	return u.p.AddLocation(loc)
+}
+
+func (u *Usecase) SetMenuLocationPrice(locationID, menuItemID int, price *float64, available bool) error {
+	return u.p.SetMenuLocationPrice(locationID, menuItemID, price, available)
+}
+
+func (u *Usecase) DeleteMenuLocationPrice(locationID, menuItemID int) error {
+	return u.p.DeleteMenuLocationPrice(locationID, menuItemID)
+}
+
+func (u *Usecase) GrantLocation(userID, locationID int) error {
+	return u.p.GrantLocation(userID, locationID)
+}
+
+func (u *Usecase) RevokeLocation(userID, locationID int) error {
+	return u.p.RevokeLocation(userID, locationID)
+}
+
+func (u *Usecase) GetOrderLocation(orderID int) (int, error) {
+	return u.p.FetchOrderLocation(orderID)
+}
+
+func (u *Usecase) GetOrderItemLocation(orderItemID int) (int, error) {
+	return u.p.FetchOrderItemLocation(orderItemID)
+}
+
+func (u *Usecase) DefaultLocationID() int {
+	return u.defaultLocationID
+}
+
+// Кассовая смена сотрудника в точке
+type Shift struct {
+	ID           int      `json:"id"`
+	UserID       int      `json:"user_id"`
+	LocationID   int      `json:"location_id"`
+	OpeningFloat float64  `json:"opening_float"`
+	CountedCash  *float64 `json:"counted_cash"`
+	ExpectedCash *float64 `json:"expected_cash"`
+	OpenedAt     string   `json:"opened_at"`
+	ClosedAt     *string  `json:"closed_at"`
+}
+
+// Виды операций с наличными в кассе
+const (
+	CashIn  = "in"
+	CashOut = "out"
+)
+
+type CashOperation struct {
+	ID        int     `json:"id"`
+	ShiftID   int     `json:"shift_id"`
+	Kind      string  `json:"kind"`
+	Amount    float64 `json:"amount"`
+	Comment   string  `json:"comment"`
+	CreatedBy string  `json:"created_by"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// Виды отчётов по смене: промежуточный и закрывающий
+const (
+	ReportX = "X"
+	ReportZ = "Z"
+)
+
+// Отчёт по смене. Продажи и возвраты разбиты по способам оплаты;
+// ожидаемая сумма в кассе — разменная сумма плюс наличные движения.
+type ShiftReport struct {
+	Kind        string             `json:"kind"`
+	Shift       Shift              `json:"shift"`
+	OrdersCount int                `json:"orders_count"`
+	Sales       map[string]float64 `json:"sales"`
+	Refunds     map[string]float64 `json:"refunds"`
+	// Продажи и пополнения подарочных карт по способам оплаты
+	GiftCardSales map[string]float64 `json:"gift_card_sales"`
+	CashIn        float64            `json:"cash_in"`
+	CashOut       float64            `json:"cash_out"`
+	ExpectedCash  float64            `json:"expected_cash"`
+	CountedCash   *float64           `json:"counted_cash"`
+	Discrepancy   *float64           `json:"discrepancy"`
+	Operations    []CashOperation    `json:"operations"`
+}
+
+func (r *ShiftReport) calcExpectedCash() {
+	r.ExpectedCash = r.Shift.OpeningFloat + r.Sales[PaymentCash] - r.Refunds[PaymentCash] +
+		r.GiftCardSales[PaymentCash] + r.CashIn - r.CashOut
+}
+
+var (
+	ErrNoOpenShift          = errors.New("no open shift")
+	ErrShiftAlreadyOpen     = errors.New("shift already open")
+	ErrShiftNotFound        = errors.New("shift not found")
+	ErrInvalidCashOperation = errors.New("invalid cash operation")
+)
+
+func (u *Usecase) OpenShift(userID, locationID int, openingFloat float64) (Shift, error) {
+	if locationID == 0 {
+		locationID = u.defaultLocationID
+	}
+	return u.p.OpenShift(userID, locationID, openingFloat)
+}
+
+func (u *Usecase) GetCurrentShift(userID int) (Shift, error) {
+	return u.p.FetchOpenShift(userID)
+}
+
+// Список смен; userID = 0 — смены всех сотрудников, locationID = 0 — всех точек
+func (u *Usecase) GetShifts(userID, locationID int) ([]Shift, error) {
+	return u.p.FetchShifts(userID, locationID)
+}
+
+func (u *Usecase) GetShift(shiftID int) (Shift, error) {
+	return u.p.FetchShift(shiftID)
+}
+
+// Внесение или изъятие наличных в открытой смене сотрудника
+func (u *Usecase) AddCashOperation(userID int, op CashOperation) (CashOperation, error) {
+	if op.Kind != CashIn && op.Kind != CashOut {
+		return CashOperation{}, fmt.Errorf("%w: unknown kind %q", ErrInvalidCashOperation, op.Kind)
+	}
+	if op.Amount <= 0 {
+		return CashOperation{}, fmt.Errorf("%w: amount must be positive", ErrInvalidCashOperation)
+	}
+	return u.p.AddCashOperation(userID, op)
+}
+
+// X-отчёт по открытой смене сотрудника
+func (u *Usecase) GetXReport(userID int) (ShiftReport, error) {
+	shift, err := u.p.FetchOpenShift(userID)
+	if err != nil {
+		return ShiftReport{}, err
+	}
+	return u.p.FetchShiftReport(shift.ID)
+}
+
+// Отчёт по смене: X для открытой, Z для закрытой
+func (u *Usecase) GetShiftReport(shiftID int) (ShiftReport, error) {
+	return u.p.FetchShiftReport(shiftID)
+}
+
+// Закрытие смены с пересчитанной суммой наличных; возвращает Z-отчёт
+func (u *Usecase) CloseShift(userID int, countedCash float64) (ShiftReport, error) {
+	if countedCash < 0 {
+		return ShiftReport{}, fmt.Errorf("%w: counted cash must not be negative", ErrInvalidCashOperation)
+	}
+	shiftID, err := u.p.CloseShift(userID, countedCash)
+	if err != nil {
+		return ShiftReport{}, err
+	}
+	return u.p.FetchShiftReport(shiftID)
+}
+
+// Покупатель программы лояльности. Visits, TotalSpent и LastVisit
+// считаются по заказам покупателя с учётом возвратов.
+type Customer struct {
+	ID             int        `json:"id"`
+	Phone          string     `json:"phone"`
+	Name           string     `json:"name"`
+	Points         int        `json:"points"`
+	PointsExpireAt *time.Time `json:"points_expire_at"`
+	CreatedAt      string     `json:"created_at"`
+	Visits         int        `json:"visits"`
+	TotalSpent     float64    `json:"total_spent"`
+	LastVisit      *time.Time `json:"last_visit"`
+}
+
+// Виды движений баллов
+const (
+	LoyaltyEarn   = "earn"
+	LoyaltyRedeem = "redeem"
+	LoyaltyExpire = "expire"
+	LoyaltyRefund = "refund"
+)
+
+type LoyaltyTransaction struct {
+	ID         int    `json:"id"`
+	CustomerID int    `json:"customer_id"`
+	OrderID    *int   `json:"order_id"`
+	Kind       string `json:"kind"`
+	Points     int    `json:"points"`
+	CreatedAt  string `json:"created_at"`
+}
+
+var (
+	ErrInvalidPhone      = errors.New("invalid phone number")
+	ErrCustomerNotFound  = errors.New("customer not found")
+	ErrCustomerExists    = errors.New("customer already exists")
+	ErrInvalidRedemption = errors.New("invalid points redemption")
+)
+
+const MaxCustomerPhoneSize = 15
+
+// Номер телефона в виде цифр с кодом страны; российские номера
+// вида 8XXXXXXXXXX и XXXXXXXXXX приводятся к 7XXXXXXXXXX
+func normalizePhone(s string) (string, error) {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' || r == '-' || r == '(' || r == ')' || unicode.IsSpace(r):
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	phone := b.String()
+	switch {
+	case len(phone) == 10:
+		phone = "7" + phone
+	case len(phone) == 11 && phone[0] == '8':
+		phone = "7" + phone[1:]
+	}
+	if len(phone) < 11 || len(phone) > MaxCustomerPhoneSize {
+		return "", ErrInvalidPhone
+	}
+	return phone, nil
+}
+
+// Поиск покупателей по телефону или имени; пустой запрос возвращает последних
+func (u *Usecase) GetCustomers(query string) ([]Customer, error) {
+	return u.p.FetchCustomers(query)
+}
+
+func (u *Usecase) GetCustomer(id int) (Customer, error) {
+	return u.p.FetchCustomer(id)
+}
+
+func (u *Usecase) AddCustomer(phone, name string) (Customer, error) {
+	phone, err := normalizePhone(phone)
+	if err != nil {
+		return Customer{}, err
+	}
+	return u.p.AddCustomer(phone, name)
+}
+
+func (u *Usecase) UpdateCustomer(id int, name string) (Customer, error) {
+	return u.p.UpdateCustomer(id, name)
+}
+
+func (u *Usecase) GetCustomerPoints(id int) ([]LoyaltyTransaction, error) {
+	return u.p.FetchLoyaltyTransactions(id)
+}
+
+// Программа штампов: карта заполняется за StampsRequired подходящих порций,
+// после чего одна подходящая позиция следующего заказа выдаётся бесплатно.
+// Подходящими считаются позиции из MenuItemIDs и позиции категорий Categories.
+type StampProgram struct {
+	ID             int      `json:"id"`
+	Name           string   `json:"name"`
+	StampsRequired int      `json:"stamps_required"`
+	MenuItemIDs    []int64  `json:"menu_item_ids"`
+	Categories     []string `json:"categories"`
+	Active         bool     `json:"active"`
+}
+
+func (p StampProgram) Matches(menuItemID int, category string) bool {
+	for _, id := range p.MenuItemIDs {
+		if int(id) == menuItemID {
+			return true
+		}
+	}
+	for _, c := range p.Categories {
+		if category != "" && c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Карта штампов покупателя по программе
+type StampCard struct {
+	ProgramID      int    `json:"program_id"`
+	ProgramName    string `json:"program_name"`
+	Stamps         int    `json:"stamps"`
+	StampsRequired int    `json:"stamps_required"`
+	RewardReady    bool   `json:"reward_ready"`
+}
+
+// Виды записей журнала штампов
+const (
+	StampEarn         = "stamp"
+	StampReverse      = "unstamp"
+	StampReward       = "reward"
+	StampRewardReturn = "reward_return"
+)
+
+var (
+	ErrStampProgramNotFound = errors.New("stamp program not found")
+	ErrInvalidStampProgram  = errors.New("invalid stamp program")
+)
+
+func (u *Usecase) GetStampPrograms() ([]StampProgram, error) {
+	return u.p.FetchStampPrograms()
+}
+
+// Проверка программы; пустые списки приводятся к пустым массивам для базы
+func validateStampProgram(program *StampProgram) error {
+	if program.MenuItemIDs == nil {
+		program.MenuItemIDs = []int64{}
+	}
+	if program.Categories == nil {
+		program.Categories = []string{}
+	}
+	if program.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidStampProgram)
+	}
+	if program.StampsRequired <= 0 {
+		return fmt.Errorf("%w: stamps_required must be positive", ErrInvalidStampProgram)
+	}
+	if len(program.MenuItemIDs) == 0 && len(program.Categories) == 0 {
+		return fmt.Errorf("%w: menu items or categories are required", ErrInvalidStampProgram)
+	}
+	return nil
+}
+
+func (u *Usecase) AddStampProgram(program StampProgram) (StampProgram, error) {
+	if err := validateStampProgram(&program); err != nil {
+		return StampProgram{}, err
+	}
+	return u.p.AddStampProgram(program)
+}
+
+func (u *Usecase) UpdateStampProgram(program StampProgram) (StampProgram, error) {
+	if err := validateStampProgram(&program); err != nil {
+		return StampProgram{}, err
+	}
+	return u.p.UpdateStampProgram(program)
+}
+
+func (u *Usecase) GetCustomerStamps(customerID int) ([]StampCard, error) {
+	return u.p.FetchStampCards(customerID)
+}
+
+// Подарочная карта. Выпущенная карта (issued) становится действующей (active)
+// после активации, то есть продажи покупателю; аннулированная — void.
+type GiftCard struct {
+	ID            int                   `json:"id"`
+	Code          string                `json:"code"`
+	Status        string                `json:"status"`
+	InitialAmount float64               `json:"initial_amount"`
+	Balance       float64               `json:"balance"`
+	ExpiresAt     *time.Time            `json:"expires_at"`
+	Expired       bool                  `json:"expired"`
+	CreatedBy     string                `json:"created_by"`
+	CreatedAt     string                `json:"created_at"`
+	ActivatedAt   *time.Time            `json:"activated_at"`
+	Transactions  []GiftCardTransaction `json:"transactions,omitempty"`
+}
+
+// Статусы подарочных карт
+const (
+	GiftCardIssued = "issued"
+	GiftCardActive = "active"
+	GiftCardVoid   = "void"
+)
+
+// Виды операций по подарочным картам
+const (
+	GiftCardActivate = "activate"
+	GiftCardTopUp    = "topup"
+	GiftCardRedeem   = "redeem"
+	GiftCardRefund   = "refund"
+	GiftCardVoidOp   = "void"
+)
+
+type GiftCardTransaction struct {
+	ID            int     `json:"id"`
+	GiftCardID    int     `json:"gift_card_id"`
+	Kind          string  `json:"kind"`
+	Amount        float64 `json:"amount"`
+	OrderID       *int    `json:"order_id"`
+	PaymentMethod string  `json:"payment_method"`
+	ShiftID       *int    `json:"shift_id"`
+	CreatedBy     string  `json:"created_by"`
+	CreatedAt     string  `json:"created_at"`
+}
+
+// Обязательства по действующим картам: неизрасходованные остатки.
+// Остатки на просроченных картах показываются отдельно.
+type GiftCardLiability struct {
+	ActiveCards    int     `json:"active_cards"`
+	Outstanding    float64 `json:"outstanding"`
+	ExpiredCards   int     `json:"expired_cards"`
+	ExpiredBalance float64 `json:"expired_balance"`
+}
+
+var (
+	ErrGiftCardNotFound  = errors.New("gift card not found")
+	ErrGiftCardExists    = errors.New("gift card code already exists")
+	ErrInvalidGiftCard   = errors.New("invalid gift card operation")
+	ErrInvalidCardCode   = errors.New("invalid gift card code")
+	ErrGiftCardExpired   = errors.New("gift card expired")
+	ErrGiftCardNotActive = errors.New("gift card is not active")
+)
+
+// Алфавит кодов без легко путаемых символов (0/O, 1/I)
+const giftCardAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const giftCardCodeSize = 16
+
+func generateGiftCardCode() (string, error) {
+	buf := make([]byte, giftCardCodeSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = giftCardAlphabet[int(b)%len(giftCardAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// Код карты без пробелов и дефисов в верхнем регистре
+func normalizeGiftCardCode(s string) (string, error) {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		switch {
+		case r == '-' || unicode.IsSpace(r):
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			b.WriteRune(r)
+		default:
+			return "", ErrInvalidCardCode
+		}
+	}
+	code := b.String()
+	if len(code) < 4 || len(code) > 32 {
+		return "", ErrInvalidCardCode
+	}
+	return code, nil
+}
+
+// Выпуск карты на сумму amount. Пустой code генерирует новый код,
+// иначе используется номер уже напечатанного сертификата.
+func (u *Usecase) IssueGiftCard(code string, amount float64, user string) (GiftCard, error) {
+	if amount <= 0 {
+		return GiftCard{}, fmt.Errorf("%w: amount must be positive", ErrInvalidGiftCard)
+	}
+	if code != "" {
+		code, err := normalizeGiftCardCode(code)
+		if err != nil {
+			return GiftCard{}, err
+		}
+		return u.p.AddGiftCard(code, amount, user)
+	}
+
+	for attempt := 0; ; attempt++ {
+		code, err := generateGiftCardCode()
+		if err != nil {
+			return GiftCard{}, err
+		}
+		card, err := u.p.AddGiftCard(code, amount, user)
+		if errors.Is(err, ErrGiftCardExists) && attempt < 3 {
+			continue
+		}
+		return card, err
+	}
+}
+
+func (u *Usecase) GetGiftCard(code string) (GiftCard, error) {
+	code, err := normalizeGiftCardCode(code)
+	if err != nil {
+		return GiftCard{}, err
+	}
+	return u.p.FetchGiftCard(code)
+}
+
+// Активация (продажа) карты; деньги за карту учитываются в смене сотрудника
+func (u *Usecase) ActivateGiftCard(code, paymentMethod string, userID int, user string) (GiftCard, error) {
+	code, err := normalizeGiftCardCode(code)
+	if err != nil {
+		return GiftCard{}, err
+	}
+	if !PaymentMethods[paymentMethod] {
+		return GiftCard{}, fmt.Errorf("%w: unknown payment method %q", ErrInvalidGiftCard, paymentMethod)
+	}
+	return u.p.ActivateGiftCard(code, paymentMethod, u.giftCards.ValidityDays, userID, user, u.requireShift)
+}
+
+func (u *Usecase) TopUpGiftCard(code string, amount float64, paymentMethod string, userID int, user string) (GiftCard, error) {
+	code, err := normalizeGiftCardCode(code)
+	if err != nil {
+		return GiftCard{}, err
+	}
+	if amount <= 0 {
+		return GiftCard{}, fmt.Errorf("%w: amount must be positive", ErrInvalidGiftCard)
+	}
+	if !PaymentMethods[paymentMethod] {
+		return GiftCard{}, fmt.Errorf("%w: unknown payment method %q", ErrInvalidGiftCard, paymentMethod)
+	}
+	return u.p.TopUpGiftCard(code, amount, paymentMethod, userID, user, u.requireShift)
+}
+
+// Частичная оплата картой уже созданного заказа; amount = 0 — сколько возможно
+func (u *Usecase) RedeemGiftCard(code string, orderID int, amount float64, user string) (Order, error) {
+	code, err := normalizeGiftCardCode(code)
+	if err != nil {
+		return Order{}, err
+	}
+	if amount < 0 {
+		return Order{}, fmt.Errorf("%w: amount must not be negative", ErrInvalidGiftCard)
+	}
+	if err := u.p.RedeemGiftCard(code, orderID, amount, user); err != nil {
+		return Order{}, err
+	}
+	return u.orderUpdated(orderID)
+}
+
+func (u *Usecase) VoidGiftCard(code, user string) (GiftCard, error) {
+	code, err := normalizeGiftCardCode(code)
+	if err != nil {
+		return GiftCard{}, err
+	}
+	return u.p.VoidGiftCard(code, user)
+}
+
+func (u *Usecase) GetGiftCardLiability() (GiftCardLiability, error) {
+	return u.p.FetchGiftCardLiability()
+}
+
+// Стол в зале точки; zone — зал или зона (терраса, второй этаж)
+type DiningTable struct {
+	ID         int    `json:"id"`
+	LocationID int    `json:"location_id"`
+	Number     int    `json:"number"`
+	Capacity   int    `json:"capacity"`
+	Zone       string `json:"zone"`
+	Active     bool   `json:"active"`
+}
+
+// Бронь стола. Из booked бронь переходит в seated, когда гости пришли,
+// в no_show, если не пришли, или отменяется (cancelled).
+type Reservation struct {
+	ID          int       `json:"id"`
+	LocationID  int       `json:"location_id"`
+	TableID     int       `json:"table_id"`
+	TableNumber int       `json:"table_number"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+	PartySize   int       `json:"party_size"`
+	GuestName   string    `json:"guest_name"`
+	Phone       string    `json:"phone"`
+	Comment     string    `json:"comment"`
+	Status      string    `json:"status"`
+	OrderID     *int      `json:"order_id"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   string    `json:"created_at"`
+}
+
+// Статусы брони
+const (
+	ReservationBooked    = "booked"
+	ReservationSeated    = "seated"
+	ReservationNoShow    = "no_show"
+	ReservationCancelled = "cancelled"
+)
+
+// Допустимые переходы статусов брони
+var reservationTransitions = map[string]map[string]bool{
+	ReservationBooked: {ReservationSeated: true, ReservationNoShow: true, ReservationCancelled: true},
+}
+
+// Длительность брони, если в настройках она не задана
+const defaultReservationDuration = 2 * time.Hour
+
+var (
+	ErrTableNotFound       = errors.New("table not found")
+	ErrTableExists         = errors.New("table number already exists")
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationConflict = errors.New("table is already booked for this time")
+	ErrInvalidReservation  = errors.New("invalid reservation")
+)
+
+// Промежуток времени [From, To)
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Занятость стола за день и свободные окна не короче стандартной брони
+type TableAvailability struct {
+	Table DiningTable `json:"table"`
+	Busy  []TimeRange `json:"busy"`
+	Free  []TimeRange `json:"free"`
+}
+
+type Availability struct {
+	Date   string              `json:"date"`
+	Closed bool                `json:"closed"`
+	Open   *time.Time          `json:"open"`
+	Close  *time.Time          `json:"close"`
+	Tables []TableAvailability `json:"tables"`
+}
+
+func (u *Usecase) reservationDuration() time.Duration {
+	if u.reservations.DefaultDurationMinutes > 0 {
+		return time.Duration(u.reservations.DefaultDurationMinutes) * time.Minute
+	}
+	return defaultReservationDuration
+}
+
+func validateTable(table DiningTable) error {
+	switch {
+	case table.Number <= 0:
+		return fmt.Errorf("%w: table number must be positive", ErrInvalidReservation)
+	case table.Capacity <= 0:
+		return fmt.Errorf("%w: capacity must be positive", ErrInvalidReservation)
+	case utf8.RuneCountInString(table.Zone) > 64:
+		return fmt.Errorf("%w: zone is too long", ErrInvalidReservation)
+	}
+	return nil
+}
+
+// Столы точки; locationID = 0 возвращает столы всех точек
+func (u *Usecase) GetTables(locationID int) ([]DiningTable, error) {
+	return u.p.FetchTables(locationID)
+}
+
+func (u *Usecase) GetTable(id int) (DiningTable, error) {
+	return u.p.FetchTable(id)
+}
+
+func (u *Usecase) AddTable(table DiningTable) (DiningTable, error) {
+	if err := validateTable(table); err != nil {
+		return DiningTable{}, err
+	}
+	return u.p.AddTable(table)
+}
+
+func (u *Usecase) UpdateTable(table DiningTable) (DiningTable, error) {
+	if err := validateTable(table); err != nil {
+		return DiningTable{}, err
+	}
+	return u.p.UpdateTable(table)
+}
+
+// Границы рабочего дня date (YYYY-MM-DD) по расписанию hours
+func businessDay(hours *BusinessHours, date string) (from, to time.Time, err error) {
+	midnight, err := time.ParseInLocation("2006-01-02", date, hours.Location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	from = midnight.Add(hours.Cutoff)
+	return from, from.Add(24 * time.Hour), nil
+}
+
+// Брони точки за рабочий день date; пустой date — текущий день.
+// Пустой status не ограничивает выборку.
+func (u *Usecase) GetReservations(locationID int, date, status string) ([]Reservation, error) {
+	hours, err := u.locationHours(locationID)
+	if err != nil {
+		return nil, err
+	}
+	if date == "" {
+		date = hours.BusinessDate(hours.Now())
+	}
+	from, to, err := businessDay(hours, date)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid date", ErrInvalidReservation)
+	}
+	var statuses []string
+	if status != "" {
+		statuses = []string{status}
+	}
+	return u.p.FetchReservations(locationID, from, to, statuses)
+}
+
+func (u *Usecase) GetReservation(id int) (Reservation, error) {
+	return u.p.FetchReservation(id)
+}
+
+// Проверка брони перед записью: duration = 0 означает стандартную длительность.
+// Бронь должна целиком попадать в часы работы своего рабочего дня по времени точки.
+func (u *Usecase) prepareReservation(r *Reservation, duration time.Duration) error {
+	if duration == 0 {
+		duration = u.reservationDuration()
+	}
+	if duration < 0 || duration > 24*time.Hour {
+		return fmt.Errorf("%w: invalid duration", ErrInvalidReservation)
+	}
+	if r.PartySize <= 0 {
+		return fmt.Errorf("%w: party size must be positive", ErrInvalidReservation)
+	}
+	if r.GuestName == "" {
+		return fmt.Errorf("%w: guest name is required", ErrInvalidReservation)
+	}
+	if r.Phone != "" {
+		phone, err := normalizePhone(r.Phone)
+		if err != nil {
+			return err
+		}
+		r.Phone = phone
+	}
+
+	hours, err := u.locationHours(r.LocationID)
+	if err != nil {
+		return err
+	}
+	r.StartsAt = r.StartsAt.In(hours.Location)
+	r.EndsAt = r.StartsAt.Add(duration)
+	if !r.EndsAt.After(hours.Now()) {
+		return fmt.Errorf("%w: reservation is in the past", ErrInvalidReservation)
+	}
+
+	open, closeAt, closed, err := hours.OpeningWindow(hours.BusinessDate(r.StartsAt))
+	if err != nil {
+		return err
+	}
+	if closed || r.StartsAt.Before(open) || r.EndsAt.After(closeAt) {
+		return fmt.Errorf("%w: reservation is outside opening hours", ErrInvalidReservation)
+	}
+	return nil
+}
+
+func (u *Usecase) AddReservation(r Reservation, duration time.Duration) (Reservation, error) {
+	if err := u.prepareReservation(&r, duration); err != nil {
+		return Reservation{}, err
+	}
+	return u.p.AddReservation(r)
+}
+
+// Перенос брони на другое время, стол или состав гостей; только для booked
+func (u *Usecase) UpdateReservation(r Reservation, duration time.Duration) (Reservation, error) {
+	if err := u.prepareReservation(&r, duration); err != nil {
+		return Reservation{}, err
+	}
+	return u.p.UpdateReservation(r)
+}
+
+func (u *Usecase) SetReservationStatus(id int, status string) (Reservation, error) {
+	switch status {
+	case ReservationBooked, ReservationSeated, ReservationNoShow, ReservationCancelled:
+	default:
+		return Reservation{}, fmt.Errorf("%w: unknown status %q", ErrInvalidReservation, status)
+	}
+	return u.p.SetReservationStatus(id, status)
+}
+
+// Занятость подходящих по вместимости столов точки в рабочий день date.
+// Свободные окна начинаются не раньше текущего момента.
+func (u *Usecase) GetAvailability(locationID int, date string, partySize int) (Availability, error) {
+	hours, err := u.locationHours(locationID)
+	if err != nil {
+		return Availability{}, err
+	}
+	if date == "" {
+		date = hours.BusinessDate(hours.Now())
+	}
+	open, closeAt, closed, err := hours.OpeningWindow(date)
+	if err != nil {
+		return Availability{}, fmt.Errorf("%w: invalid date", ErrInvalidReservation)
+	}
+	availability := Availability{Date: date, Closed: closed, Tables: []TableAvailability{}}
+	if closed {
+		return availability, nil
+	}
+	availability.Open = &open
+	availability.Close = &closeAt
+
+	tables, err := u.p.FetchTables(locationID)
+	if err != nil {
+		return Availability{}, err
+	}
+	reservations, err := u.p.FetchReservations(locationID, open, closeAt, []string{ReservationBooked, ReservationSeated})
+	if err != nil {
+		return Availability{}, err
+	}
+	busy := make(map[int][]TimeRange)
+	for _, r := range reservations {
+		busy[r.TableID] = append(busy[r.TableID], TimeRange{From: r.StartsAt, To: r.EndsAt})
+	}
+
+	from := open
+	if now := hours.Now(); now.After(from) {
+		from = now
+	}
+	minFree := u.reservationDuration()
+	for _, table := range tables {
+		if !table.Active || table.Capacity < partySize {
+			continue
+		}
+		ta := TableAvailability{Table: table, Busy: busy[table.ID], Free: []TimeRange{}}
+		if ta.Busy == nil {
+			ta.Busy = []TimeRange{}
+		}
+
+		// Брони отсортированы по началу, свободные окна — промежутки между ними
+		cursor := from
+		for _, b := range append(ta.Busy, TimeRange{From: closeAt, To: closeAt}) {
+			if b.From.Sub(cursor) >= minFree {
+				ta.Free = append(ta.Free, TimeRange{From: cursor, To: b.From})
+			}
+			if b.To.After(cursor) {
+				cursor = b.To
+			}
+		}
+		availability.Tables = append(availability.Tables, ta)
+	}
+	return availability, nil
+}
+
+// Открытие заказа в зале по брони, за которой уже сидят гости. Заказ
+// создаётся один раз: повторный вызов возвращает ранее открытый заказ.
+func (u *Usecase) OpenReservationOrder(id int, req OrderRequest) (Order, bool, error) {
+	r, err := u.p.FetchReservation(id)
+	if err != nil {
+		return Order{}, false, err
+	}
+	if r.OrderID != nil {
+		order, err := u.p.FetchOrder(*r.OrderID)
+		return order, true, err
+	}
+	if r.Status != ReservationSeated {
+		return Order{}, false, fmt.Errorf("%w: guests are not seated", ErrInvalidReservation)
+	}
+
+	tableNumber := r.TableNumber
+	req.Type = OrderTypeDineIn
+	req.TableNumber = &tableNumber
+	req.CustomerName = r.GuestName
+	req.CustomerPhone = r.Phone
+	req.LocationID = r.LocationID
+	req.PickupAt = nil
+	req.OverrideClosed = true
+	req.IdempotencyKey = fmt.Sprintf("reservation:%d", r.ID)
+
+	order, replayed, err := u.AddOrder(req)
+	if err != nil {
+		return Order{}, false, err
+	}
+	if err := u.p.SetReservationOrder(r.ID, order.ID); err != nil {
+		return Order{}, false, err
+	}
+	return order, replayed, nil
+}
+
+// Отзыв гостя о заказе: общая оценка и, по желанию, оценки позиций
+type Feedback struct {
+	ID        int            `json:"id"`
+	OrderID   int            `json:"order_id"`
+	Rating    int            `json:"rating"`
+	Comment   string         `json:"comment"`
+	Items     []FeedbackItem `json:"items"`
+	CreatedAt string         `json:"created_at"`
+}
+
+type FeedbackItem struct {
+	OrderItemID int `json:"order_item_id"`
+	MenuItemID  int `json:"menu_item_id"`
+	Rating      int `json:"rating"`
+}
+
+// Отбор отзывов; MaxRating > 0 оставляет только оценки не выше заданной
+type FeedbackFilter struct {
+	LocationID int
+	From       *time.Time
+	To         *time.Time
+	MaxRating  int
+}
+
+// Средняя оценка позиции меню или сотрудника
+type RatingStat struct {
+	ID      int     `json:"id"`
+	Name    string  `json:"name"`
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+type FeedbackAnalytics struct {
+	Average float64      `json:"average"`
+	Count   int          `json:"count"`
+	Items   []RatingStat `json:"items"`
+	Staff   []RatingStat `json:"staff"`
+}
+
+const MaxFeedbackCommentSize = 1000
+
+var (
+	ErrFeedbackNotFound     = errors.New("feedback not found")
+	ErrFeedbackExists       = errors.New("feedback already submitted")
+	ErrInvalidFeedback      = errors.New("invalid feedback")
+	ErrInvalidFeedbackToken = errors.New("invalid feedback token")
+)
+
+// Подпись для ссылки на отзыв, которая печатается на чеке заказа
+func (u *Usecase) GetFeedbackToken(orderID int) string {
+	return u.jp.FeedbackToken(orderID)
+}
+
+// Отзыв гостя по подписанной ссылке; один отзыв на заказ
+func (u *Usecase) SubmitFeedback(token string, f Feedback) (Feedback, error) {
+	if !u.jp.ValidFeedbackToken(f.OrderID, token) {
+		return Feedback{}, ErrInvalidFeedbackToken
+	}
+	if f.Rating < 1 || f.Rating > 5 {
+		return Feedback{}, fmt.Errorf("%w: rating must be between 1 and 5", ErrInvalidFeedback)
+	}
+	if utf8.RuneCountInString(f.Comment) > MaxFeedbackCommentSize {
+		return Feedback{}, fmt.Errorf("%w: comment is too long", ErrInvalidFeedback)
+	}
+	seen := make(map[int]bool)
+	for _, item := range f.Items {
+		if item.Rating < 1 || item.Rating > 5 {
+			return Feedback{}, fmt.Errorf("%w: rating must be between 1 and 5", ErrInvalidFeedback)
+		}
+		if seen[item.OrderItemID] {
+			return Feedback{}, fmt.Errorf("%w: item %d is rated twice", ErrInvalidFeedback, item.OrderItemID)
+		}
+		seen[item.OrderItemID] = true
+	}
+	return u.p.AddFeedback(f)
+}
+
+func (u *Usecase) GetOrderFeedback(orderID int) (Feedback, error) {
+	return u.p.FetchOrderFeedback(orderID)
+}
+
+func (u *Usecase) GetFeedback(filter FeedbackFilter) ([]Feedback, error) {
+	return u.p.FetchFeedback(filter)
+}
+
+// Средние оценки по позициям меню и по кассирам, принявшим заказ
+func (u *Usecase) GetFeedbackAnalytics(filter FeedbackFilter) (FeedbackAnalytics, error) {
+	return u.p.FetchFeedbackAnalytics(filter)
+}
+
+// Чек заказа: реквизиты кафе, позиции с названиями и разбивка оплаты
+type Receipt struct {
+	Cafe        ReceiptConfig    `json:"cafe"`
+	Order       Order            `json:"order"`
+	Lines       []ReceiptLine    `json:"lines"`
+	Payments    []ReceiptPayment `json:"payments"`
+	FeedbackURL string           `json:"feedback_url,omitempty"`
+}
+
+type ReceiptLine struct {
+	Name     string  `json:"name"`
+	Quantity int     `json:"quantity"`
+	Price    float64 `json:"price"`
+	Amount   float64 `json:"amount"`
+	Comment  string  `json:"comment"`
+}
+
+type ReceiptPayment struct {
+	Method string  `json:"method"`
+	Amount float64 `json:"amount"`
+}
+
+func (u *Usecase) GetReceipt(orderID int) (Receipt, error) {
+	order, err := u.p.FetchOrder(orderID)
+	if err != nil {
+		return Receipt{}, err
+	}
+	// Названия берутся из базового меню: позиция могла стать недоступной на точке
+	menu, err := u.p.FetchMenuItems(0)
+	if err != nil {
+		return Receipt{}, err
+	}
+	names := make(map[int]string, len(menu))
+	for _, item := range menu {
+		names[item.ID] = item.Name
+	}
+
+	receipt := Receipt{Cafe: u.receipt, Order: order, Lines: []ReceiptLine{}, Payments: []ReceiptPayment{}}
+	for _, item := range order.Items {
+		name, ok := names[item.MenuItemId]
+		if !ok {
+			name = fmt.Sprintf("Позиция #%d", item.MenuItemId)
+		}
+		receipt.Lines = append(receipt.Lines, ReceiptLine{
+			Name:     name,
+			Quantity: item.Quantity,
+			Price:    item.Price,
+			Amount:   roundMoney(item.Price * float64(item.Quantity)),
+			Comment:  item.Comment,
+		})
+	}
+
+	// Баллы и подарочные карты оплачивают часть суммы, остаток — основной способ
+	if rest := roundMoney(order.Total - order.PointsAmount - order.GiftCardAmount); rest > 0 {
+		receipt.Payments = append(receipt.Payments, ReceiptPayment{Method: order.PaymentMethod, Amount: rest})
+	}
+	if order.PointsAmount > 0 {
+		receipt.Payments = append(receipt.Payments, ReceiptPayment{Method: PaymentPoints, Amount: order.PointsAmount})
+	}
+	if order.GiftCardAmount > 0 {
+		receipt.Payments = append(receipt.Payments, ReceiptPayment{Method: PaymentGiftCard, Amount: order.GiftCardAmount})
+	}
+
+	if u.receipt.FeedbackURL != "" {
+		receipt.FeedbackURL = strings.NewReplacer(
+			"{order}", strconv.Itoa(order.ID),
+			"{token}", u.jp.FeedbackToken(order.ID),
+		).Replace(u.receipt.FeedbackURL)
+	}
+	return receipt, nil
 }
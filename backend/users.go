@@ -0,0 +1,330 @@
+package main
+
+import (
+	"backend/pkg/vars"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Профиль пользователя. Деактивированный пользователь не может войти,
+// а выданные ему токены перестают приниматься.
+type User struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	Active    bool   `json:"active"`
+	Locations []int  `json:"locations"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Приглашение сотрудника. В базе хранится только хеш токена,
+// сам токен показывается владельцу один раз при создании.
+type Invite struct {
+	ID         int     `json:"id"`
+	Email      string  `json:"email"`
+	Role       string  `json:"role"`
+	Locations  []int64 `json:"locations"`
+	CreatedBy  string  `json:"created_by"`
+	ExpiresAt  string  `json:"expires_at"`
+	AcceptedAt *string `json:"accepted_at"`
+	CreatedAt  string  `json:"created_at"`
+	Token      string  `json:"token,omitempty"`
+	URL        string  `json:"url,omitempty"`
+}
+
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrUserExists        = errors.New("user already exists")
+	ErrUserInactive      = errors.New("user is deactivated")
+	ErrInvalidUser       = errors.New("invalid user data")
+	ErrLastOwner         = errors.New("cannot remove the last active owner")
+	ErrRegistrationClose = errors.New("registration is closed")
+	ErrInviteNotFound    = errors.New("invite not found")
+	ErrInviteExpired     = errors.New("invite expired or already used")
+	ErrWrongPassword     = errors.New("current password is wrong")
+	ErrSessionRevoked    = errors.New("session revoked")
+	ErrResetTokenInvalid = errors.New("reset token is invalid, expired or already used")
+)
+
+// Срок действия приглашения, если он не задан в настройках
+const defaultInviteTTLHours = 72
+
+// Срок действия ссылки для сброса пароля, если он не задан в настройках
+const defaultResetTTLMinutes = 60
+
+// Длина временного пароля при сбросе владельцем
+const tempPasswordSize = 12
+
+var userRoles = map[string]bool{
+	vars.RoleOwner: true,
+	vars.RoleStaff: true,
+}
+
+// Случайный токен для ссылок; возвращает сам токен и хеш для хранения
+func newSecretToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateTempPassword() (string, error) {
+	buf := make([]byte, tempPasswordSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = giftCardAlphabet[int(b)%len(giftCardAlphabet)]
+	}
+	return string(buf), nil
+}
+
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", fmt.Errorf("%w: invalid email", ErrInvalidUser)
+	}
+	return email, nil
+}
+
+// Профиль текущего пользователя по его токену
+func (u *Usecase) GetMe(userID int) (User, error) {
+	return u.p.FetchUser(userID)
+}
+
+func (u *Usecase) GetUsers() ([]User, error) {
+	return u.p.FetchUsers()
+}
+
+// Приглашение сотрудника с ролью и доступом к точкам
+func (u *Usecase) InviteUser(email, role string, locations []int64, createdBy string) (Invite, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return Invite{}, err
+	}
+	if role == "" {
+		role = vars.RoleStaff
+	}
+	if !userRoles[role] {
+		return Invite{}, fmt.Errorf("%w: unknown role %q", ErrInvalidUser, role)
+	}
+	if len(locations) == 0 && role == vars.RoleStaff && u.defaultLocationID > 0 {
+		locations = []int64{int64(u.defaultLocationID)}
+	}
+	if locations == nil {
+		locations = []int64{}
+	}
+
+	exist, err := u.p.CheckUserByEmail(email)
+	if err != nil {
+		return Invite{}, err
+	}
+	if exist {
+		return Invite{}, ErrUserExists
+	}
+
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return Invite{}, err
+	}
+	ttl := u.users.InviteTTLHours
+	if ttl <= 0 {
+		ttl = defaultInviteTTLHours
+	}
+	invite, err := u.p.AddInvite(hash, email, role, locations, createdBy, time.Duration(ttl)*time.Hour)
+	if err != nil {
+		return Invite{}, err
+	}
+	invite.Token = token
+	if u.users.InviteURL != "" {
+		invite.URL = strings.ReplaceAll(u.users.InviteURL, "{token}", token)
+	}
+	return invite, nil
+}
+
+// Действующие (непринятые и непросроченные) приглашения
+func (u *Usecase) GetInvites() ([]Invite, error) {
+	return u.p.FetchInvites()
+}
+
+func (u *Usecase) RevokeInvite(id int) error {
+	return u.p.DeleteInvite(id)
+}
+
+// Регистрация по приглашению: роль и точки берутся из приглашения
+func (u *Usecase) AcceptInvite(token, name, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.New("failed to hash password")
+	}
+	return u.p.AcceptInvite(hashToken(token), name, string(hashedPassword))
+}
+
+func (u *Usecase) SetUserRole(userID int, role string) (User, error) {
+	if !userRoles[role] {
+		return User{}, fmt.Errorf("%w: unknown role %q", ErrInvalidUser, role)
+	}
+	if err := u.p.SetUserRole(userID, role); err != nil {
+		return User{}, err
+	}
+	return u.p.FetchUser(userID)
+}
+
+func (u *Usecase) SetUserActive(userID int, active bool) (User, error) {
+	if err := u.p.SetUserActive(userID, active); err != nil {
+		return User{}, err
+	}
+	return u.p.FetchUser(userID)
+}
+
+// Сброс пароля владельцем. Без password генерируется временный пароль,
+// который возвращается один раз.
+func (u *Usecase) ResetUserPassword(userID int, password string) (string, error) {
+	if password == "" {
+		var err error
+		if password, err = generateTempPassword(); err != nil {
+			return "", err
+		}
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.New("failed to hash password")
+	}
+	if err := u.p.SetUserPassword(userID, string(hashedPassword)); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// Проверка токена на каждом защищённом запросе: пользователь не отключён,
+// а токен выдан после последней смены пароля
+func (u *Usecase) CheckSession(claims *vars.JWTClaims) error {
+	active, validAfter, err := u.p.FetchUserSession(claims.UserID)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrUserInactive
+	}
+	if validAfter != nil && (claims.IssuedAt == nil || claims.IssuedAt.Time.Before(*validAfter)) {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// Смена пароля с проверкой текущего. Прежние токены перестают действовать,
+// взамен возвращается новый.
+func (u *Usecase) ChangePassword(userID int, current, password string) (string, error) {
+	hashedPassword, err := u.p.FetchUserPassword(userID)
+	if err != nil {
+		return "", err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(current)); err != nil {
+		return "", ErrWrongPassword
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.New("failed to hash password")
+	}
+	if err := u.p.SetUserPassword(userID, string(newHash)); err != nil {
+		return "", err
+	}
+
+	user, err := u.p.FetchUser(userID)
+	if err != nil {
+		return "", err
+	}
+	access, err := u.p.FetchUserAccess(user.Email)
+	if err != nil {
+		return "", err
+	}
+	return u.jp.GenerateToken(access)
+}
+
+// Отправка ссылки для сброса пароля. Каждый запрос учитывается по адресу
+// и IP, частые дают ErrLoginThrottled. Письмо готовится и отправляется
+// в фоне: ни ответ, ни время ответа не показывают, есть ли такой
+// пользователь. Для неизвестного или отключённого адреса ничего не происходит.
+func (u *Usecase) RequestPasswordReset(email, ip string) error {
+	if err := u.resetLimiter.Allow(email, ip); err != nil {
+		return err
+	}
+	u.resetLimiter.Failure(email, ip)
+
+	go func() {
+		if err := u.sendPasswordReset(email); err != nil {
+			log.Printf("Error requesting password reset: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (u *Usecase) sendPasswordReset(email string) error {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil
+	}
+	access, err := u.p.FetchUserAccess(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !access.Active {
+		return nil
+	}
+
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	ttl := u.users.ResetTTLMinutes
+	if ttl <= 0 {
+		ttl = defaultResetTTLMinutes
+	}
+	if err := u.p.AddPasswordReset(access.ID, hash, time.Duration(ttl)*time.Minute); err != nil {
+		return err
+	}
+
+	link := token
+	if u.users.ResetURL != "" {
+		link = strings.ReplaceAll(u.users.ResetURL, "{token}", token)
+	}
+	return u.notifier.Send(Message{
+		To:      email,
+		Subject: "Сброс пароля",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\nЧтобы задать новый пароль, перейдите по ссылке "+
+			"или введите код в форме сброса:\n\n%s\n\nСсылка действует %d мин. и может быть использована один раз. "+
+			"Если вы не запрашивали сброс, просто проигнорируйте это письмо.\n", access.Name, link, ttl),
+	})
+}
+
+// Новый пароль по ссылке из письма; все выданные токены перестают действовать
+func (u *Usecase) ResetPassword(token, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.New("failed to hash password")
+	}
+	return u.p.ResetPassword(hashToken(token), string(hashedPassword))
+}
@@ -5,6 +5,8 @@ import '../styles/OrdersPage.css';
 function OrdersPage() {
   const [menuItems, setMenuItems] = useState([]);
   const [orders, setOrders] = useState([]);
+  const [nextCursor, setNextCursor] = useState('');
+  const [totalCount, setTotalCount] = useState(0);
   const [newOrder, setNewOrder] = useState([{ menuItemId: '', quantity: '1' }]);
   const [isAdding, setIsAdding] = useState(false);
   const [error, setError] = useState('');
@@ -37,10 +39,16 @@ function OrdersPage() {
     }
   };
 
-  const fetchOrders = async () => {
+  // Сервер отдаёт заказы страницами (новые сначала): без cursor загружается
+  // первая страница, с cursor — следующая дописывается к уже загруженным
+  const fetchOrders = async (cursor = '') => {
     try {
       const token = localStorage.getItem('token');
-      const response = await fetch('http://127.0.0.1:8885/api/orders', {
+      const params = new URLSearchParams({ sort: 'created_at', order: 'desc' });
+      if (cursor) {
+        params.set('cursor', cursor);
+      }
+      const response = await fetch(`http://127.0.0.1:8885/api/orders?${params}`, {
         method: 'GET',
         headers: {
           'Content-Type': 'application/json',
@@ -54,9 +62,9 @@ function OrdersPage() {
       }
 
       const data = await response.json();
-      // Сортировка заказов по дате создания (новые сначала)
-      const sortedData = [...data].sort((a, b) => new Date(b.created_at) - new Date(a.created_at));
-      setOrders(sortedData);
+      setOrders(prev => (cursor ? [...prev, ...data] : data));
+      setNextCursor(response.headers.get('X-Next-Cursor') || '');
+      setTotalCount(parseInt(response.headers.get('X-Total-Count'), 10) || 0);
     } catch (error) {
       setError(error.message);
     }
@@ -226,6 +234,12 @@ function OrdersPage() {
             ))}
           </tbody>
         </table>
+        <div className="orders-pagination">
+          <span>Показано {orders.length} из {totalCount}</span>
+          {nextCursor && (
+            <button onClick={() => fetchOrders(nextCursor)}>Показать ещё</button>
+          )}
+        </div>
       </div>
     </div>
   );